@@ -2,15 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/cloudlink-delta/bridge/server"
 	"github.com/cloudlink-delta/duplex"
+	"github.com/fsnotify/fsnotify"
 	"github.com/pion/webrtc/v4"
 	"github.com/rs/zerolog"
 	"github.com/spf13/pflag"
@@ -81,11 +85,178 @@ func parseICEServers(raw string) []webrtc.ICEServer {
 	return nil
 }
 
+func parseRateLimitCosts(raw map[string]any) (map[string]float64, error) {
+	costs := make(map[string]float64)
+	for command, value := range raw {
+		switch cost := value.(type) {
+		case float64:
+			costs[command] = cost
+		case int:
+			costs[command] = float64(cost)
+		case int64:
+			costs[command] = float64(cost)
+		default:
+			return nil, fmt.Errorf("invalid rate limit cost for %q: %v", command, value)
+		}
+	}
+	return costs, nil
+}
+
+// Parses log levels given either as names (i.e. "debug") or as numbers.
+func parseLogLevels(raw map[string]any) (map[string]zerolog.Level, error) {
+	levels := make(map[string]zerolog.Level, len(raw))
+	for subsystem, value := range raw {
+		switch level := value.(type) {
+		case string:
+			parsed, err := zerolog.ParseLevel(level)
+			if err != nil {
+				number, numErr := strconv.Atoi(level)
+				if numErr != nil {
+					return nil, fmt.Errorf("invalid log level for %q: %v", subsystem, value)
+				}
+				parsed = zerolog.Level(number)
+			}
+			levels[subsystem] = parsed
+		case float64:
+			levels[subsystem] = zerolog.Level(level)
+		case int:
+			levels[subsystem] = zerolog.Level(level)
+		default:
+			return nil, fmt.Errorf("invalid log level for %q: %v", subsystem, value)
+		}
+	}
+	return levels, nil
+}
+
+// Builds the server configuration from flags, environment variables and the config file.
+func loadServerConfig() (server.Config, error) {
+	costs, err := parseRateLimitCosts(viper.GetStringMap("rate_limit_costs"))
+	if err != nil {
+		return server.Config{}, err
+	}
+	levels, err := parseLogLevels(viper.GetStringMap("subsystem_log_levels"))
+	if err != nil {
+		return server.Config{}, err
+	}
+
+	return server.Config{
+		Designation:              viper.GetString("designation"),
+		Enable_MOTD:              viper.GetBool("enable_motd"),
+		MOTD_Message:             viper.GetString("motd_message"),
+		Serve_IP_Addresses:       viper.GetBool("serve_ip_addresses"),
+		Maximum_Rooms:            uint(viper.GetInt("maximum_rooms")),
+		Maximum_Room_Members:     uint(viper.GetInt("maximum_room_members")),
+		Maximum_Clients:          uint(viper.GetInt("maximum_clients")),
+		Maximum_Clients_Per_IP:   uint(viper.GetInt("maximum_clients_per_ip")),
+		IP_Limit_Exemptions:      viper.GetStringSlice("ip_limit_exemptions"),
+		Force_Set:                viper.GetBool("force_set"),
+		Address:                  viper.GetString("address"),
+		Enable_Rate_Limit:        viper.GetBool("enable_rate_limit"),
+		Rate_Limit_Burst:         viper.GetInt("rate_limit_burst"),
+		Rate_Limit_Interval:      viper.GetDuration("rate_limit_interval"),
+		Rate_Limit_Costs:         costs,
+		Rate_Limit_IP_Burst:      viper.GetInt("rate_limit_ip_burst"),
+		Kick_On_Rate_Limit:       viper.GetBool("kick_on_rate_limit"),
+		Shutdown_Message:         viper.GetString("shutdown_message"),
+		Shutdown_Timeout:         viper.GetDuration("shutdown_timeout"),
+		Slow_Consumer_Max_Drops:  viper.GetUint64("slow_consumer_max_drops"),
+		Slow_Consumer_Timeout:    viper.GetDuration("slow_consumer_timeout"),
+		Ping_Interval:            viper.GetDuration("ping_interval"),
+		Idle_Timeout:             viper.GetDuration("idle_timeout"),
+		Handshake_Timeout:        viper.GetDuration("handshake_timeout"),
+		Federated_Rooms:          viper.GetStringSlice("federated_rooms"),
+		Snowflake_Node:           viper.GetInt64("snowflake_node"),
+		Standalone_Mode:          viper.GetBool("standalone_mode"),
+		Disabled_Protocols:       viper.GetStringSlice("disabled_protocols"),
+		Enable_Compression:       viper.GetBool("enable_compression"),
+		Compression_Level:        viper.GetInt("compression_level"),
+		Compression_Threshold:    uint(viper.GetInt("compression_threshold")),
+		Uncompressed_Protocols:   viper.GetStringSlice("uncompressed_protocols"),
+		Log_Level:                zerolog.Level(viper.GetInt("log_level")),
+		Log_Format:               viper.GetString("log_format"),
+		Log_File:                 viper.GetString("log_file"),
+		Log_File_Max_Size:        viper.GetInt("log_file_max_size"),
+		Log_File_Backups:         viper.GetInt("log_file_backups"),
+		Subsystem_Log_Levels:     levels,
+		Log_Sample_Rate:          viper.GetUint32("log_sample_rate"),
+		Storage_Driver:           viper.GetString("storage_driver"),
+		Storage_Path:             viper.GetString("storage_path"),
+		Admin_Token:              viper.GetString("admin_token"),
+		Username_Policy:          viper.GetString("username_policy"),
+		Room_Username_Policies:   viper.GetStringMapString("room_username_policies"),
+		Scratch_Validation:       viper.GetBool("scratch_validation"),
+		Scratch_Max_Value_Length: viper.GetInt("scratch_max_value_length"),
+		Scratch_Max_Variables:    viper.GetInt("scratch_max_variables"),
+		Capture_Path:             viper.GetString("capture_path"),
+		TLS_Address:              viper.GetString("tls_address"),
+		TLS_Only:                 viper.GetBool("tls_only"),
+		TLS_Cert_File:            viper.GetString("tls_cert_file"),
+		TLS_Key_File:             viper.GetString("tls_key_file"),
+		TLS_Cert_Dir:             viper.GetString("tls_cert_dir"),
+		Allowed_Origins:          viper.GetStringSlice("allowed_origins"),
+		Room_Allowed_Origins:     viper.GetStringMapStringSlice("room_allowed_origins"),
+		Require_Origin:           viper.GetBool("require_origin"),
+		Auth_HMAC_Key:            viper.GetString("auth_hmac_key"),
+		Auth_Token_Name:          viper.GetString("auth_token_name"),
+		Require_Auth:             viper.GetBool("require_auth"),
+	}, nil
+}
+
+// Reads the list of predisposed instances from flags or the config file.
+func loadPredisposedInstances() []string {
+	if predisposedFlag := viper.GetString("predisposed_instances_flag"); predisposedFlag != "" {
+		return parsePredisposedInstances(predisposedFlag)
+	} else if viper.IsSet("predisposed_instances") {
+		data, _ := json.Marshal(viper.Get("predisposed_instances"))
+		return parsePredisposedInstances(string(data))
+	}
+	return nil
+}
+
+// Replays a capture file and returns the exit code.
+func replay(path string, cfg *server.Config) int {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open capture: %v", err)
+		return 2
+	}
+	defer file.Close()
+
+	records, err := server.Read_Capture(file)
+	if err != nil {
+		log.Printf("Failed to read capture: %v", err)
+		return 2
+	}
+
+	mismatches, err := server.Replay(cfg, records)
+	if err != nil {
+		log.Printf("Failed to replay capture: %v", err)
+		return 2
+	}
+
+	for _, mismatch := range mismatches {
+		log.Println(mismatch)
+	}
+	if len(mismatches) > 0 {
+		log.Printf("Replay differs from the capture in %d frame(s).", len(mismatches))
+		return 1
+	}
+	log.Printf("Replay matches the capture (%d records).", len(records))
+	return 0
+}
+
 func main() {
 
 	// CLI flags
 	pflag.Int("log-level", (int)(zerolog.InfoLevel), "Logging level to use. Acceptable values range from -1 to 7. (default: 1 \"Info\")")
+	pflag.String("log-format", "console", "Format of the logs: console or json")
+	pflag.String("log-file", "", "Write logs to this file instead of the standard output")
+	pflag.Int("log-file-max-size", 100, "Size in megabytes at which the log file is rotated. Never rotated if zero.")
+	pflag.Int("log-file-backups", 3, "Number of rotated log files to keep")
+	pflag.StringToString("subsystem-log-levels", nil, "Log levels of subsystems (rooms, cl2, cl4, scratch, delta), i.e. rooms=warn,cl4=debug")
+	pflag.Uint32("log-sample-rate", 0, "Only log one in this many debug messages of each subsystem. Everything is logged if zero.")
 	pflag.String("config", "", "Path to JSON configuration file, i.e. ~/config.json")
+	pflag.Bool("watch-config", false, "Reload the configuration file when it changes. It is always reloaded on SIGHUP.")
 	pflag.String("designation", "", "Globally unique designation (required)")
 	pflag.Bool("standalone", false, "Run in standalone mode (Only run the classic Clients server)")
 
@@ -103,13 +274,66 @@ func main() {
 	pflag.String("motd-message", "Welcome to the CloudLink Bridge!", "Message-of-the-day")
 	pflag.Bool("serve-ips", true, "Serve IP addresses to legacy CloudLink clients")
 	pflag.Int("max-rooms", 100, "Maximum number of rooms")
+	pflag.Uint("max-room-members", 0, "Maximum number of clients in a room. Unlimited if zero.")
 	pflag.Int("max-clients", 1000, "Maximum number of clients")
+	pflag.Uint("max-clients-per-ip", 0, "Maximum number of concurrent connections from a single IP address. Unlimited if zero.")
+	pflag.StringSlice("ip-limit-exemptions", nil, "Comma-separated list of addresses or CIDR ranges exempt from the per-IP connection limit")
 	pflag.Bool("force-set", true, "Force the use of the `set` ulist mode for legacy CloudLink clients")
 	pflag.String("address", "127.0.0.1:3000", "Legacy CloudLink listener address")
 	pflag.Bool("enable-rate-limit", true, "Enable rate limiting")
-	pflag.Int("rate-limit-burst", 50, "Maximum number of messages per interval for rate limiting")
-	pflag.Duration("rate-limit-interval", time.Second, "Interval for rate limiting")
+	pflag.Int("rate-limit-burst", 50, "Size of each client's rate limit bucket, in tokens. Most packets cost 1 token.")
+	pflag.Duration("rate-limit-interval", time.Second, "Time it takes to completely refill an empty rate limit bucket")
+	pflag.Int("rate-limit-ip-burst", 0, "Size of a rate limit bucket shared by all clients from the same IP address. Disabled if zero.")
 	pflag.Bool("kick-on-rate-limit", false, "Kick clients that exceed the rate limit. Otherwise, packets are dropped.")
+	pflag.String("shutdown-message", "This server is shutting down. Please reconnect later.", "Message sent to every classic client when the server shuts down")
+	pflag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for queued packets to be sent to clients when shutting down")
+	pflag.Uint64("slow-consumer-max-drops", 0, "Disconnect clients once this many packets to them were dropped because they can't keep up. Disabled if zero.")
+	pflag.Duration("slow-consumer-timeout", 0, "Disconnect clients whose send queue has been full for this long. Disabled if zero.")
+	pflag.Duration("ping-interval", 30*time.Second, "How often to send WebSocket pings to classic clients. Disabled if zero.")
+	pflag.Duration("idle-timeout", 90*time.Second, "Disconnect classic clients that send nothing, not even a pong, for this long. Disabled if zero.")
+	pflag.Duration("handshake-timeout", 0, "Disconnect classic clients that don't finish their handshake within this long. Disabled if zero, since older clients may connect without sending anything.")
+	pflag.StringSlice("federated-rooms", nil, "Comma-separated list of rooms to share with other bridges that federate them too")
+	pflag.Int64("snowflake-node", 0, "Node of the IDs given to clients, from 1 to 1023. Bridges that federate rooms must use different nodes. Derived from the designation if zero.")
+	pflag.StringSlice("disabled-protocols", nil, "Comma-separated list of classic protocols to disable (cl2, cl4, scratch)")
+	pflag.Bool("compression", false, "Negotiate permessage-deflate compression with classic clients")
+	pflag.Int("compression-level", server.Default_Compression_Level, "DEFLATE level of compressed frames, from -2 (Huffman only) to 9 (best compression)")
+	pflag.Uint("compression-threshold", server.Default_Compression_Threshold, "Size in bytes below which frames are sent uncompressed")
+	pflag.StringSlice("uncompressed-protocols", nil, "Comma-separated list of classic protocols that are never sent compressed frames (cl2, cl4, scratch)")
+
+	// Storage flags
+	pflag.String("storage-driver", "memory", "Backend used to persist room global variables. Acceptable values are \"memory\" and \"bolt\".")
+	pflag.String("storage-path", "bridge.db", "Path to the database file used by on-disk storage drivers")
+
+	// Scratch flags
+	pflag.Bool("scratch-validation", true, "Validate cloud variables from Scratch clients like the TurboWarp cloud server does")
+	pflag.Int("scratch-max-value-length", 100000, "Maximum length of a Scratch cloud variable value")
+	pflag.Int("scratch-max-variables", 128, "Maximum number of cloud variables per Scratch project")
+
+	// Username flags
+	pflag.String("username-policy", "allow", "What to do when a username is already in use in a room. Acceptable values are \"allow\", \"reject\" and \"kick\".")
+
+	// Admin API flags
+	pflag.String("admin-token", "", "Bearer token for the admin API. The admin API is disabled if left empty.")
+
+	// TLS flags
+	pflag.String("tls-address", "", "TLS listener address. TLS is disabled if left empty.")
+	pflag.Bool("tls-only", false, "Only serve the TLS listener")
+	pflag.String("tls-cert", "", "Path to the TLS certificate file")
+	pflag.String("tls-key", "", "Path to the TLS key file")
+	pflag.String("tls-cert-dir", "", "Directory of certificates (.crt or .pem) and keys (.key) with matching names, selected by SNI")
+
+	// Origin flags
+	pflag.StringSlice("allowed-origins", nil, "Comma-separated list of browser origins that may connect, e.g. https://turbowarp.org or https://*.example.com. Any origin is accepted if left empty.")
+	pflag.Bool("require-origin", false, "Reject clients that don't send an Origin header wherever an origin allowlist applies. Otherwise, they pass every allowlist.")
+
+	// Authentication flags
+	pflag.String("auth-hmac-key", "", "Shared key used to verify HS256-signed tokens of classic clients. Authentication is disabled if left empty.")
+	pflag.String("auth-token-name", "token", "Name of the query parameter and cookie that carry a token")
+	pflag.Bool("require-auth", false, "Disconnect classic clients that don't authenticate")
+
+	// Capture flags
+	pflag.String("capture", "", "Append every frame sent and received by classic clients to this JSONL file")
+	pflag.String("replay", "", "Replay a capture file against a local standalone server, print any differences and exit")
 
 	// Parse command-line flags
 	pflag.Usage = func() {
@@ -135,13 +359,57 @@ func main() {
 	viper.BindPFlag("motd_message", pflag.Lookup("motd-message"))
 	viper.BindPFlag("serve_ip_addresses", pflag.Lookup("serve-ips"))
 	viper.BindPFlag("maximum_rooms", pflag.Lookup("max-rooms"))
+	viper.BindPFlag("maximum_room_members", pflag.Lookup("max-room-members"))
 	viper.BindPFlag("maximum_clients", pflag.Lookup("max-clients"))
+	viper.BindPFlag("maximum_clients_per_ip", pflag.Lookup("max-clients-per-ip"))
+	viper.BindPFlag("ip_limit_exemptions", pflag.Lookup("ip-limit-exemptions"))
 	viper.BindPFlag("force_set", pflag.Lookup("force-set"))
 	viper.BindPFlag("address", pflag.Lookup("address"))
 	viper.BindPFlag("enable_rate_limit", pflag.Lookup("enable-rate-limit"))
 	viper.BindPFlag("rate_limit_burst", pflag.Lookup("rate-limit-burst"))
 	viper.BindPFlag("rate_limit_interval", pflag.Lookup("rate-limit-interval"))
+	viper.BindPFlag("rate_limit_ip_burst", pflag.Lookup("rate-limit-ip-burst"))
 	viper.BindPFlag("kick_on_rate_limit", pflag.Lookup("kick-on-rate-limit"))
+	viper.BindPFlag("shutdown_message", pflag.Lookup("shutdown-message"))
+	viper.BindPFlag("shutdown_timeout", pflag.Lookup("shutdown-timeout"))
+	viper.BindPFlag("slow_consumer_max_drops", pflag.Lookup("slow-consumer-max-drops"))
+	viper.BindPFlag("slow_consumer_timeout", pflag.Lookup("slow-consumer-timeout"))
+	viper.BindPFlag("ping_interval", pflag.Lookup("ping-interval"))
+	viper.BindPFlag("idle_timeout", pflag.Lookup("idle-timeout"))
+	viper.BindPFlag("handshake_timeout", pflag.Lookup("handshake-timeout"))
+	viper.BindPFlag("federated_rooms", pflag.Lookup("federated-rooms"))
+	viper.BindPFlag("snowflake_node", pflag.Lookup("snowflake-node"))
+	viper.BindPFlag("disabled_protocols", pflag.Lookup("disabled-protocols"))
+	viper.BindPFlag("enable_compression", pflag.Lookup("compression"))
+	viper.BindPFlag("compression_level", pflag.Lookup("compression-level"))
+	viper.BindPFlag("compression_threshold", pflag.Lookup("compression-threshold"))
+	viper.BindPFlag("uncompressed_protocols", pflag.Lookup("uncompressed-protocols"))
+	viper.BindPFlag("storage_driver", pflag.Lookup("storage-driver"))
+	viper.BindPFlag("storage_path", pflag.Lookup("storage-path"))
+	viper.BindPFlag("admin_token", pflag.Lookup("admin-token"))
+	viper.BindPFlag("username_policy", pflag.Lookup("username-policy"))
+	viper.BindPFlag("scratch_validation", pflag.Lookup("scratch-validation"))
+	viper.BindPFlag("scratch_max_value_length", pflag.Lookup("scratch-max-value-length"))
+	viper.BindPFlag("scratch_max_variables", pflag.Lookup("scratch-max-variables"))
+	viper.BindPFlag("tls_address", pflag.Lookup("tls-address"))
+	viper.BindPFlag("tls_only", pflag.Lookup("tls-only"))
+	viper.BindPFlag("tls_cert_file", pflag.Lookup("tls-cert"))
+	viper.BindPFlag("tls_key_file", pflag.Lookup("tls-key"))
+	viper.BindPFlag("tls_cert_dir", pflag.Lookup("tls-cert-dir"))
+	viper.BindPFlag("allowed_origins", pflag.Lookup("allowed-origins"))
+	viper.BindPFlag("require_origin", pflag.Lookup("require-origin"))
+	viper.BindPFlag("auth_hmac_key", pflag.Lookup("auth-hmac-key"))
+	viper.BindPFlag("auth_token_name", pflag.Lookup("auth-token-name"))
+	viper.BindPFlag("require_auth", pflag.Lookup("require-auth"))
+	viper.BindPFlag("watch_config", pflag.Lookup("watch-config"))
+	viper.BindPFlag("log_format", pflag.Lookup("log-format"))
+	viper.BindPFlag("log_file", pflag.Lookup("log-file"))
+	viper.BindPFlag("log_file_max_size", pflag.Lookup("log-file-max-size"))
+	viper.BindPFlag("log_file_backups", pflag.Lookup("log-file-backups"))
+	viper.BindPFlag("subsystem_log_levels", pflag.Lookup("subsystem-log-levels"))
+	viper.BindPFlag("log_sample_rate", pflag.Lookup("log-sample-rate"))
+	viper.BindPFlag("capture_path", pflag.Lookup("capture"))
+	viper.BindPFlag("replay", pflag.Lookup("replay"))
 
 	// Load values from environment variables
 	viper.AutomaticEnv()
@@ -154,25 +422,17 @@ func main() {
 		}
 	}
 
-	logging_level := zerolog.Level(viper.GetInt("log_level"))
-	designation := viper.GetString("designation")
-	standaloneMode := viper.GetBool("standalone_mode")
+	serverCfg, err := loadServerConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	logging_level := serverCfg.Log_Level
+	designation := serverCfg.Designation
+	standaloneMode := serverCfg.Standalone_Mode
 
-	serverCfg := server.Config{
-		Designation:         designation,
-		Enable_MOTD:         viper.GetBool("enable_motd"),
-		MOTD_Message:        viper.GetString("motd_message"),
-		Serve_IP_Addresses:  viper.GetBool("serve_ip_addresses"),
-		Maximum_Rooms:       uint(viper.GetInt("maximum_rooms")),
-		Maximum_Clients:     uint(viper.GetInt("maximum_clients")),
-		Force_Set:           viper.GetBool("force_set"),
-		Address:             viper.GetString("address"),
-		Enable_Rate_Limit:   viper.GetBool("enable_rate_limit"),
-		Rate_Limit_Burst:    viper.GetInt("rate_limit_burst"),
-		Rate_Limit_Interval: viper.GetDuration("rate_limit_interval"),
-		Kick_On_Rate_Limit:  viper.GetBool("kick_on_rate_limit"),
-		Standalone_Mode:     standaloneMode,
-		Log_Level:           logging_level,
+	// Replay a capture instead of running the bridge
+	if replayFile := viper.GetString("replay"); replayFile != "" {
+		os.Exit(replay(replayFile, &serverCfg))
 	}
 
 	duplexCfg := duplex.Config{
@@ -214,14 +474,7 @@ func main() {
 	instance := server.New(&serverCfg, &duplexCfg)
 
 	// Load predisposed instances if provided
-	var predisposedInstances []string
-	if predisposedFlag := viper.GetString("predisposed_instances_flag"); predisposedFlag != "" {
-		predisposedInstances = parsePredisposedInstances(predisposedFlag)
-	} else if viper.IsSet("predisposed_instances") {
-		data, _ := json.Marshal(viper.Get("predisposed_instances"))
-		predisposedInstances = parsePredisposedInstances(string(data))
-	}
-	if len(predisposedInstances) > 0 {
+	if predisposedInstances := loadPredisposedInstances(); len(predisposedInstances) > 0 {
 		instance.Predisposed_Instances = predisposedInstances
 	}
 
@@ -230,11 +483,56 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		log.Println("Shutting down... Send the signal again to exit immediately.")
+		go func() {
+			<-c
+			os.Exit(1)
+		}()
 		instance.Close <- true
 		<-instance.Done
-		os.Exit(1)
+		os.Exit(0)
+	}()
+
+	// Reload the configuration and certificates on SIGHUP, or when the config file changes
+	var reloadMux sync.Mutex
+	reload := func(reread bool) {
+		reloadMux.Lock()
+		defer reloadMux.Unlock()
+		if cfgFile := viper.ConfigFileUsed(); reread && cfgFile != "" {
+			if err := viper.ReadInConfig(); err != nil {
+				log.Printf("Failed to read config file: %v", err)
+				return
+			}
+		}
+		reloadedCfg, err := loadServerConfig()
+		if err != nil {
+			log.Printf("Failed to reload configuration: %v", err)
+			return
+		}
+		if _, err := instance.Reload_Config(&reloadedCfg); err != nil {
+			log.Printf("Failed to reload configuration: %v", err)
+		}
+		instance.Reload_Predisposed_Instances(loadPredisposedInstances())
+		if err := instance.Reload_Certificates(); err != nil {
+			log.Printf("Failed to reload certificates: %v", err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload(true)
+		}
 	}()
 
+	if viper.GetBool("watch_config") && viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(fsnotify.Event) {
+			reload(false)
+		})
+		viper.WatchConfig()
+	}
+
 	// Run the server
 	instance.Run()
 }
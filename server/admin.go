@@ -0,0 +1,244 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// AdminClient is the admin API's view of a classic client.
+type AdminClient struct {
+	ID       string   `json:"id"`
+	UUID     string   `json:"uuid"`
+	Username any      `json:"username,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	Dialect  string   `json:"dialect"`
+	Rooms    RoomKeys `json:"rooms"`
+	Roles    []string `json:"roles,omitempty"`
+	Drops    uint64   `json:"drops"`
+}
+
+// AdminRoom is the admin API's view of a room.
+type AdminRoom struct {
+	Name    RoomKey           `json:"name"`
+	Members []*CL4_UserObject `json:"members"`
+	Vars    map[string]any    `json:"gvars"`
+}
+
+type adminDisconnectRequest struct {
+	Code   uint   `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type adminVarRequest struct {
+	Value any `json:"value"`
+}
+
+type adminBroadcastRequest struct {
+	Message any `json:"message"`
+}
+
+// ConfigureAdmin registers the token-protected admin API under /admin.
+func (s *Server) ConfigureAdmin() {
+	admin := s.App.Group("/admin", s.admin_auth)
+
+	admin.Get("/clients", func(c fiber.Ctx) error {
+		return c.JSON(s.Admin_List_Clients())
+	})
+
+	admin.Post("/clients/:id/disconnect", func(c fiber.Ctx) error {
+		client := s.Find_Client(c.Params("id"))
+		if client == nil {
+			return fiber.ErrNotFound
+		}
+
+		var req adminDisconnectRequest
+		if len(c.Body()) > 0 {
+			if err := c.Bind().JSON(&req); err != nil {
+				return fiber.ErrBadRequest
+			}
+		}
+
+		// Without a code, the connection is dropped without a close frame.
+		if req.Code == 0 {
+			s.Logger.Warn().Msgf("%s 🔨 Disconnected by an administrator.", client.GiveName())
+			client.Conn.Close()
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+
+		code, ok := Lookup_Socket_Code(req.Code)
+		if !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "unknown close code")
+		}
+		if req.Reason != "" {
+			code.Message = req.Reason
+		}
+
+		s.Logger.Warn().Msgf("%s 🔨 Kicked by an administrator: %s", client.GiveName(), code.Message)
+		s.Evict_Client(client, code)
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	admin.Get("/ips", func(c fiber.Ctx) error {
+		return c.JSON(s.Connections_Per_IP())
+	})
+
+	admin.Get("/rooms", func(c fiber.Ctx) error {
+		return c.JSON(s.Admin_List_Rooms())
+	})
+
+	admin.Put("/rooms/:room/vars/:name", func(c fiber.Ctx) error {
+		room, name, err := admin_room_and_var(c)
+		if err != nil {
+			return err
+		}
+
+		var req adminVarRequest
+		if err := c.Bind().JSON(&req); err != nil {
+			return fiber.ErrBadRequest
+		}
+
+		if !s.SetRoomGlobalVar(nil, room, name, req.Value) {
+			return fiber.ErrNotFound
+		}
+
+		s.Broadcast(room, &Common_Packet{
+			Command: "gvar",
+			Name:    name,
+			Value:   req.Value,
+			Rooms:   room,
+		})
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	admin.Delete("/rooms/:room/vars/:name", func(c fiber.Ctx) error {
+		room, name, err := admin_room_and_var(c)
+		if err != nil {
+			return err
+		}
+
+		if !s.DeleteRoomGlobalVar(room, name) {
+			return fiber.ErrNotFound
+		}
+
+		s.Broadcast(room, &Common_Packet{
+			Command: "gvar_delete",
+			Name:    name,
+			Rooms:   room,
+		})
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	admin.Post("/rooms/:room/broadcast", func(c fiber.Ctx) error {
+		room, err := url.PathUnescape(c.Params("room"))
+		if err != nil {
+			return fiber.ErrBadRequest
+		}
+
+		var req adminBroadcastRequest
+		if err := c.Bind().JSON(&req); err != nil {
+			return fiber.ErrBadRequest
+		}
+
+		if !s.DoesRoomExist(RoomKey(room)) {
+			return fiber.ErrNotFound
+		}
+
+		s.Broadcast(RoomKey(room), &Common_Packet{
+			Command: "gmsg",
+			Value:   req.Message,
+			Rooms:   RoomKey(room),
+		})
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+}
+
+// Rejects any request that doesn't carry the configured admin token.
+func (s *Server) admin_auth(c fiber.Ctx) error {
+	token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.Config().Admin_Token)) != 1 {
+		return fiber.ErrUnauthorized
+	}
+	return c.Next()
+}
+
+func admin_room_and_var(c fiber.Ctx) (RoomKey, string, error) {
+	room, err := url.PathUnescape(c.Params("room"))
+	if err != nil {
+		return "", "", fiber.ErrBadRequest
+	}
+	name, err := url.PathUnescape(c.Params("name"))
+	if err != nil {
+		return "", "", fiber.ErrBadRequest
+	}
+	return RoomKey(room), name, nil
+}
+
+// Find_Client returns the classic client with a matching ID or UUID, or nil if there is none.
+func (s *Server) Find_Client(id string) *BridgeClient {
+	s.classicclientsmu.RLock()
+	defer s.classicclientsmu.RUnlock()
+	for client := range s.ClassicClients {
+		if client.ID == id || client.UUID == id {
+			return client
+		}
+	}
+	return nil
+}
+
+// Admin_List_Clients returns a snapshot of every connected classic client.
+func (s *Server) Admin_List_Clients() []AdminClient {
+	s.classicclientsmu.RLock()
+	clients := make(BridgeClients, 0, len(s.ClassicClients))
+	for client := range s.ClassicClients {
+		clients = append(clients, client)
+	}
+	s.classicclientsmu.RUnlock()
+
+	list := make([]AdminClient, 0, len(clients))
+	for _, client := range clients {
+		entry := AdminClient{
+			ID:       client.ID,
+			UUID:     client.UUID,
+			Username: client.GetUsername(),
+			Dialect:  Dialect_Name(client.GetDialect()),
+			Rooms:    client.GetRooms(),
+			Drops:    client.GetDrops(),
+		}
+		if identity := client.GetIdentity(); identity != nil {
+			entry.Roles = identity.Roles
+		}
+		if protocol := client.GetProtocol(); protocol != nil {
+			entry.Protocol = protocol.Name()
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// Admin_List_Rooms returns a snapshot of every open room, its members and its global variables.
+func (s *Server) Admin_List_Rooms() []AdminRoom {
+	rooms := s.Get_Rooms()
+	list := make([]AdminRoom, 0, len(rooms))
+	for _, room := range rooms {
+		entry := AdminRoom{
+			Name:    room,
+			Members: make([]*CL4_UserObject, 0),
+			Vars:    make(map[string]any),
+		}
+		for _, client := range s.Copy_Clients(room) {
+			entry.Members = append(entry.Members, s.UserObject(client))
+		}
+		if gv := s.GetRoomGlobalVars(room); gv != nil {
+			gv.Range(func(key, value any) bool {
+				entry.Vars[fmt.Sprintf("%v", key)] = value
+				return true
+			})
+		}
+		list = append(list, entry)
+	}
+	return list
+}
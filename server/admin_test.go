@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+	config := New_Test_Config()
+	config.Admin_Token = "secret"
+	b := Start_Test_Bridge(t, config)
+
+	// Sends a request to the admin API, and returns its status and body
+	request := func(method string, path string, token string, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://"+b.Address+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		b.Settle()
+		return res.StatusCode, string(data)
+	}
+
+	connect := func(name string) *Test_Client {
+		c := b.Connect(name)
+		c.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+		c.Send(`{"cmd":"setid","val":"` + name + `"}`)
+		return c
+	}
+	alice, bob := connect("alice"), connect("bob")
+	b.Settle()
+	bob.Drain()
+
+	// Requests without the token are refused
+	for token, want := range map[string]int{"": 401, "wrong": 401, "secret": 200} {
+		if status, _ := request("GET", "/admin/clients", token, ""); status != want {
+			t.Errorf("listing clients with token %q returned %d, expected %d", token, status, want)
+		}
+	}
+	if _, body := request("GET", "/admin/clients", "secret", ""); !strings.Contains(body, `"username":"alice"`) || !strings.Contains(body, `"dialect":"cl4-0.2.0"`) {
+		t.Errorf("client list is missing alice: %s", body)
+	}
+
+	// Variables
+	if status, _ := request("PUT", "/admin/rooms/default/vars/score", "secret", `{"value":5}`); status != 204 {
+		t.Errorf("setting a variable returned %d", status)
+	}
+	if got := received(bob, "gvar"); len(got) != 1 || got[0].Name != "score" || fmt.Sprint(got[0].Value) != "5" {
+		t.Errorf("bob received %+v, expected the variable", got)
+	}
+	if _, body := request("GET", "/admin/rooms", "secret", ""); !strings.Contains(body, `"gvars":{"score":5}`) {
+		t.Errorf("room list is missing the variable: %s", body)
+	}
+	if status, _ := request("PUT", "/admin/rooms/missing/vars/score", "secret", `{"value":5}`); status != 404 {
+		t.Errorf("setting a variable of a missing room returned %d, expected 404", status)
+	}
+	if status, _ := request("DELETE", "/admin/rooms/default/vars/score", "secret", ""); status != 204 {
+		t.Errorf("deleting a variable returned %d", status)
+	}
+	if got := received(bob, "gvar_delete"); len(got) != 1 || got[0].Name != "score" {
+		t.Errorf("bob received %+v, expected the deletion", got)
+	}
+	if status, _ := request("DELETE", "/admin/rooms/default/vars/score", "secret", ""); status != 404 {
+		t.Errorf("deleting a missing variable returned %d, expected 404", status)
+	}
+
+	// Broadcasts
+	if status, _ := request("POST", "/admin/rooms/default/broadcast", "secret", `{"message":"hello"}`); status != 204 {
+		t.Errorf("broadcasting returned %d", status)
+	}
+	if got := received(bob, "gmsg"); len(got) != 1 || got[0].Value != "hello" {
+		t.Errorf("bob received %+v, expected the broadcast", got)
+	}
+
+	// Kicks
+	if status, _ := request("POST", "/admin/clients/nobody/disconnect", "secret", ""); status != 404 {
+		t.Errorf("kicking a missing client returned %d, expected 404", status)
+	}
+	if status, _ := request("POST", "/admin/clients/"+alice.ID+"/disconnect", "secret", `{"code":1}`); status != 400 {
+		t.Errorf("kicking with an unknown close code returned %d, expected 400", status)
+	}
+	if status, _ := request("POST", "/admin/clients/"+alice.UUID+"/disconnect", "secret", fmt.Sprintf(`{"code":%d,"reason":"Go away"}`, Identity_Error.Code)); status != 204 {
+		t.Errorf("kicking alice returned %d", status)
+	}
+	<-alice.done
+	if frames := alice.Drain(); !slices.Contains(frames, fmt.Sprintf("close %d Go away", Identity_Error.Code)) {
+		t.Errorf("alice wasn't closed with %d: %v", Identity_Error.Code, frames)
+	}
+}
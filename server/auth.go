@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// Identity is what an Authenticator verified about a classic client.
+type Identity struct {
+
+	// The only username the client may use.
+	Username string `json:"username"`
+
+	// Roles granted to the client.
+	Roles []string `json:"roles,omitempty"`
+}
+
+func (i *Identity) Has_Role(role string) bool {
+	return i != nil && slices.Contains(i.Roles, role)
+}
+
+// Authenticator verifies the tokens that classic clients present. Tokens are read from a query parameter or
+// cookie when connecting (see Config.Auth_Token_Name), or from the "token" field of a CL4 handshake.
+type Authenticator interface {
+
+	// Returns the identity proven by a token, or an error if the token is not valid.
+	Authenticate(token string) (*Identity, error)
+}
+
+// HMAC_Authenticator verifies JWTs signed with HS256 and a shared key. The "sub" claim is the username, and
+// the optional "roles" claim grants roles. The "exp" and "nbf" claims are honored if present.
+type HMAC_Authenticator struct {
+	key []byte
+}
+
+func New_HMAC_Authenticator(key string) *HMAC_Authenticator {
+	return &HMAC_Authenticator{key: []byte(key)}
+}
+
+type hmac_header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+type hmac_claims struct {
+	Subject   string   `json:"sub"`
+	Roles     []string `json:"roles,omitempty"`
+	Expires   int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+}
+
+func (a *HMAC_Authenticator) sign(data string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (a *HMAC_Authenticator) Authenticate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	// The algorithm is checked before anything else, so that no other algorithm is ever trusted
+	var header hmac_header
+	if err := decode_token_part(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Algorithm != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, a.sign(parts[0]+"."+parts[1])) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims hmac_claims
+	if err := decode_token_part(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if claims.Expires != 0 && now >= claims.Expires {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return &Identity{Username: claims.Subject, Roles: claims.Roles}, nil
+}
+
+// Sign issues a token for an identity. A token with a zero lifetime never expires.
+func (a *HMAC_Authenticator) Sign(identity Identity, lifetime time.Duration) (string, error) {
+	claims := hmac_claims{Subject: identity.Username, Roles: identity.Roles}
+	if lifetime != 0 {
+		claims.Expires = time.Now().Add(lifetime).Unix()
+	}
+
+	header, err := json.Marshal(hmac_header{Algorithm: "HS256", Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(a.sign(unsigned)), nil
+}
+
+func decode_token_part(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// Creates the authenticator selected by the configuration. Returns nil if authentication is disabled.
+func new_authenticator(config *Config) Authenticator {
+	if config.Authenticator != nil {
+		return config.Authenticator
+	}
+	if config.Auth_HMAC_Key != "" {
+		return New_HMAC_Authenticator(config.Auth_HMAC_Key)
+	}
+	return nil
+}
+
+// Name of the query parameter and cookie that carry a token.
+func (s *Server) auth_token_name() string {
+	if s.Config().Auth_Token_Name == "" {
+		return "token"
+	}
+	return s.Config().Auth_Token_Name
+}
+
+// Authenticate_Token verifies a token and pins the resulting identity to a client. Once pinned, a client may only
+// present tokens for the same username, which refresh its roles. Clients that present an invalid token, or a token
+// for someone else, are disconnected with Identity_Error.
+func (s *Server) Authenticate_Token(c *BridgeClient, token string) bool {
+	if s.auth == nil || token == "" {
+		return true
+	}
+
+	identity, err := s.auth.Authenticate(token)
+	if err != nil {
+		s.Logger.Warn().Msgf("%s ⚠️  Authentication failed: %v", c.GiveName(), err)
+		s.Evict_Client(c, Identity_Error)
+		return false
+	}
+
+	if pinned := c.GetIdentity(); pinned != nil && pinned.Username != identity.Username {
+		s.Logger.Warn().Msgf("%s ⚠️  Authentication failed: Already authenticated as %s, not %s.", c.GiveName(), pinned.Username, identity.Username)
+		s.Evict_Client(c, Identity_Error)
+		return false
+	}
+
+	c.SetIdentity(identity)
+	s.Logger.Debug().Msgf("%s 🔑 Authenticated as %s", c.GiveName(), identity.Username)
+	return true
+}
+
+// Require_Identity disconnects a client with Identity_Error if authentication is required and it hasn't authenticated.
+func (s *Server) Require_Identity(c *BridgeClient) bool {
+	if !s.Config().Require_Auth || c.GetIdentity() != nil {
+		return true
+	}
+	s.Logger.Warn().Msgf("%s ⚠️  Aborting connection to client: Not authenticated.", c.GiveName())
+	s.Evict_Client(c, Identity_Error)
+	return false
+}
+
+// Pinned_Username reports whether a client may use a username. Authenticated clients may only use the
+// username of their identity.
+func (s *Server) Pinned_Username(c *BridgeClient, username any) bool {
+	identity := c.GetIdentity()
+	return identity == nil || fmt.Sprintf("%v", username) == identity.Username
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	auth := New_HMAC_Authenticator("secret")
+
+	token, err := auth.Sign(Identity{Username: "alice", Roles: []string{"moderator"}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := auth.Authenticate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "alice" || !identity.Has_Role("moderator") {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	expired, _ := auth.Sign(Identity{Username: "alice"}, -time.Minute)
+	forged, _ := New_HMAC_Authenticator("not the secret").Sign(Identity{Username: "alice"}, 0)
+	parts := strings.Split(token, ".")
+	unsigned := parts[0] + "." + parts[1] + "."
+
+	// Signed with the right key, but claiming another algorithm
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	other_algorithm := header + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(auth.sign(header+"."+parts[1]))
+
+	for name, bad := range map[string]string{"expired": expired, "forged": forged, "unsigned": unsigned, "other algorithm": other_algorithm, "garbage": "garbage"} {
+		if _, err := auth.Authenticate(bad); err == nil {
+			t.Errorf("%s token was accepted", name)
+		}
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	config := New_Test_Config()
+	config.Auth_HMAC_Key = "secret"
+	config.Require_Auth = true
+	b := Start_Test_Bridge(t, config)
+
+	token, err := New_HMAC_Authenticator("secret").Sign(Identity{Username: "alice"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := "/?token=" + url.QueryEscape(token)
+
+	// Without a token
+	if _, code := b.Exchange("/", nil, "<%sn>\nalice"); code != int(Identity_Error.Code) {
+		t.Errorf("unauthenticated CL2 client closed with %d, expected %d", code, Identity_Error.Code)
+	}
+	if _, code := b.Exchange("/", nil, `{"cmd":"handshake"}`); code != int(Identity_Error.Code) {
+		t.Errorf("unauthenticated CL4 client closed with %d, expected %d", code, Identity_Error.Code)
+	}
+
+	// With an invalid token
+	if _, code := b.Exchange("/?token=garbage", nil); code != int(Identity_Error.Code) {
+		t.Errorf("invalid token closed with %d, expected %d", code, Identity_Error.Code)
+	}
+
+	// With a token in the query string or a cookie
+	if _, code := b.Exchange(query, nil, `{"method":"handshake","project_id":"1","user":"alice"}`); code != 0 {
+		t.Errorf("authenticated Scratch client closed with %d", code)
+	}
+	cookie := http.Header{"Cookie": {"token=" + token}}
+	if _, code := b.Exchange("/", cookie, `{"method":"handshake","project_id":"1","user":"mallory"}`); code != int(Identity_Error.Code) {
+		t.Errorf("Scratch client using someone else's username closed with %d, expected %d", code, Identity_Error.Code)
+	}
+
+	// With a token in the CL4 handshake
+	frames, code := b.Exchange("/", nil,
+		`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0","token":"`+token+`"}}`,
+		`{"cmd":"setid","val":"mallory","listener":"a"}`,
+		`{"cmd":"setid","val":"alice","listener":"b"}`,
+	)
+	if code != 0 {
+		t.Fatalf("authenticated CL4 client closed with %d", code)
+	}
+	transcript := strings.Join(frames, "\n")
+	if !strings.Contains(transcript, `"listener":"a","code":"E:108 | Refused"`) {
+		t.Errorf("CL4 client could use someone else's username:\n%s", transcript)
+	}
+	if !strings.Contains(transcript, `"listener":"b","code":"I:100 | OK"`) {
+		t.Errorf("CL4 client could not use its own username:\n%s", transcript)
+	}
+
+	// Handshaking again may only refresh the identity, not replace it
+	other, err := New_HMAC_Authenticator("secret").Sign(Identity{Username: "mallory"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(token string) string {
+		return `{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0","token":"` + token + `"}}`
+	}
+	if _, code := b.Exchange("/", nil, handshake(token), handshake(token)); code != 0 {
+		t.Errorf("CL4 client handshaking again as itself closed with %d", code)
+	}
+	if _, code := b.Exchange("/", nil, handshake(token), handshake(other)); code != int(Identity_Error.Code) {
+		t.Errorf("CL4 client handshaking again as someone else closed with %d, expected %d", code, Identity_Error.Code)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// Directions of a captured record.
+const (
+	Capture_Open  = "open"  // The client connected
+	Capture_Rx    = "rx"    // Frame sent by the client
+	Capture_Tx    = "tx"    // Frame sent to the client
+	Capture_Close = "close" // The client disconnected
+)
+
+// Capture_Record is a single line of a traffic capture.
+type Capture_Record struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Client    string    `json:"client"` // UUID
+	ID        string    `json:"id"`
+	Protocol  string    `json:"protocol"`
+	Dialect   string    `json:"dialect"`
+	Frame     string    `json:"frame,omitempty"`
+	Binary    bool      `json:"binary,omitempty"` // The frame was MessagePack, and is recorded as the equivalent JSON
+}
+
+// Recorder appends the traffic of classic clients to a JSONL file. A nil Recorder records nothing.
+type Recorder struct {
+	mux  sync.Mutex
+	file *os.File
+}
+
+func New_Recorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: file}, nil
+}
+
+// Record writes a single record for a client. Errors are ignored, since a capture must never affect the traffic itself.
+func (r *Recorder) Record(c *BridgeClient, direction string, frame []byte) {
+	r.record(c, direction, frame, false)
+}
+
+// Record_Binary records a MessagePack frame that was converted to JSON.
+func (r *Recorder) Record_Binary(c *BridgeClient, direction string, frame []byte) {
+	r.record(c, direction, frame, true)
+}
+
+func (r *Recorder) record(c *BridgeClient, direction string, frame []byte, binary bool) {
+	if r == nil {
+		return
+	}
+
+	line, err := json.Marshal(&Capture_Record{
+		Time:      time.Now(),
+		Direction: direction,
+		Client:    c.UUID,
+		ID:        c.ID,
+		Protocol:  client_protocol(c),
+		Dialect:   Dialect_Name(c.GetDialect()),
+		Frame:     string(frame),
+		Binary:    binary,
+	})
+	if err != nil {
+		return
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.file.Write(append(line, '\n'))
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.file.Close()
+}
+
+// Read_Capture parses every record of a JSONL capture.
+func Read_Capture(r io.Reader) ([]Capture_Record, error) {
+	var records []Capture_Record
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Capture_Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
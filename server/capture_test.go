@@ -0,0 +1,81 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func record_session(t *testing.T) []Capture_Record {
+	config := New_Test_Config()
+	config.Capture_Path = filepath.Join(t.TempDir(), "capture.jsonl")
+
+	b := Start_Test_Bridge(t, config)
+	tr := b.Transcript()
+	cl2 := b.Connect("cl2")
+	cl4 := b.Connect("cl4")
+	scratch := b.Connect("scratch")
+	msgpack := b.Connect("msgpack")
+
+	tr.Step(cl2, "<%sh>\n")
+	tr.Step(cl2, "<%sn>\ncl2")
+	tr.Step(cl4, `{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	tr.Step(cl4, `{"cmd":"setid","val":"cl4","listener":"id"}`)
+	tr.Step(scratch, `{"method":"handshake","project_id":"default","user":"scratch"}`)
+	tr.Step_MessagePack(msgpack, `{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	tr.Step_MessagePack(msgpack, `{"cmd":"setid","val":"msgpack","listener":"id"}`)
+	tr.Step(cl4, `{"cmd":"gvar","name":"☁ score","val":"1"}`)
+	tr.Step(scratch, `{"method":"set","name":"☁ score","value":"2"}`)
+	tr.Step(cl2, "<%gs>\ncl2\nhello")
+	tr.Step_MessagePack(msgpack, `{"cmd":"gmsg","val":{"x":1,"y":2.5}}`)
+	tr.Disconnect(scratch)
+
+	file, err := os.Open(config.Capture_Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	records, err := Read_Capture(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestReplayMatchesCapture(t *testing.T) {
+	records := record_session(t)
+
+	mismatches, err := Replay(New_Test_Config(), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mismatch := range mismatches {
+		t.Error(mismatch)
+	}
+}
+
+func TestReplayReportsDifferences(t *testing.T) {
+	records := record_session(t)
+
+	// Pretend the bridge used to send something else
+	tampered := false
+	for i := range records {
+		if records[i].Direction == Capture_Tx {
+			records[i].Frame = `{"cmd":"gmsg","val":"not what was sent"}`
+			tampered = true
+			break
+		}
+	}
+	if !tampered {
+		t.Fatal("capture has no frames sent to clients")
+	}
+
+	mismatches, err := Replay(New_Test_Config(), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 {
+		t.Fatalf("expected exactly one mismatch, got %d: %v", len(mismatches), mismatches)
+	}
+}
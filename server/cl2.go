@@ -22,6 +22,10 @@ type CL2 struct {
 	linksMu sync.RWMutex             // Mutex for thread-safe map access
 }
 
+func init() {
+	Register_Protocol(Protocol_CL2, 30, New_CL2)
+}
+
 func New_CL2(parent *Server) Protocol {
 	return &CL2{
 		Server: parent,
@@ -71,6 +75,10 @@ func New_CL2(parent *Server) Protocol {
 	}
 }
 
+func (*CL2) Name() string {
+	return Protocol_CL2
+}
+
 func (s *CL2) On_Disconnect(c *BridgeClient, rooms RoomKeys) {
 	s.linksMu.Lock()
 	delete(s.links, c)
@@ -144,10 +152,17 @@ func (s *CL2) Reader(client *BridgeClient, data []byte) bool {
 	}
 
 	if !parsed {
-		s.Logger.Error().Msgf("Failed to parse CL2 packet: %s", message)
+		s.Log(Subsystem_CL2).Error().Msgf("Failed to parse CL2 packet: %s", message)
 		return false
 	}
 
+	s.Metrics.Packets_Received.Inc(Protocol_CL2, metric_command(p.Command))
+
+	// CL2 has no way to report errors, so throttled packets are dropped silently
+	if ok, _ := s.Allow_Packet(client, p.Command); !ok {
+		return true
+	}
+
 	go s.Handler(client, p)
 	return true
 }
@@ -157,7 +172,7 @@ func (s *CL2) Handler(client *BridgeClient, p *CL2Packet) {
 		return
 	}
 
-	s.Logger.Debug().Any("packet", p).Any("client", client).Msg("Received CL2 packet")
+	s.Log(Subsystem_CL2).Debug().Any("packet", p).Any("client", client).Msg("Received CL2 packet")
 
 	if client.Conn != nil {
 		s.classicclientsmu.RLock()
@@ -168,6 +183,10 @@ func (s *CL2) Handler(client *BridgeClient, p *CL2Packet) {
 		}
 	}
 
+	if !s.Require_Identity(client) {
+		return
+	}
+
 	if client.GetDialect() == Dialect_Undefined {
 		if p.Command == "sh" {
 			s.Upgrade_Dialect(client, Dialect_CL2_Late)
@@ -176,6 +195,9 @@ func (s *CL2) Handler(client *BridgeClient, p *CL2Packet) {
 		}
 	}
 
+	// The sh command is optional, so any packet completes the handshake
+	client.Complete_Handshake()
+
 	switch p.Command {
 	case "sh":
 		s.Unicast(client, &Common_Packet{Command: "server_version", Value: "0.1.5"})
@@ -201,7 +223,17 @@ func (s *CL2) Handler(client *BridgeClient, p *CL2Packet) {
 		if usernameVal != nil && usernameVal != "" {
 			return
 		}
-		client.SetUsername(p.Sender)
+
+		// CL2 has no way to report errors, so conflicts close the connection
+		if !s.Pinned_Username(client, p.Sender) {
+			s.Evict_Client(client, Identity_Error)
+			return
+		}
+		if !s.Claim_Username(client, p.Sender, client.GetRooms()) {
+			s.Respond_With_Code(client.Conn, Username_Error)
+			client.Conn.Close()
+			return
+		}
 
 		s.Unicast(client, &Common_Packet{
 			Command: "ulist",
@@ -262,7 +294,11 @@ func (s *CL2) Handler(client *BridgeClient, p *CL2Packet) {
 				}, targets)
 			}
 		case "1":
-			// Mode 1: Standard Global Variable Broadcast
+			// Mode 1: Standard Global Variable Broadcast. CL2 can't be told about invalid variables, so they are dropped
+			if err := s.Check_Variable_Rules(DEFAULT_ROOM, "set", p.Var, nil, p.Data); err != nil {
+				s.Log(Subsystem_CL2).Warn().Any("client", client).Any("gvar", p.Var).Msgf("Dropped global variable: %v.", err)
+				return
+			}
 			s.SetRoomGlobalVar(client, DEFAULT_ROOM, p.Var, p.Data)
 			s.Broadcast(DEFAULT_ROOM, &Common_Packet{
 				Command: "gvar",
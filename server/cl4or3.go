@@ -1,11 +1,17 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/goccy/go-json"
 )
 
+func init() {
+	Register_Protocol(Protocol_CL4, 10, New_CL4_or_CL3)
+}
+
 // Creates a new instance of the protocol handler.
 func New_CL4_or_CL3(parent *Server) Protocol {
 	return &CL4_or_CL3{
@@ -14,6 +20,10 @@ func New_CL4_or_CL3(parent *Server) Protocol {
 	}
 }
 
+func (CL4_or_CL3) Name() string {
+	return Protocol_CL4
+}
+
 func (s CL4_or_CL3) On_Disconnect(c *BridgeClient, rooms RoomKeys) { // (And Scratch_Handler)
 	username := c.GetUsername()
 	if username == nil || username == "" {
@@ -35,33 +45,48 @@ func (s CL4_or_CL3) On_Disconnect(c *BridgeClient, rooms RoomKeys) { // (And Scr
 func (s CL4_or_CL3) Reader(client *BridgeClient, data []byte) bool {
 	// Check if the data is even remotely usable
 	if !json.Valid(data) {
-		s.Logger.Error().Msg("CL4/CL3 Reader: Invalid JSON received")
+		s.Log(Subsystem_CL4).Error().Msg("CL4/CL3 Reader: Invalid JSON received")
 		return false
 	}
 
 	// Schema validation
 	result := s.Schema.Validate(data)
 	if !result.IsValid() {
-		s.Logger.Error().Msgf("CL4/CL3 Packet failed schema validation: %v", result)
+		s.Log(Subsystem_CL4).Error().Msgf("CL4/CL3 Packet failed schema validation: %v", result)
 		return false
 	}
 
 	// Unmarshal into the struct
 	var p *Common_Packet
 	if err := json.Unmarshal(data, &p); err != nil {
-		s.Logger.Error().Msgf("CL4/CL3 JSON Unmarshal Error: %s", err)
+		s.Log(Subsystem_CL4).Error().Msgf("CL4/CL3 JSON Unmarshal Error: %s", err)
 		return false
 	}
 
 	// Basic check: Command must exist
 	if p.Command == "" {
-		s.Logger.Error().Msg("CL4/CL3 Reader: Packet missing required 'cmd' field")
+		s.Log(Subsystem_CL4).Error().Msg("CL4/CL3 Reader: Packet missing required 'cmd' field")
 		return false
 	}
 
+	s.Metrics.Packets_Received.Inc(Protocol_CL4, metric_command(p.Command))
+
 	// Attempt to auto-detect (or upgrade) the protocol dialect
 	s.Derive_Dialect(p, client)
 
+	// Dialects before CL4 0.1.9 have no handshake
+	if client.GetDialect() < Dialect_CL4_0_1_9 {
+		client.Complete_Handshake()
+	}
+
+	// Let the client know when its packets are throttled
+	if ok, reason := s.Allow_Packet(client, p.Command); !ok {
+		if reason != "" {
+			s.Send_Status_Code(client, StatusRefused, p.Listener, reason, nil)
+		}
+		return true
+	}
+
 	// Interpret the protocol's commands
 	go s.Handler(client, p)
 	return true
@@ -73,7 +98,7 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 		return
 	}
 
-	s.Logger.Debug().Any("packet", p).Any("client", client).Msg("Received CL3/4 packet")
+	s.Log(Subsystem_CL4).Debug().Any("packet", p).Any("client", client).Msg("Received CL3/4 packet")
 
 	if client.Conn != nil {
 		s.classicclientsmu.RLock()
@@ -84,9 +109,24 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 		}
 	}
 
+	// Unauthenticated clients may only send a handshake, which can carry a token
+	if p.Command != "handshake" && !s.Require_Identity(client) {
+		return
+	}
+
 	switch p.Command {
 
 	case "handshake":
+		if val, ok := p.Value.(map[string]any); ok {
+			if token, ok := val["token"].(string); ok && !s.Authenticate_Token(client, token) {
+				return
+			}
+		}
+		if !s.Require_Identity(client) {
+			return
+		}
+		client.Complete_Handshake()
+
 		userObj := s.UserObject(client)
 		s.Unicast(client, &Common_Packet{Command: "server_version", Value: s.Spoof_Server_Version(client)})
 		s.Unicast(client, &Common_Packet{Command: "client_obj", Value: userObj})
@@ -97,10 +137,10 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 			Rooms:   DEFAULT_ROOM,
 		})
 
-		if client.Server.Config.Enable_MOTD {
-			s.Unicast(client, &Common_Packet{Command: "motd", Value: client.Server.Config.MOTD_Message})
+		if enabled, motd := s.Get_MOTD(); enabled {
+			s.Unicast(client, &Common_Packet{Command: "motd", Value: motd})
 		}
-		if client.Server.Config.Serve_IP_Addresses {
+		if client.Server.Config().Serve_IP_Addresses {
 			s.Unicast(client, &Common_Packet{Command: "client_ip", Value: client.Conn.IP()})
 		}
 		s.Sync_Room_State(client, DEFAULT_ROOM)
@@ -116,7 +156,15 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 		}
 
 		if username, ok := p.Value.(string); ok {
-			client.SetUsername(username)
+			if !s.Pinned_Username(client, username) {
+				s.Send_Status_Code(client, StatusRefused, p.Listener, fmt.Sprintf("This session is authenticated as %s.", client.GetIdentity().Username), nil)
+				return
+			}
+
+			if !s.Claim_Username(client, username, client.GetRooms()) {
+				s.Send_Status_Code(client, StatusIDConflict, p.Listener, nil, nil)
+				return
+			}
 
 			s.Send_Status_Code(client, StatusOK, p.Listener, nil, s.UserObject(client))
 
@@ -148,6 +196,10 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 
 			// Store the variable dynamically across all protocols
 			if p.Command == "gvar" {
+				if err := s.Check_Variable_Rules(room, "set", p.Name, nil, p.Value); err != nil {
+					s.Send_Status_Code(client, StatusRefused, p.Listener, fmt.Sprintf("Cannot set global variable %v in room %s: %v.", p.Name, room, err), nil)
+					return
+				}
 				s.SetRoomGlobalVar(client, room, p.Name, p.Value)
 			}
 
@@ -174,6 +226,56 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 			}
 		}
 
+	case "gvar_delete", "gvar_rename":
+		// Bridge extension commands for managing room variables
+		if p.Name == nil || (p.Command == "gvar_rename" && p.Value == nil) {
+			s.Send_Status_Code(client, StatusSyntax, p.Listener, nil, nil)
+			return
+		}
+
+		targetRooms := s.Get_Target_Rooms(client, p.Rooms)
+
+		for _, room := range targetRooms {
+			if !s.Is_Client_In_Room(client, room) {
+				s.Send_Status_Code(client, StatusRoomNotJoined, p.Listener, fmt.Sprintf("Attempted to access room %s while not joined.", room), nil)
+				return
+			}
+
+			method := strings.TrimPrefix(p.Command, "gvar_")
+			if err := s.Check_Variable_Rules(room, method, p.Name, p.Value, nil); err != nil {
+				s.Send_Status_Code(client, StatusRefused, p.Listener, fmt.Sprintf("Cannot %s global variable %v in room %s: %v.", method, p.Name, room, err), nil)
+				return
+			}
+
+			if p.Command == "gvar_delete" {
+				if !s.DeleteRoomGlobalVar(room, p.Name) {
+					s.Send_Status_Code(client, StatusIDNotFound, p.Listener, fmt.Sprintf("Global variable %v doesn't exist in room %s.", p.Name, room), nil)
+					return
+				}
+			} else if !s.RenameRoomGlobalVar(client, room, p.Name, p.Value) {
+				if vars := s.GetRoomGlobalVars(room); vars != nil {
+					if _, taken := vars.Load(p.Value); taken {
+						s.Send_Status_Code(client, StatusIDConflict, p.Listener, fmt.Sprintf("Global variable %v already exists in room %s.", p.Value, room), nil)
+						return
+					}
+				}
+				s.Send_Status_Code(client, StatusIDNotFound, p.Listener, fmt.Sprintf("Global variable %v doesn't exist in room %s.", p.Name, room), nil)
+				return
+			}
+
+			s.Broadcast(room, &Common_Packet{
+				Command: p.Command,
+				Name:    p.Name,
+				Value:   p.Value,
+				Origin:  s.UserObject(client),
+				Rooms:   room,
+			})
+		}
+
+		if p.Listener != nil {
+			s.Send_Status_Code(client, StatusOK, p.Listener, nil, nil)
+		}
+
 	case "pmsg", "pvar":
 		usernameVal := client.GetUsername()
 		if usernameVal == nil || usernameVal == "" {
@@ -191,15 +293,19 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 			}
 
 			targets := s.Get_Clients(room, p.ID)
-			if len(targets) > 0 {
+			packet := &Common_Packet{
+				Command: p.Command,
+				Value:   p.Value,
+				Name:    p.Name,
+				Origin:  s.UserObject(client),
+				Rooms:   room,
+			}
+
+			// Recipients on other bridges are only known in federated rooms
+			relayed := s.Relay_Private(room, p.ID, packet)
+			if len(targets) > 0 || relayed {
 				anyResultsFound = true
-				s.Multicast(&Common_Packet{
-					Command: p.Command,
-					Value:   p.Value,
-					Name:    p.Name,
-					Origin:  s.UserObject(client),
-					Rooms:   room,
-				}, targets)
+				s.Multicast(packet, targets)
 			} else {
 				s.Send_Status_Code(client, StatusIDNotFound, p.Listener, nil, nil)
 				return
@@ -256,7 +362,13 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 			return
 		}
 
-		roomsToLink := s.Get_Target_Rooms(client, p.Value)
+		requests := Parse_Room_Requests(p.Value)
+		if len(requests) == 0 {
+			for _, room := range s.Get_Target_Rooms(client, nil) {
+				requests = append(requests, Room_Request{Room: room})
+			}
+		}
+		roomsToLink := Requested_Rooms(requests)
 		hasDefault := false
 
 		if !s.CanAllocateNRooms(client, len(roomsToLink)) {
@@ -264,11 +376,47 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 			return
 		}
 
+		for _, room := range roomsToLink {
+			if !s.Origin_Allowed(client.origin, room) {
+				s.Send_Status_Code(client, StatusRefused, p.Listener, fmt.Sprintf("Cannot join room %v from this origin.", room), nil)
+				return
+			}
+		}
+
+		refuse := func(err error) {
+			var access_err *Room_Access_Error
+			if !errors.As(err, &access_err) {
+				s.Send_Status_Code(client, StatusRefused, p.Listener, fmt.Sprintf("Cannot join the requested rooms: %v.", err), nil)
+				return
+			}
+			if access_err.Conflict {
+				s.Send_Status_Code(client, StatusIDConflict, p.Listener, "Your username is already in use in one of the requested rooms.", nil)
+				return
+			}
+			s.Send_Status_Code(client, StatusRefused, p.Listener, fmt.Sprintf("Cannot join room %v: %v.", access_err.Room, err), nil)
+		}
+
+		// Check the rooms before claiming the username, since that may kick other clients
+		if err := s.Check_Room_Access(client, requests); err != nil {
+			refuse(err)
+			return
+		}
+
+		if !s.Claim_Username(client, usernameVal, roomsToLink) {
+			s.Send_Status_Code(client, StatusIDConflict, p.Listener, "Your username is already in use in one of the requested rooms.", nil)
+			return
+		}
+
+		invites, err := s.Join_Rooms(client, requests)
+		if err != nil {
+			refuse(err)
+			return
+		}
+
 		for _, room := range roomsToLink {
 			if room == DEFAULT_ROOM {
 				hasDefault = true
 			}
-			s.Subscribe(client, room)
 
 			// Broadcast addition to new room
 			s.Broadcast(room, &Common_Packet{
@@ -301,7 +449,10 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 			}, client)
 		}
 
-		if p.Listener != nil {
+		// Private rooms opened by the client are only reachable with their invite tokens, so always send them
+		if len(invites) > 0 {
+			s.Send_Status_Code(client, StatusOK, p.Listener, nil, invites)
+		} else if p.Listener != nil {
 			s.Send_Status_Code(client, StatusOK, p.Listener, nil, nil)
 		}
 
@@ -345,6 +496,10 @@ func (s CL4_or_CL3) Handler(client *BridgeClient, p *Common_Packet) {
 		if p.Listener != nil {
 			s.Send_Status_Code(client, StatusOK, p.Listener, nil, nil)
 		}
+
+	case "ping":
+		// Keepalive. Receiving the packet already counted as activity, so all that's left is to answer it.
+		s.Send_Status_Code(client, StatusOK, p.Listener, nil, nil)
 	}
 }
 
@@ -11,86 +11,116 @@ import (
 // It ensures only one goroutine ever writes to the connection at a time.
 func (c *BridgeClient) Writer() {
 	defer c.Conn.Close()
+	ticker, pings := c.ping_ticker()
+	if ticker != nil {
+		defer ticker.Stop()
+	}
 	for {
 		select {
 		case msg, ok := <-c.writer:
 			if !ok {
 				return
 			}
-			if write_err := c.Conn.WriteMessage(websocket.TextMessage, msg); write_err != nil {
+			if write_err := c.write_frame(msg); write_err != nil {
 				c.Server.Logger.Error().Msgf("%s ⚠️  Error writing to client: %v", c.GiveName(), write_err)
 			}
+		case <-pings:
+			c.send_ping()
+		case deadline := <-c.closing:
+			c.flush(deadline)
+			return
 		case <-c.exit:
 			return // Stop the goroutine
 		}
 	}
 }
 
+// Writes every queued message, then closes the connection with Unavailable_Status. Gives up at the deadline.
+func (c *BridgeClient) flush(deadline time.Time) {
+	c.Conn.SetWriteDeadline(deadline)
+	for {
+		select {
+		case msg, ok := <-c.writer:
+			if !ok {
+				return
+			}
+			if write_err := c.write_frame(msg); write_err != nil {
+				return
+			}
+		default:
+			c.Server.Respond_With_Code(c.Conn, Unavailable_Status)
+			return
+		}
+	}
+}
+
+func (c *BridgeClient) write_frame(msg frame) error {
+	if c.deflate {
+		c.Conn.EnableWriteCompression(msg.deflate)
+	}
+	if !msg.binary {
+		if err := c.Conn.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+			return err
+		}
+		c.Server.recorder.Record(c, Capture_Tx, msg.data)
+		return nil
+	}
+
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, msg.data); err != nil {
+		return err
+	}
+	if c.Server.recorder != nil {
+		if data, err := msgpack_to_json(msg.data); err == nil {
+			c.Server.recorder.Record_Binary(c, Capture_Tx, data)
+		}
+	}
+	return nil
+}
+
 func (c *BridgeClient) Reader() {
 	// Set a hard limit of 64KB
 	c.Conn.SetReadLimit(64 * 1024)
+	c.watch_idle()
 reader:
 	for {
 		if msg_type, packet, err := c.Conn.ReadMessage(); err != nil {
-			c.Server.Logger.Error().AnErr("error", err).Msg("Error reading from client")
+			if is_timeout(err) {
+				c.Server.Logger.Warn().Msgf("%s ⚠️  Aborting connection to client: Idle timeout.", c.GiveName())
+				c.Server.Metrics.Timeouts.Inc("idle")
+				c.Server.Respond_With_Code(c.Conn, Timeout_Error)
+			} else {
+				c.Server.Logger.Error().AnErr("error", err).Msg("Error reading from client")
+			}
 			c.exit <- true
 			break reader
 		} else {
+			c.extend_idle_deadline()
 
-			// Rate limit check
-			if c.Server.Config.Enable_Rate_Limit {
-
-				now := time.Now()
-				if c.last_msg_time.IsZero() {
-					c.last_msg_time = now
-				}
-				if now.Sub(c.last_msg_time) > c.Server.Config.Rate_Limit_Interval {
-					c.msg_count = 0
-					c.last_msg_time = now
-				}
-
-				c.msg_count++
-
-				exceeded := c.msg_count > c.Server.Config.Rate_Limit_Burst
-
-				if exceeded {
-					if c.Server.Config.Kick_On_Rate_Limit {
-						c.Server.Logger.Error().Msgf("%s ⚠️  Aborting connection to client: Exceeded ratelimit.", c.GiveName())
-						c.writer <- []byte("Your client has exceeded the ratelimit allowed by the server. Please reduce the messages that you send.")
-						c.Server.Respond_With_Code(c.Conn, Ratelimit_Exceeded)
-						c.exit <- true
-						break reader
-					} else {
-						c.Server.Logger.Warn().Msgf("%s ⚠️  Client exceeding rate limit...", c.GiveName())
-						// Silently drop new packets
-						continue
-					}
-				}
+			// Charge every frame before it is parsed, so that invalid frames count towards the rate limit too
+			if !c.Server.Allow_Frame(c, packet, msg_type == websocket.BinaryMessage) {
+				continue
 			}
 
 			switch msg_type {
 			case websocket.TextMessage:
-				switch p := c.Protocol.(type) {
-				case nil:
-					if p, ok := c.DetectAndReadProtocol(packet); !ok {
+				c.Server.recorder.Record(c, Capture_Rx, packet)
+				if protocol := c.GetProtocol(); protocol == nil {
+					if _, ok := c.DetectAndReadProtocol(packet); !ok {
 						c.Server.Logger.Error().Msgf("%s ⚠️  Aborting connection to client: Failed to identify protocol.", c.GiveName())
 						err_msg := []byte("Failed to detect your client's protocol. Please try again later.")
 						c.Server.Respond_With_Message_And_Code(c.Conn, Protocol_Detection_Failure, err_msg)
 						c.exit <- true
 						break reader
-					} else {
-						c.Protocol = p
 					}
-				case *CL4_or_CL3:
-					go p.Reader(c, packet)
-				case *Scratch_Handler:
-					go p.Reader(c, packet)
-				case *CL2:
-					go p.Reader(c, packet)
-				default:
-					c.Server.Logger.Error().Msgf("%s ⚠️  Aborting connection to client: Failed to process client protocol.", c.GiveName())
-					err_msg := []byte("Failed to process your client's protocol. Please report this to the server administrator.")
-					c.Server.Respond_With_Message_And_Code(c.Conn, Protocol_Handler_Failure, err_msg)
+				} else {
+					go protocol.Reader(c, packet)
+				}
+
+			case websocket.BinaryMessage:
+				if !c.read_msgpack(packet) {
+					c.Server.Logger.Error().Msgf("%s ⚠️  Aborting connection to client: Invalid binary frame.", c.GiveName())
+					err_msg := []byte("You sent a binary frame that the server does not understand; Binary frames must contain CL4 packets encoded with MessagePack.")
+					c.Server.Respond_With_Message_And_Code(c.Conn, Generic_Error, err_msg)
 					c.exit <- true
 					break reader
 				}
@@ -124,23 +154,17 @@ func (c *BridgeClient) GiveName() string {
 }
 
 func (c *BridgeClient) DetectAndReadProtocol(data []byte) (Protocol, bool) {
-	cl4or3 := New_CL4_or_CL3(c.Server)
-	if cl4or3.Reader(c, data) {
-		c.Protocol = cl4or3
-		return cl4or3, true
-	}
-
-	scratch := New_Scratch(c.Server)
-	if scratch.Reader(c, data) {
-		c.Protocol = scratch
-		return scratch, true
-	}
-
-	cl2 := New_CL2(c.Server)
-	if cl2.Reader(c, data) {
-		c.Protocol = cl2
-		return cl2, true
+	// Try every enabled protocol in order of priority
+	// The protocol is assigned before its reader runs, since a successful read hands the packet
+	// off to a handler goroutine that may reply right away.
+	for _, entry := range c.Server.protocols {
+		p := entry.New(c.Server)
+		c.SetProtocol(p)
+		if p.Reader(c, data) {
+			return p, true
+		}
 	}
+	c.SetProtocol(nil)
 
 	// No valid protocol detected
 	c.Server.Logger.Debug().Msgf("No valid protocol detected")
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"compress/flate"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Default settings for permessage-deflate. See Config.Compression_Level and Config.Compression_Threshold.
+const (
+	Default_Compression_Level     = flate.BestSpeed
+	Default_Compression_Threshold = 512
+)
+
+// Checks the compression settings, and applies the defaults to those that are unset.
+func validate_compression(config *Config) error {
+
+	// flate.NoCompression would make every frame larger, so a zero level means the default instead
+	if config.Compression_Level == 0 {
+		config.Compression_Level = Default_Compression_Level
+	}
+	if config.Compression_Threshold == 0 {
+		config.Compression_Threshold = Default_Compression_Threshold
+	}
+	if config.Compression_Level < flate.HuffmanOnly || config.Compression_Level > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d", config.Compression_Level)
+	}
+	registered := Registered_Protocols()
+	for _, name := range config.Uncompressed_Protocols {
+		if !slices.ContainsFunc(registered, func(entry Protocol_Entry) bool { return entry.Name == name }) {
+			return fmt.Errorf("cannot disable compression for unknown protocol %q", name)
+		}
+	}
+	return nil
+}
+
+// Reports whether a client offered permessage-deflate in its WebSocket upgrade. If compression is enabled,
+// the upgrade accepts any such offer.
+func offers_deflate(extensions string) bool {
+	for extension := range strings.SplitSeq(extensions, ",") {
+		name, _, _ := strings.Cut(extension, ";")
+		if strings.TrimSpace(name) == "permessage-deflate" {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether frames to a client may be compressed. Clients that haven't been detected yet are never
+// sent compressed frames, since their protocol may have opted out.
+func (s *Server) deflate_allowed(c *BridgeClient) bool {
+	if !c.deflate {
+		return false
+	}
+	protocol := c.GetProtocol()
+	return protocol != nil && !slices.Contains(s.Config().Uncompressed_Protocols, protocol.Name())
+}
+
+// Marks a frame for compression if it is large enough, and works out how large it will be once compressed.
+// This is done once for every group of clients that receives the frame, rather than once for every client.
+func (s *Server) prepare_deflate(msg *frame) {
+	if len(msg.data) < int(s.Config().Compression_Threshold) {
+		return
+	}
+	msg.deflate = true
+	msg.deflated_size = s.deflated_size(msg.data)
+}
+
+type byte_counter int
+
+func (n *byte_counter) Write(p []byte) (int, error) {
+	*n += byte_counter(len(p))
+	return len(p), nil
+}
+
+// Returns the size of the payload that permessage-deflate sends for some data. Without context takeover,
+// that is a flushed DEFLATE stream, minus the 4 bytes that terminate the flush.
+func (s *Server) deflated_size(data []byte) int {
+	var n byte_counter
+	w := s.deflaters.Get().(*flate.Writer)
+	defer s.deflaters.Put(w)
+	w.Reset(&n)
+	w.Write(data)
+	w.Flush()
+	return int(n) - 4
+}
+
+func (s *Server) configure_deflaters(level int) {
+	s.deflaters.New = func() any {
+		w, _ := flate.NewWriter(nil, level)
+		return w
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"strings"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+)
+
+func TestOffersDeflate(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                   false,
+		"permessage-deflate": true,
+		"permessage-deflate; client_max_window_bits": true,
+		"x-webkit-deflate-frame, permessage-deflate": true,
+		"x-permessage-deflate":                       false,
+	} {
+		if got := offers_deflate(header); got != want {
+			t.Errorf("offers_deflate(%q) = %v, expected %v", header, got, want)
+		}
+	}
+}
+
+func TestCompressionDefaults(t *testing.T) {
+	config := &Config{Enable_Compression: true}
+	if err := validate_compression(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Compression_Level != Default_Compression_Level || config.Compression_Threshold != Default_Compression_Threshold {
+		t.Errorf("unset compression settings became level %d and threshold %d", config.Compression_Level, config.Compression_Threshold)
+	}
+
+	config = &Config{Enable_Compression: true, Compression_Level: flate.HuffmanOnly, Compression_Threshold: 1}
+	if err := validate_compression(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Compression_Level != flate.HuffmanOnly || config.Compression_Threshold != 1 {
+		t.Errorf("compression settings were replaced with level %d and threshold %d", config.Compression_Level, config.Compression_Threshold)
+	}
+}
+
+func TestDeflatedSize(t *testing.T) {
+	s := &Server{}
+	s.configure_deflaters(flate.BestSpeed)
+	data := []byte(strings.Repeat(`{"cmd":"gvar","name":"☁ score","val":"12345"}`, 20))
+
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(data)
+	w.Flush()
+	if got, want := s.deflated_size(data), buf.Len()-4; got != want {
+		t.Errorf("deflated size is %d, expected %d", got, want)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	config := New_Test_Config()
+	config.Enable_Compression = true
+	config.Compression_Level = flate.BestSpeed
+	config.Compression_Threshold = 256
+	config.Uncompressed_Protocols = []string{Protocol_Scratch}
+	b := Start_Test_Bridge(t, config)
+	b.Dialer = &websocket.Dialer{EnableCompression: true}
+
+	cl4 := b.Connect("cl4")
+	scratch := b.Connect("scratch")
+	tr := b.Transcript()
+	tr.Step(cl4, `{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	tr.Step(scratch, `{"method":"handshake","project_id":"default","user":"scratch"}`)
+	value := strings.Repeat("1234567890", 100)
+	tr.Step(scratch, `{"method":"set","name":"☁ score","value":"`+value+`"}`)
+
+	if !strings.Contains(tr.String(), `<<< cl4: {"cmd":"gvar","name":"☁ score","val":"`+value+`"`) {
+		t.Errorf("compressed frame wasn't received intact:\n%s", tr.String())
+	}
+
+	input, output := b.Metrics.Compression_Input.values(), b.Metrics.Compression_Output.values()
+	if len(input) != 1 || input[Protocol_CL4].value == 0 {
+		t.Fatalf("only CL4 clients should have been sent compressed frames, got %v", input)
+	}
+	if in, out := input[Protocol_CL4].value, output[Protocol_CL4].value; out == 0 || out >= in {
+		t.Errorf("compressed %d bytes into %d bytes", in, out)
+	}
+
+	// Frames under the threshold aren't compressed
+	before := input[Protocol_CL4].value
+	tr.Step(scratch, `{"method":"set","name":"☁ score","value":"1"}`)
+	if after := b.Metrics.Compression_Input.values()[Protocol_CL4].value; after != before {
+		t.Errorf("a small frame was compressed")
+	}
+
+	var sb strings.Builder
+	b.Write_Metrics(&sb)
+	if !strings.Contains(sb.String(), `bridge_compression_ratio{protocol="cl4"} 0.`) {
+		t.Errorf("compression ratio wasn't reported:\n%s", sb.String())
+	}
+}
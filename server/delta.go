@@ -18,11 +18,14 @@ func (s *Server) ConfigureDelta(designation string) {
 	i.OnCreate = func() {
 
 		// Attempt to connect to the discovery server
-		s.Logger.Info().Msgf("Attempting to connect to discovery@%s...", designation)
+		s.Log(Subsystem_Delta).Info().Msgf("Attempting to connect to discovery@%s...", designation)
 		i.Connect("discovery@" + designation)
 
 		// Establish a connection to every predisposed instance.
-		for _, instance := range s.Predisposed_Instances {
+		s.registry_mux.RLock()
+		instances := s.Predisposed_Instances
+		s.registry_mux.RUnlock()
+		for _, instance := range instances {
 			i.Connect(instance)
 		}
 
@@ -44,14 +47,14 @@ func (s *Server) ConfigureDelta(designation string) {
 		reply := peer.WaitForMatchedPacket("AUTO_REGISTER", "VIOLATION")
 		switch reply.Opcode {
 		case "AUTO_REGISTER":
-			s.Logger.Info().Msgf("Automatically registered on %s successfully!", peer.GetPeerID())
+			s.Log(Subsystem_Delta).Info().Msgf("Automatically registered on %s successfully!", peer.GetPeerID())
 		case "VIOLATION":
 			// The protocol mandates that VIOLATION messages have a string payload. This should never panic unless something's very wrong.
 			var message string
 			if err := json.Unmarshal(reply.Payload, &message); err != nil {
 				panic(err)
 			}
-			s.Logger.Error().Msgf("Failed to auto-register on %s: %v", peer.GetPeerID(), message)
+			s.Log(Subsystem_Delta).Error().Msgf("Failed to auto-register on %s: %v", peer.GetPeerID(), message)
 		}
 	}
 
@@ -75,16 +78,25 @@ func (s *Server) ConfigureDelta(designation string) {
 		// Unregister from Discovery & Bridge registries
 		s.UnregisterDiscovery(peer)
 		s.UnregisterBridge(peer)
+		s.Unlink_Federation(peer.GetPeerID())
 
-		bc.Protocol.On_Disconnect(bc, currentRooms)
+		bc.GetProtocol().On_Disconnect(bc, currentRooms)
 	}
 
 	i.OnBridgeConnected = func(peer *duplex.Peer) {
 		s.RegisterBridge(peer)
-		s.Logger.Info().Msgf("Registered bridge server %s in BridgeRegistry", peer.GetPeerID())
+		s.Log(Subsystem_Delta).Info().Msgf("Registered bridge server %s in BridgeRegistry", peer.GetPeerID())
+		s.Link_Federation(peer.GetPeerID())
 	}
 	i.OnRelayConnected = func(peer *duplex.Peer) {}
 
+	// Events and state of federated rooms
+	for _, opcode := range []string{Federation_Event_Opcode, Federation_Sync_Opcode} {
+		i.Bind(opcode, func(peer *duplex.Peer, packet *duplex.RxPacket) {
+			s.receive_federation(peer.GetPeerID(), packet.Opcode, packet.Payload)
+		}, "bridge")
+	}
+
 	i.Bind("DISCOVER", func(peer *duplex.Peer, packet *duplex.RxPacket) {
 		var targetBridge string
 		if err := json.Unmarshal(packet.Payload, &targetBridge); err != nil {
@@ -96,7 +108,7 @@ func (s *Server) ConfigureDelta(designation string) {
 			s.registry_mux.RUnlock()
 
 			if !exists {
-				s.Logger.Info().Msgf("Discovered bridge %s via %s, connecting...", targetBridge, peer.GetPeerID())
+				s.Log(Subsystem_Delta).Info().Msgf("Discovered bridge %s via %s, connecting...", targetBridge, peer.GetPeerID())
 				i.Connect(targetBridge)
 			}
 		}
@@ -115,7 +127,7 @@ func (s *Server) ConfigureDelta(designation string) {
 	i.Bind("HELLO", func(peer *duplex.Peer, packet *duplex.RxPacket) {
 		var args HelloArgs
 		if err := json.Unmarshal(packet.Payload, &args); err != nil {
-			s.Logger.Warn().Msgf("peer %s malformed HELLO: %v", peer.GetPeerID(), err)
+			s.Log(Subsystem_Delta).Warn().Msgf("peer %s malformed HELLO: %v", peer.GetPeerID(), err)
 			return
 		}
 
@@ -184,10 +196,32 @@ func (s *Server) ConfigureDelta(designation string) {
 	}, "discovery", "bridge")
 
 	i.Bind("LINK", func(peer *duplex.Peer, packet *duplex.RxPacket) {
-		rooms := parseRoomsFromPayload(packet.Payload)
+		requested := parseRoomRequestsFromPayload(packet.Payload)
 		bc := New_Delta(s).(*CLDelta).ToBridgeClient(peer)
-		for _, room := range rooms {
-			s.Subscribe(bc, room)
+
+		// Rooms that refuse the peer, or where its name conflicts with an existing member, are reported on their own
+		var rooms []RoomKey
+		for _, req := range requested {
+			join := []Room_Request{req}
+			err := s.Check_Room_Access(bc, join)
+			if err == nil && !s.Claim_Username(bc, bc.GetUsername(), RoomKeys{req.Room}) {
+				err = &Room_Access_Error{Room: req.Room, Conflict: true}
+			}
+			if err == nil {
+				_, err = s.Join_Rooms(bc, join)
+			}
+			if err != nil {
+				peer.Write(&duplex.TxPacket{
+					Packet: duplex.Packet{
+						Opcode:   "LINK_REFUSED",
+						Listener: packet.Listener,
+						TTL:      1,
+					},
+					Payload: &Room_Refusal{Room: req.Room, Reason: err.Error()},
+				})
+				continue
+			}
+			rooms = append(rooms, req.Room)
 		}
 		peer.Write(&duplex.TxPacket{
 			Packet: duplex.Packet{
@@ -228,23 +262,7 @@ func (s *Server) ConfigureDelta(designation string) {
 		}
 
 		for _, room := range rooms {
-			s.Unsubscribe(bc, room)
-
-			// Tell existing peers we have left
-			s.Broadcast(room, &Common_Packet{
-				Command: "ulist",
-				Mode:    "remove",
-				Value:   s.UserObject(bc),
-				Rooms:   room,
-			}, bc)
-
-			// Tell our peer to forget each bridged client
-			s.Unicast(bc, &Common_Packet{
-				Command: "ulist",
-				Mode:    "delete",
-				Value:   s.Get_User_List(room),
-				Rooms:   room,
-			})
+			s.leave_delta_room(bc, room)
 		}
 
 		peer.Write(&duplex.TxPacket{
@@ -257,77 +275,153 @@ func (s *Server) ConfigureDelta(designation string) {
 		})
 	})
 
-	i.Remap("G_MSG", func(peer *duplex.Peer, packet *duplex.RxPacket) {
-		bc := New_Delta(s).(*CLDelta).ToBridgeClient(peer)
-		p := &Common_Packet{
-			Command: "gmsg",
-			Value:   packet.Payload,
-			Origin:  s.PeerUserObject(peer),
-		}
-		rooms := s.getDeltaRooms(peer)
-		if len(rooms) == 0 {
-			rooms = []RoomKey{DEFAULT_ROOM}
-		}
-		for _, room := range rooms {
-			p.Rooms = room
-			s.Broadcast(room, p, bc)
-		}
-	})
+	// Messages and variables
+	for opcode, handler := range s.delta_handlers() {
+		i.Remap(opcode, handler)
+	}
+}
 
-	i.Remap("P_MSG", func(peer *duplex.Peer, packet *duplex.RxPacket) {
-		p := &Common_Packet{
-			Command: "pmsg",
-			Value:   packet.Payload,
-			Origin:  s.PeerUserObject(peer),
-		}
-		rooms := s.getDeltaRooms(peer)
-		if len(rooms) == 0 {
-			rooms = []RoomKey{DEFAULT_ROOM}
-		}
-		for _, room := range rooms {
-			targets := s.Get_Client(packet.Target, room)
-			s.Multicast(p, targets)
-		}
-	})
+// Returns the handlers of the messages and variables that Delta peers send to their rooms.
+func (s *Server) delta_handlers() map[string]func(*duplex.Peer, *duplex.RxPacket) {
+	return map[string]func(*duplex.Peer, *duplex.RxPacket){
+		"G_MSG": func(peer *duplex.Peer, packet *duplex.RxPacket) {
+			bc := New_Delta(s).(*CLDelta).ToBridgeClient(peer)
+			p := &Common_Packet{
+				Command: "gmsg",
+				Value:   packet.Payload,
+				Origin:  s.PeerUserObject(peer),
+			}
+			rooms := s.getDeltaRooms(peer)
+			if len(rooms) == 0 {
+				rooms = []RoomKey{DEFAULT_ROOM}
+			}
+			for _, room := range rooms {
+				p.Rooms = room
+				s.Broadcast(room, p, bc)
+			}
+		},
 
-	i.Remap("G_VAR", func(peer *duplex.Peer, packet *duplex.RxPacket) {
-		bc := New_Delta(s).(*CLDelta).ToBridgeClient(peer)
-		p := &Common_Packet{
-			Command: "gvar",
-			Name:    packet.Id,
-			Value:   packet.Payload,
-			Origin:  s.PeerUserObject(peer),
-		}
-		rooms := s.getDeltaRooms(peer)
-		if len(rooms) == 0 {
-			rooms = []RoomKey{DEFAULT_ROOM}
-		}
-		for _, room := range rooms {
-			p.Rooms = room
-			s.Broadcast(room, p, bc)
+		"P_MSG": func(peer *duplex.Peer, packet *duplex.RxPacket) {
+			p := &Common_Packet{
+				Command: "pmsg",
+				Value:   packet.Payload,
+				Origin:  s.PeerUserObject(peer),
+			}
+			rooms := s.getDeltaRooms(peer)
+			if len(rooms) == 0 {
+				rooms = []RoomKey{DEFAULT_ROOM}
+			}
+			for _, room := range rooms {
+				targets := s.Get_Client(packet.Target, room)
+				s.Multicast(p, targets)
+			}
+		},
 
-			if gv := s.GetRoomGlobalVars(room); gv != nil {
-				gv.Store(packet.Id, packet.Payload)
+		"G_VAR": func(peer *duplex.Peer, packet *duplex.RxPacket) {
+			bc := New_Delta(s).(*CLDelta).ToBridgeClient(peer)
+			p := &Common_Packet{
+				Command: "gvar",
+				Name:    packet.Id,
+				Value:   packet.Payload,
+				Origin:  s.PeerUserObject(peer),
 			}
-		}
-	})
+			rooms := s.getDeltaRooms(peer)
+			if len(rooms) == 0 {
+				rooms = []RoomKey{DEFAULT_ROOM}
+			}
+			for _, room := range rooms {
+				if err := s.Check_Variable_Rules(room, "set", packet.Id, nil, packet.Payload); err != nil {
+					s.Log(Subsystem_Delta).Warn().Msgf("peer %s invalid G_VAR in room %s: %v", peer.GetPeerID(), room, err)
+					continue
+				}
 
-	i.Remap("P_VAR", func(peer *duplex.Peer, packet *duplex.RxPacket) {
-		p := &Common_Packet{
-			Command: "pvar",
-			Name:    packet.Id,
-			Value:   packet.Payload,
-			Origin:  s.PeerUserObject(peer),
-		}
-		rooms := s.getDeltaRooms(peer)
-		if len(rooms) == 0 {
-			rooms = []RoomKey{DEFAULT_ROOM}
-		}
-		for _, room := range rooms {
-			targets := s.Get_Client(packet.Target, room)
-			s.Multicast(p, targets)
-		}
-	})
+				p.Rooms = room
+				s.Broadcast(room, p, bc)
+
+				s.SetRoomGlobalVar(bc, room, packet.Id, packet.Payload)
+			}
+		},
+
+		"G_VAR_DELETE": func(peer *duplex.Peer, packet *duplex.RxPacket) {
+			bc := New_Delta(s).(*CLDelta).ToBridgeClient(peer)
+			p := &Common_Packet{
+				Command: "gvar_delete",
+				Name:    packet.Id,
+				Origin:  s.PeerUserObject(peer),
+			}
+			rooms := s.getDeltaRooms(peer)
+			if len(rooms) == 0 {
+				rooms = []RoomKey{DEFAULT_ROOM}
+			}
+			for _, room := range rooms {
+				if err := s.Check_Variable_Rules(room, "delete", packet.Id, nil, nil); err != nil {
+					s.Log(Subsystem_Delta).Warn().Msgf("peer %s invalid G_VAR_DELETE in room %s: %v", peer.GetPeerID(), room, err)
+					continue
+				}
+				if !s.DeleteRoomGlobalVar(room, packet.Id) {
+					continue
+				}
+
+				p.Rooms = room
+				s.Broadcast(room, p, bc)
+			}
+		},
+
+		"G_VAR_RENAME": func(peer *duplex.Peer, packet *duplex.RxPacket) {
+			var newName string
+			if err := json.Unmarshal(packet.Payload, &newName); err != nil || newName == "" {
+				s.Log(Subsystem_Delta).Warn().Msgf("peer %s malformed G_VAR_RENAME: %v", peer.GetPeerID(), err)
+				return
+			}
+
+			bc := New_Delta(s).(*CLDelta).ToBridgeClient(peer)
+			p := &Common_Packet{
+				Command: "gvar_rename",
+				Name:    packet.Id,
+				Value:   newName,
+				Origin:  s.PeerUserObject(peer),
+			}
+			rooms := s.getDeltaRooms(peer)
+			if len(rooms) == 0 {
+				rooms = []RoomKey{DEFAULT_ROOM}
+			}
+			for _, room := range rooms {
+				if err := s.Check_Variable_Rules(room, "rename", packet.Id, newName, nil); err != nil {
+					s.Log(Subsystem_Delta).Warn().Msgf("peer %s invalid G_VAR_RENAME in room %s: %v", peer.GetPeerID(), room, err)
+					continue
+				}
+				if !s.RenameRoomGlobalVar(bc, room, packet.Id, newName) {
+					continue
+				}
+
+				p.Rooms = room
+				s.Broadcast(room, p, bc)
+			}
+		},
+
+		"P_VAR": func(peer *duplex.Peer, packet *duplex.RxPacket) {
+			p := &Common_Packet{
+				Command: "pvar",
+				Name:    packet.Id,
+				Value:   packet.Payload,
+				Origin:  s.PeerUserObject(peer),
+			}
+			rooms := s.getDeltaRooms(peer)
+			if len(rooms) == 0 {
+				rooms = []RoomKey{DEFAULT_ROOM}
+			}
+			for _, room := range rooms {
+				targets := s.Get_Client(packet.Target, room)
+				s.Multicast(p, targets)
+			}
+		},
+	}
+}
+
+// Sends a packet to the peer of a Delta client. Every packet that the bridge relays to Delta clients goes through
+// Server.write_peer, so that it can be redirected without a WebRTC connection, as the transcript tests do.
+func write_peer(c *BridgeClient, p *duplex.TxPacket) {
+	c.Peer.Write(p)
 }
 
 func New_Delta(parent *Server) Protocol {
@@ -336,6 +430,10 @@ func New_Delta(parent *Server) Protocol {
 	}
 }
 
+func (*CLDelta) Name() string {
+	return Protocol_Delta
+}
+
 func (d *CLDelta) ToBridgeClient(peer *duplex.Peer) *BridgeClient {
 	peer.KeyLock.Lock()
 	if peer.KeyStore == nil {
@@ -359,7 +457,7 @@ func (d *CLDelta) ToBridgeClient(peer *duplex.Peer) *BridgeClient {
 		Peer:     peer,
 		ID:       sfID,
 		UUID:     peer.GetPeerID(),
-		writer:   make(chan []byte, 256),
+		writer:   make(chan frame, 256),
 		exit:     make(chan bool, 1),
 		Rooms:    make(RoomKeys, 0),
 		Server:   d.Server,
@@ -531,6 +629,12 @@ func (s *Server) PeerUserObject(peer *duplex.Peer) *CL4_UserObject {
 	if peer.KeyStore == nil {
 		peer.KeyStore = make(map[string]any)
 	}
+
+	// Peers that linked to rooms have a bridge client, which has the username that they claimed
+	if bc, ok := peer.KeyStore["bridge_client"].(*BridgeClient); ok {
+		peer.KeyLock.Unlock()
+		return s.UserObject(bc)
+	}
 	var sfID string
 	if id, ok := peer.KeyStore["snowflake_id"].(string); ok {
 		sfID = id
@@ -581,6 +685,23 @@ func parseRoomsFromPayload(payload json.RawMessage) []RoomKey {
 	return nil
 }
 
+// Like parseRoomsFromPayload, but rooms may also be objects with the fields of a Room_Request.
+// Peers can't open rooms with invite tokens, since LINK_ACK has no way of returning them.
+func parseRoomRequestsFromPayload(payload json.RawMessage) []Room_Request {
+	if len(payload) == 0 || string(payload) == "null" {
+		return nil
+	}
+	var value any
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil
+	}
+	requests := Parse_Room_Requests(value)
+	for i := range requests {
+		requests[i].Private = false
+	}
+	return requests
+}
+
 func (s *Server) getDeltaRooms(peer *duplex.Peer) []RoomKey {
 	bc := New_Delta(s).(*CLDelta).ToBridgeClient(peer)
 	bc.room_mux.RLock()
@@ -589,3 +710,43 @@ func (s *Server) getDeltaRooms(peer *duplex.Peer) []RoomKey {
 	copy(rooms, bc.Rooms)
 	return rooms
 }
+
+// Room_Refusal tells a Delta peer why it couldn't join a room, or why it was removed from one.
+type Room_Refusal struct {
+	Room   RoomKey `json:"room"`
+	Reason string  `json:"reason"`
+}
+
+// Removes a Delta peer from a room, and tells everyone involved.
+func (s *Server) leave_delta_room(bc *BridgeClient, room RoomKey) {
+	s.Unsubscribe(bc, room)
+
+	// Tell existing peers we have left
+	s.Broadcast(room, &Common_Packet{
+		Command: "ulist",
+		Mode:    "remove",
+		Value:   s.UserObject(bc),
+		Rooms:   room,
+	}, bc)
+
+	// Tell our peer to forget each bridged client
+	s.Unicast(bc, &Common_Packet{
+		Command: "ulist",
+		Mode:    "delete",
+		Value:   s.Get_User_List(room),
+		Rooms:   room,
+	})
+}
+
+// Unlink_Peer removes a Delta peer from a single room without closing its connection, since the peer may be
+// serving other rooms. The peer is sent an UNLINKED packet with the reason.
+func (s *Server) Unlink_Peer(bc *BridgeClient, room RoomKey, reason string) {
+	s.leave_delta_room(bc, room)
+	s.write_peer(bc, &duplex.TxPacket{
+		Packet: duplex.Packet{
+			Opcode: "UNLINKED",
+			TTL:    1,
+		},
+		Payload: &Room_Refusal{Room: room, Reason: reason},
+	})
+}
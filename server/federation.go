@@ -0,0 +1,420 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/cloudlink-delta/duplex"
+	"github.com/goccy/go-json"
+)
+
+// Rooms listed in Config.Federated_Rooms are shared with every bridge in the BridgeRegistry that federates the
+// same room. Their gmsg, gvar and ulist events are relayed to the other bridges, along with pmsg and pvar packets
+// for remote members. Remote members are listed alongside local ones, and count towards the username policy of
+// the room. Variables are reconciled whenever a bridge connects, and whenever a federated room is opened. Events
+// are relayed to each bridge directly, and never relayed again by the bridges that receive them.
+
+// Opcodes exchanged between federated bridges.
+const (
+	Federation_Event_Opcode = "FED_EVENT"
+	Federation_Sync_Opcode  = "FED_SYNC"
+)
+
+// Federation_Event is a single event of a federated room.
+type Federation_Event struct {
+	Room    RoomKey         `json:"room"`
+	Command string          `json:"cmd"`            // gmsg, gvar, gvar_rename, gvar_delete, pmsg, pvar or ulist
+	Mode    string          `json:"mode,omitempty"` // For ulist: add or remove
+	Name    any             `json:"name,omitempty"`
+	Value   any             `json:"val,omitempty"`
+	Target  any             `json:"id,omitempty"`   // Recipient(s) of pmsg and pvar
+	User    *CL4_UserObject `json:"user,omitempty"` // Member that joined or left, for ulist
+	Origin  *CL4_UserObject `json:"origin,omitempty"`
+}
+
+// Federation_Sync carries the members and variables of federated rooms, so that another bridge can reconcile
+// its own. The receiver replies with its own state if asked to.
+type Federation_Sync struct {
+	Reply bool              `json:"reply,omitempty"`
+	Rooms []Federated_State `json:"rooms"`
+}
+
+// Federated_State is the local state of a federated room on one bridge.
+type Federated_State struct {
+	Room    RoomKey           `json:"room"`
+	Members []*CL4_UserObject `json:"members"`
+	Vars    []Federated_Var   `json:"vars"`
+}
+
+// Federated_Var is a global variable of a federated room.
+type Federated_Var struct {
+	Name  any `json:"name"`
+	Value any `json:"val"`
+}
+
+// federation tracks the members of federated rooms on other bridges.
+type federation struct {
+	mux     sync.RWMutex
+	members map[RoomKey]map[string]*CL4_UserObject // By room, then by UUID
+	bridges map[string]string                      // Bridge of each member, by UUID
+	send    func(bridge string, opcode string, payload any)
+}
+
+func new_federation() *federation {
+	return &federation{
+		members: make(map[RoomKey]map[string]*CL4_UserObject),
+		bridges: make(map[string]string),
+	}
+}
+
+// Sends a payload to a bridge, or to every bridge if it is empty.
+func (f *federation) relay(bridge string, opcode string, payload any) {
+	f.mux.RLock()
+	send := f.send
+	f.mux.RUnlock()
+	send(bridge, opcode, payload)
+}
+
+// Replaces how payloads are sent to other bridges.
+func (f *federation) link(send func(bridge string, opcode string, payload any)) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.send = send
+}
+
+func (f *federation) add(bridge string, room RoomKey, user *CL4_UserObject) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.members[room] == nil {
+		f.members[room] = make(map[string]*CL4_UserObject)
+	}
+	_, known := f.members[room][user.UUID]
+	f.members[room][user.UUID] = user
+	f.bridges[user.UUID] = bridge
+	return !known
+}
+
+func (f *federation) remove(room RoomKey, uuid string) *CL4_UserObject {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	user, ok := f.members[room][uuid]
+	if !ok {
+		return nil
+	}
+	delete(f.members[room], uuid)
+	if len(f.members[room]) == 0 {
+		delete(f.members, room)
+	}
+	if len(f.rooms_of(uuid)) == 0 {
+		delete(f.bridges, uuid)
+	}
+	return user
+}
+
+// Returns the rooms that a remote member is in. Must be called with the lock held.
+func (f *federation) rooms_of(uuid string) []RoomKey {
+	var rooms []RoomKey
+	for room, members := range f.members {
+		if _, ok := members[uuid]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// Returns the remote members of a room that are on a bridge, or on any bridge if it's empty.
+func (f *federation) list(room RoomKey, bridge string) []*CL4_UserObject {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	users := make([]*CL4_UserObject, 0, len(f.members[room]))
+	for uuid, user := range f.members[room] {
+		if bridge == "" || f.bridges[uuid] == bridge {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// Returns the bridges of the remote members of a room that match a pmsg recipient, or several of them.
+func (f *federation) resolve(room RoomKey, target any) map[string]bool {
+	targets, ok := target.([]any)
+	if !ok {
+		targets = []any{target}
+	}
+
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	bridges := make(map[string]bool)
+	for _, t := range targets {
+		id := fmt.Sprintf("%v", t)
+		for uuid, user := range f.members[room] {
+			if user.ID == id || user.UUID == id || fmt.Sprintf("%v", user.Username) == id {
+				bridges[f.bridges[uuid]] = true
+			}
+		}
+	}
+	return bridges
+}
+
+// Returns whether a remote member of a room uses a username.
+func (f *federation) has_username(room RoomKey, username any) bool {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	wanted := fmt.Sprintf("%v", username)
+	for _, user := range f.members[room] {
+		if user.Username != nil && user.Username != "" && fmt.Sprintf("%v", user.Username) == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the snowflake node of a bridge. Unless configured, it is derived from the bridge's name, since the IDs
+// of remote members are shown alongside local ones and must not collide.
+func snowflake_node(configured int64, self string) int64 {
+	if configured != 0 {
+		return configured
+	}
+	h := fnv.New32a()
+	h.Write([]byte(self))
+	return int64(h.Sum32()%1023) + 1
+}
+
+// Is_Federated reports whether a room is shared with other bridges.
+func (s *Server) Is_Federated(room RoomKey) bool {
+	return slices.Contains(s.Config().Federated_Rooms, string(room))
+}
+
+// Writes a packet to a bridge in the BridgeRegistry, or to all of them if bridge is empty. Peers are written to
+// after releasing the registry, so that a slow bridge doesn't hold up registering others.
+func (s *Server) send_to_bridges(bridge string, opcode string, payload any) {
+	var peers []*duplex.Peer
+	s.registry_mux.RLock()
+	for id, peer := range s.BridgeRegistry {
+		if bridge == "" || id == bridge {
+			peers = append(peers, peer)
+		}
+	}
+	s.registry_mux.RUnlock()
+
+	for _, peer := range peers {
+		peer.Write(&duplex.TxPacket{
+			Packet: duplex.Packet{
+				Opcode: opcode,
+				TTL:    1,
+			},
+			Payload: payload,
+		})
+	}
+}
+
+// Converts a packet broadcast to a federated room into the event that is relayed to other bridges, if any.
+func federation_event(room RoomKey, p Packet) *Federation_Event {
+	switch packet := p.(type) {
+	case *Common_Packet:
+		origin, _ := packet.Origin.(*CL4_UserObject)
+		event := &Federation_Event{Room: room, Command: packet.Command, Name: packet.Name, Value: packet.Value, Origin: origin}
+		switch packet.Command {
+		case "gmsg", "gvar", "gvar_rename", "gvar_delete":
+			return event
+		case "ulist":
+			user, ok := packet.Value.(*CL4_UserObject)
+			if !ok || (packet.Mode != "add" && packet.Mode != "remove") {
+				return nil
+			}
+			event.Mode, event.User, event.Value = packet.Mode, user, nil
+			return event
+		}
+	case *ScratchPacket:
+		// Scratch renames and deletes are broadcast as gvar_rename and gvar_delete, so only updates are left
+		if packet.Method == "set" || packet.Method == "create" {
+			origin, _ := packet.Origin.(*CL4_UserObject)
+			return &Federation_Event{Room: room, Command: "gvar", Name: packet.Name, Value: packet.Value, Origin: origin}
+		}
+	}
+	return nil
+}
+
+// Relays a packet that is broadcast to a federated room to the other bridges.
+func (s *Server) federate(room RoomKey, p Packet) {
+	if !s.Is_Federated(room) {
+		return
+	}
+	if event := federation_event(room, p); event != nil {
+		s.federation.relay("", Federation_Event_Opcode, event)
+	}
+}
+
+// Relay_Private sends a pmsg or pvar to the remote members of a federated room that match its recipient.
+// Returns false if none of them do.
+func (s *Server) Relay_Private(room RoomKey, target any, p *Common_Packet) bool {
+	if !s.Is_Federated(room) {
+		return false
+	}
+	bridges := s.federation.resolve(room, target)
+	if len(bridges) == 0 {
+		return false
+	}
+	origin, _ := p.Origin.(*CL4_UserObject)
+	event := &Federation_Event{Room: room, Command: p.Command, Name: p.Name, Value: p.Value, Target: target, Origin: origin}
+	for bridge := range bridges {
+		s.federation.relay(bridge, Federation_Event_Opcode, event)
+	}
+	return true
+}
+
+// Handles a packet of another bridge. Events for rooms that aren't federated here are ignored.
+func (s *Server) receive_federation(bridge string, opcode string, payload json.RawMessage) {
+	switch opcode {
+	case Federation_Event_Opcode:
+		var event Federation_Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			s.Log(Subsystem_Delta).Warn().Msgf("bridge %s malformed %s: %v", bridge, opcode, err)
+			return
+		}
+		s.receive_federation_event(bridge, &event)
+
+	case Federation_Sync_Opcode:
+		var sync Federation_Sync
+		if err := json.Unmarshal(payload, &sync); err != nil {
+			s.Log(Subsystem_Delta).Warn().Msgf("bridge %s malformed %s: %v", bridge, opcode, err)
+			return
+		}
+		var rooms []RoomKey
+		for _, state := range sync.Rooms {
+			if s.Is_Federated(state.Room) {
+				s.reconcile_room(bridge, &state)
+				rooms = append(rooms, state.Room)
+			}
+		}
+		if sync.Reply && len(rooms) > 0 {
+			s.federation.relay(bridge, Federation_Sync_Opcode, s.federation_sync(false, rooms...))
+		}
+	}
+}
+
+func (s *Server) receive_federation_event(bridge string, e *Federation_Event) {
+	if !s.Is_Federated(e.Room) {
+		return
+	}
+	p := &Common_Packet{Command: e.Command, Name: e.Name, Value: e.Value, Rooms: e.Room}
+	if e.Origin != nil {
+		p.Origin = e.Origin
+	}
+
+	switch e.Command {
+	case "gmsg":
+	case "gvar":
+		s.SetRoomGlobalVar(nil, e.Room, e.Name, e.Value)
+	case "gvar_rename":
+		if !s.RenameRoomGlobalVar(nil, e.Room, e.Name, e.Value) {
+			return
+		}
+	case "gvar_delete":
+		if !s.DeleteRoomGlobalVar(e.Room, e.Name) {
+			return
+		}
+
+	case "pmsg", "pvar":
+		s.Multicast(p, s.Get_Clients(e.Room, e.Target))
+		return
+
+	case "ulist":
+		if e.User == nil || e.User.UUID == "" {
+			return
+		}
+		switch e.Mode {
+		case "add":
+			s.federation.add(bridge, e.Room, e.User)
+		case "remove":
+			s.federation.remove(e.Room, e.User.UUID)
+		default:
+			return
+		}
+		p.Mode, p.Value = e.Mode, e.User
+
+	default:
+		return
+	}
+
+	s.broadcast(e.Room, p)
+}
+
+// Builds the local state of federated rooms, for another bridge to reconcile. Remote members are left out.
+func (s *Server) federation_sync(reply bool, rooms ...RoomKey) *Federation_Sync {
+	sync := &Federation_Sync{Reply: reply, Rooms: make([]Federated_State, 0, len(rooms))}
+	for _, room := range rooms {
+		state := Federated_State{Room: room, Members: s.local_user_list(room), Vars: make([]Federated_Var, 0)}
+		for _, v := range s.Get_Room_Vars(room) {
+			state.Vars = append(state.Vars, Federated_Var{Name: v.Name, Value: v.Value})
+		}
+		sync.Rooms = append(sync.Rooms, state)
+	}
+	return sync
+}
+
+// Sends the state of every federated room to a bridge that just connected, and asks for its own.
+func (s *Server) Link_Federation(bridge string) {
+	federated := s.Config().Federated_Rooms
+	if len(federated) == 0 {
+		return
+	}
+	rooms := make([]RoomKey, 0, len(federated))
+	for _, room := range federated {
+		rooms = append(rooms, RoomKey(room))
+	}
+	s.federation.relay(bridge, Federation_Sync_Opcode, s.federation_sync(true, rooms...))
+}
+
+// Asks every bridge for the state of a federated room that was just opened here.
+func (s *Server) request_federated_state(room RoomKey) {
+	s.federation.relay("", Federation_Sync_Opcode, s.federation_sync(true, room))
+}
+
+// Applies the state of a room on another bridge. Its members replace those previously known on that bridge.
+// Variables missing here are adopted, and conflicting ones are settled in favor of the bridge with the lowest ID,
+// so that both bridges end up with the same values.
+func (s *Server) reconcile_room(bridge string, state *Federated_State) {
+	room := state.Room
+	current := make(map[string]bool)
+	for _, user := range state.Members {
+		if user == nil || user.UUID == "" {
+			continue
+		}
+		current[user.UUID] = true
+		if s.federation.add(bridge, room, user) {
+			s.broadcast(room, &Common_Packet{Command: "ulist", Mode: "add", Value: user, Rooms: room})
+		}
+	}
+	for _, user := range s.federation.list(room, bridge) {
+		if !current[user.UUID] && s.federation.remove(room, user.UUID) != nil {
+			s.broadcast(room, &Common_Packet{Command: "ulist", Mode: "remove", Value: user, Rooms: room})
+		}
+	}
+
+	gv := s.GetRoomGlobalVars(room)
+	if gv == nil {
+		return // Nobody here to share the variables with
+	}
+	for _, v := range state.Vars {
+		if local, ok := gv.Load(v.Name); ok && (reflect.DeepEqual(local, v.Value) || s.Self < bridge) {
+			continue
+		}
+		s.SetRoomGlobalVar(nil, room, v.Name, v.Value)
+		s.broadcast(room, &Common_Packet{Command: "gvar", Name: v.Name, Value: v.Value, Rooms: room})
+	}
+}
+
+// Forgets the members of a bridge that disconnected, and tells local members that they left.
+func (s *Server) Unlink_Federation(bridge string) {
+	for _, room := range s.Config().Federated_Rooms {
+		for _, user := range s.federation.list(RoomKey(room), bridge) {
+			if s.federation.remove(RoomKey(room), user.UUID) != nil {
+				s.broadcast(RoomKey(room), &Common_Packet{Command: "ulist", Mode: "remove", Value: user, Rooms: RoomKey(room)})
+			}
+		}
+	}
+}
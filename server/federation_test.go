@@ -0,0 +1,277 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+)
+
+// Connects the federation of two test bridges directly, as if each was in the BridgeRegistry of the other.
+func federate_bridges(t *testing.T, a, b *Test_Bridge) {
+	link := func(from, to *Test_Bridge) func(string, string, any) {
+		return func(bridge string, opcode string, payload any) {
+			if bridge != "" && bridge != to.Self {
+				return
+			}
+			data, err := json.Marshal(payload)
+			if err != nil {
+				t.Errorf("failed to marshal %s: %v", opcode, err)
+				return
+			}
+			to.receive_federation(from.Self, opcode, data)
+		}
+	}
+	a.federation.link(link(a, b))
+	b.federation.link(link(b, a))
+}
+
+// Connects a CL4 client with a username, and links it to a room.
+func federated_client(b *Test_Bridge, name string, room string) *Test_Client {
+	c := b.Connect(name)
+	c.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	b.Settle()
+	c.Send(`{"cmd":"setid","val":"` + name + `"}`)
+	b.Settle()
+	c.Send(`{"cmd":"link","val":"` + room + `"}`)
+	b.Settle()
+	c.Drain()
+	return c
+}
+
+// Returns the packets with a command that a client received since the last call.
+func received(c *Test_Client, command string) []Common_Packet {
+	var packets []Common_Packet
+	for _, frame := range c.Drain() {
+		var p Common_Packet
+		if json.Unmarshal([]byte(frame), &p) == nil && p.Command == command {
+			packets = append(packets, p)
+		}
+	}
+	return packets
+}
+
+func usernames(users []*CL4_UserObject) []string {
+	var names []string
+	for _, u := range users {
+		names = append(names, fmt.Sprint(u.Username))
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestFederation(t *testing.T) {
+	bridge := func(designation string) *Test_Bridge {
+		config := New_Test_Config()
+		config.Designation = designation
+		config.Federated_Rooms = []string{"game"}
+		return Start_Test_Bridge(t, config)
+	}
+	a, b := bridge("a"), bridge("b")
+	settle := func() {
+		a.Settle()
+		b.Settle()
+	}
+
+	// Each bridge has its own variables before they are linked
+	alice := federated_client(a, "alice", "game")
+	alice.Send(`{"cmd":"gvar","name":"score","val":1,"rooms":"game"}`)
+	alice.Send(`{"cmd":"gvar","name":"shared","val":"a","rooms":"game"}`)
+	bob := federated_client(b, "bob", "game")
+	bob.Send(`{"cmd":"gvar","name":"level","val":2,"rooms":"game"}`)
+	bob.Send(`{"cmd":"gvar","name":"shared","val":"b","rooms":"game"}`)
+	settle()
+	alice.Drain()
+	bob.Drain()
+
+	federate_bridges(t, a, b)
+	a.Link_Federation(b.Self)
+	settle()
+
+	// Missing variables are adopted, and conflicts are settled in favor of the bridge with the lowest ID
+	for _, br := range []*Test_Bridge{a, b} {
+		vars := make(map[string]any)
+		for _, v := range br.Get_Room_Vars("game") {
+			vars[fmt.Sprint(v.Name)] = v.Value
+		}
+		if fmt.Sprint(vars) != "map[level:2 score:1 shared:a]" {
+			t.Errorf("%s has variables %v after linking", br.Self, vars)
+		}
+	}
+	if names := usernames(a.Get_User_List("game")); !slices.Equal(names, []string{"alice", "bob"}) {
+		t.Errorf("%s lists %v in the federated room", a.Self, names)
+	}
+	if names := usernames(b.Get_User_List("game")); !slices.Equal(names, []string{"alice", "bob"}) {
+		t.Errorf("%s lists %v in the federated room", b.Self, names)
+	}
+	if adds := received(alice, "ulist"); len(adds) != 1 || adds[0].Mode != "add" {
+		t.Errorf("alice was told %+v about bob joining", adds)
+	}
+
+	// Messages and variables are relayed
+	alice.Send(`{"cmd":"gmsg","val":"hello","rooms":"game"}`)
+	settle()
+	if got := received(bob, "gmsg"); len(got) != 1 || got[0].Value != "hello" {
+		t.Errorf("bob received %+v, expected alice's gmsg", got)
+	}
+	bob.Send(`{"cmd":"gvar","name":"score","val":5,"rooms":"game"}`)
+	settle()
+	if got := received(alice, "gvar"); len(got) != 1 || got[0].Value != float64(5) {
+		t.Errorf("alice received %+v, expected bob's gvar", got)
+	}
+	if vars := a.Get_Room_Vars("game"); len(vars) != 3 || vars[1].Value != float64(5) {
+		t.Errorf("%s has variables %+v after a remote update", a.Self, vars)
+	}
+
+	// Private messages reach members on other bridges
+	alice.Send(`{"cmd":"pmsg","val":"psst","id":"bob","rooms":"game","listener":"pm"}`)
+	settle()
+	if got := received(bob, "pmsg"); len(got) != 1 || got[0].Value != "psst" {
+		t.Errorf("bob received %+v, expected alice's pmsg", got)
+	}
+	if got := received(alice, "statuscode"); len(got) != 1 || got[0].CodeID != StatusOK.Code {
+		t.Errorf("alice's pmsg to a remote member returned %+v", got)
+	}
+
+	// Members that join and leave are announced on the other bridge
+	carol := federated_client(b, "carol", "game")
+	settle()
+	if got := received(alice, "ulist"); len(got) != 1 || got[0].Mode != "add" {
+		t.Errorf("alice was told %+v about carol joining", got)
+	}
+	carol.Conn.Close()
+	settle()
+	if got := received(alice, "ulist"); len(got) != 1 || got[0].Mode != "remove" {
+		t.Errorf("alice was told %+v about carol leaving", got)
+	}
+
+	// Other rooms aren't federated
+	dave := federated_client(a, "dave", "lobby")
+	erin := federated_client(b, "erin", "lobby")
+	dave.Send(`{"cmd":"gmsg","val":"hello","rooms":"lobby"}`)
+	settle()
+	if got := received(erin, "gmsg"); len(got) != 0 {
+		t.Errorf("erin received %+v from an unfederated room", got)
+	}
+
+	// The members of a bridge are forgotten when it disconnects
+	a.Unlink_Federation(b.Self)
+	settle()
+	if got := received(alice, "ulist"); len(got) != 1 || got[0].Mode != "remove" {
+		t.Errorf("alice was told %+v about bob's bridge disconnecting", got)
+	}
+	if names := usernames(a.Get_User_List("game")); !slices.Equal(names, []string{"alice"}) {
+		t.Errorf("%s lists %v after the other bridge disconnected", a.Self, names)
+	}
+}
+
+// A federated room that is opened asks the other bridges for their state.
+func TestFederatedRoomOpening(t *testing.T) {
+	config := New_Test_Config()
+	config.Federated_Rooms = []string{"game"}
+	a := Start_Test_Bridge(t, config)
+	config = New_Test_Config()
+	config.Designation = "other"
+	config.Federated_Rooms = []string{"game"}
+	b := Start_Test_Bridge(t, config)
+	federate_bridges(t, a, b)
+
+	alice := federated_client(a, "alice", "game")
+	alice.Send(`{"cmd":"gvar","name":"score","val":1,"rooms":"game"}`)
+	a.Settle()
+
+	federated_client(b, "bob", "game")
+	if vars := b.Get_Room_Vars("game"); len(vars) != 1 || vars[0].Value != float64(1) {
+		t.Errorf("%s has variables %+v after opening a federated room", b.Self, vars)
+	}
+	if names := usernames(b.Get_User_List("game")); !slices.Equal(names, []string{"alice", "bob"}) {
+		t.Errorf("%s lists %v in the federated room", b.Self, names)
+	}
+}
+
+// Scratch clients create, rename and delete variables of federated rooms on every bridge.
+func TestFederatedScratchVariables(t *testing.T) {
+	bridge := func(designation string) *Test_Bridge {
+		config := New_Test_Config()
+		config.Designation = designation
+		config.Federated_Rooms = []string{"game"}
+		return Start_Test_Bridge(t, config)
+	}
+	a, b := bridge("a"), bridge("b")
+	federate_bridges(t, a, b)
+	settle := func() {
+		a.Settle()
+		b.Settle()
+	}
+
+	scratch := a.Connect("scratch")
+	scratch.Send(`{"method":"handshake","project_id":"game","user":"scratcher"}`)
+	bob := federated_client(b, "bob", "game")
+	settle()
+	bob.Drain()
+
+	scratch.Send(`{"method":"create","name":"☁ coins","value":"5"}`)
+	settle()
+	if got := received(bob, "gvar"); len(got) != 1 || got[0].Value != "5" || !strings.Contains(fmt.Sprint(got[0].Origin), "username:scratcher") {
+		t.Errorf("bob received %+v, expected the created variable", got)
+	}
+
+	scratch.Send(`{"method":"rename","name":"☁ coins","new_name":"☁ gems"}`)
+	settle()
+	if got := received(bob, "gvar_rename"); len(got) != 1 || got[0].Value != "☁ gems" {
+		t.Errorf("bob received %+v, expected the renamed variable", got)
+	}
+
+	scratch.Send(`{"method":"delete","name":"☁ gems"}`)
+	settle()
+	if got := received(bob, "gvar_delete"); len(got) != 1 || got[0].Name != "☁ gems" {
+		t.Errorf("bob received %+v, expected the deleted variable", got)
+	}
+	if vars := b.Get_Room_Vars("game"); len(vars) != 0 {
+		t.Errorf("%s has variables %+v after they were deleted", b.Self, vars)
+	}
+}
+
+// Names used on another bridge are refused, since those members can't be kicked from here.
+func TestFederatedUsernames(t *testing.T) {
+	bridge := func(designation string) *Test_Bridge {
+		config := New_Test_Config()
+		config.Designation = designation
+		config.Federated_Rooms = []string{"game"}
+		config.Username_Policy = Username_Policy_Kick
+		return Start_Test_Bridge(t, config)
+	}
+	a, b := bridge("a"), bridge("b")
+	federate_bridges(t, a, b)
+
+	alice := federated_client(a, "alice", "game")
+	b.Settle()
+
+	impostor := b.Connect("impostor")
+	impostor.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	impostor.Send(`{"cmd":"setid","val":"alice"}`)
+	b.Settle()
+	impostor.Drain()
+	impostor.Send(`{"cmd":"link","val":"game","listener":"link"}`)
+	b.Settle()
+	if got := received(impostor, "statuscode"); len(got) != 1 || got[0].CodeID != StatusIDConflict.Code {
+		t.Errorf("linking with a name used on another bridge returned %+v", got)
+	}
+	if !a.connected(alice) {
+		t.Error("alice was kicked by a client on another bridge")
+	}
+}
+
+func TestSnowflakeNodes(t *testing.T) {
+	if snowflake_node(0, "bridge@a") == snowflake_node(0, "bridge@b") {
+		t.Error("bridges with different names derived the same snowflake node")
+	}
+	if node := snowflake_node(0, "bridge@a"); node < 1 || node > 1023 {
+		t.Errorf("derived snowflake node %d is out of range", node)
+	}
+	if node := snowflake_node(7, "bridge@a"); node != 7 {
+		t.Errorf("configured snowflake node 7 was replaced by %d", node)
+	}
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-delta/duplex"
+	"github.com/fasthttp/websocket"
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+// How long a step waits without receiving any frame before it is considered complete.
+const quiet_period = 100 * time.Millisecond
+
+// Test_Bridge is an in-process bridge server listening on an ephemeral port.
+type Test_Bridge struct {
+	*Server
+	Address string
+	t       *testing.T
+	clients []*Test_Client // Currently connected
+	known   []*Test_Client // Every client that ever connected
+	peers   sync.Map       // Test_Client of each Delta BridgeClient
+	stopped bool
+	Dialer  *websocket.Dialer // Used by Connect if set
+}
+
+// Test_Client is a simulated classic client or Delta peer that records every frame it receives.
+type Test_Client struct {
+	Name   string
+	Conn   *websocket.Conn
+	Delta  *BridgeClient // Set instead of Conn for Delta peers
+	Bridge *Test_Bridge
+	ID     string
+	UUID   string
+	mux    sync.Mutex
+	frames []string
+	done   chan struct{}
+}
+
+// Returns a configuration suitable for tests. Callers may modify it before starting the bridge.
+func New_Test_Config() *Config {
+	return &Config{
+		Designation:         "test",
+		Standalone_Mode:     true,
+		Enable_MOTD:         true,
+		MOTD_Message:        "Hello from the test bridge!",
+		Maximum_Rooms:       100,
+		Maximum_Clients:     100,
+		Rate_Limit_Burst:    1000,
+		Rate_Limit_Interval: time.Second,
+		Address:             "127.0.0.1:0",
+		Log_Level:           zerolog.Disabled,
+	}
+}
+
+// Starts a bridge server in standalone mode and stops it when the test finishes.
+func Start_Test_Bridge(t *testing.T, config *Config) *Test_Bridge {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	b := &Test_Bridge{Server: New(config, nil), Address: ln.Addr().String(), t: t}
+	b.write_peer = b.record_peer
+	go b.Serve(ln)
+
+	t.Cleanup(func() {
+		for _, c := range b.clients {
+			if c.Conn != nil {
+				c.Conn.Close()
+			}
+		}
+		if !b.stopped {
+			b.Stop()
+		}
+	})
+	return b
+}
+
+// Shuts the bridge down and waits for it to finish.
+func (b *Test_Bridge) Stop() {
+	b.stopped = true
+	b.Close <- true
+	<-b.Done
+}
+
+// Connects a new simulated client and resolves the IDs that the bridge assigned to it.
+func (b *Test_Bridge) Connect(name string) *Test_Client {
+	b.t.Helper()
+	return b.Connect_To(name, "/", nil)
+}
+
+// Like Connect, but with a custom path and headers.
+func (b *Test_Bridge) Connect_To(name string, path string, header http.Header) *Test_Client {
+	b.t.Helper()
+
+	// Remember who was already connected so the new client can be identified
+	known := make(map[*BridgeClient]bool)
+	b.classicclientsmu.RLock()
+	for c := range b.ClassicClients {
+		known[c] = true
+	}
+	b.classicclientsmu.RUnlock()
+
+	dialer := websocket.DefaultDialer
+	if b.Dialer != nil {
+		dialer = b.Dialer
+	}
+	conn, _, err := dialer.Dial("ws://"+b.Address+path, header)
+	if err != nil {
+		b.t.Fatalf("%s failed to connect: %v", name, err)
+	}
+
+	client := &Test_Client{Name: name, Conn: conn, Bridge: b, done: make(chan struct{})}
+	go client.read()
+
+	deadline := time.Now().Add(time.Second)
+	for client.ID == "" {
+		if time.Now().After(deadline) {
+			b.t.Fatalf("%s never registered on the bridge", name)
+		}
+		b.classicclientsmu.RLock()
+		for c := range b.ClassicClients {
+			if !known[c] {
+				client.ID, client.UUID = c.ID, c.UUID
+			}
+		}
+		b.classicclientsmu.RUnlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	b.clients = append(b.clients, client)
+	b.known = append(b.known, client)
+	return client
+}
+
+// Connect_Delta adds a simulated Delta peer to the default room, as if it had linked to it. The bridge writes to
+// peers through write_peer, which records each packet as a JSON frame, and frames sent by the peer are decoded as
+// packets and handled like those of a real peer.
+func (b *Test_Bridge) Connect_Delta(name string) *Test_Client {
+	peer := &duplex.Peer{KeyStore: make(map[string]any)}
+	bc := &BridgeClient{
+		Peer:     peer,
+		ID:       b.snowflakeGen.Generate().String(),
+		UUID:     "delta-" + name,
+		writer:   make(chan frame, 256),
+		exit:     make(chan bool, 1),
+		Server:   b.Server,
+		Protocol: New_Delta(b.Server),
+	}
+	bc.SetUsername(name)
+	peer.KeyStore["bridge_client"] = bc
+	peer.KeyStore["snowflake_id"] = bc.ID
+	b.Subscribe(bc, DEFAULT_ROOM)
+
+	client := &Test_Client{Name: name, Delta: bc, Bridge: b, ID: bc.ID, UUID: bc.UUID, done: make(chan struct{})}
+	close(client.done)
+	b.peers.Store(bc, client)
+	b.clients = append(b.clients, client)
+	b.known = append(b.known, client)
+	return client
+}
+
+func (b *Test_Bridge) record_peer(c *BridgeClient, p *duplex.TxPacket) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		b.t.Errorf("failed to marshal %s: %v", p.Opcode, err)
+		return
+	}
+	if client, ok := b.peers.Load(c); ok {
+		client.(*Test_Client).record(string(data))
+	}
+}
+
+// Exchange opens a short-lived connection with custom headers, sends frames (waiting for the bridge to
+// settle after each one), and returns what was received along with the close code, or 0 if it stayed open.
+func (b *Test_Bridge) Exchange(path string, header http.Header, frames ...string) ([]string, int) {
+	b.t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+b.Address+path, header)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A read that times out breaks the connection, so frames are read in the background instead
+	incoming := make(chan string)
+	closed := make(chan int, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					closed <- closeErr.Code
+				}
+				close(incoming)
+				return
+			}
+			select {
+			case incoming <- string(msg):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var received []string
+	read := func() int {
+		for {
+			select {
+			case msg, ok := <-incoming:
+				if !ok {
+					select {
+					case code := <-closed:
+						return code
+					default:
+						return 0
+					}
+				}
+				received = append(received, msg)
+			case <-time.After(quiet_period):
+				return 0
+			}
+		}
+	}
+
+	if len(frames) == 0 {
+		return received, read()
+	}
+	for _, frame := range frames {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			return received, 0
+		}
+		if code := read(); code != 0 {
+			return received, code
+		}
+	}
+	return received, 0
+}
+
+func (c *Test_Client) read() {
+	defer close(c.done)
+	for {
+		msg_type, msg, err := c.Conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				c.record(fmt.Sprintf("close %d %s", closeErr.Code, closeErr.Text))
+			}
+			return
+		}
+
+		// Binary frames are recorded as the equivalent JSON
+		if msg_type == websocket.BinaryMessage {
+			if decoded, err := msgpack_to_json(msg); err == nil {
+				msg = append([]byte("(msgpack) "), decoded...)
+			}
+		}
+		c.record(string(msg))
+	}
+}
+
+func (c *Test_Client) record(frame string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.frames = append(c.frames, frame)
+}
+
+// Returns and clears every frame received so far.
+func (c *Test_Client) Drain() []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	frames := c.frames
+	c.frames = nil
+	return frames
+}
+
+func (c *Test_Client) pending() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.frames)
+}
+
+// Sends a raw text frame to the bridge. Delta peers send a JSON packet instead.
+func (c *Test_Client) Send(frame string) {
+	if c.Delta != nil {
+		var packet duplex.RxPacket
+		if err := json.Unmarshal([]byte(frame), &packet); err != nil {
+			c.Bridge.t.Fatalf("%s failed to decode %s: %v", c.Name, frame, err)
+		}
+		handler, ok := c.Bridge.delta_handlers()[packet.Opcode]
+		if !ok {
+			c.Bridge.t.Fatalf("%s sent unknown opcode %s", c.Name, packet.Opcode)
+		}
+		go handler(c.Delta.Peer, &packet)
+		return
+	}
+	if err := c.Conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		c.Bridge.t.Fatalf("%s failed to send: %v", c.Name, err)
+	}
+}
+
+// Sends a JSON packet to the bridge as MessagePack, in a binary frame.
+func (c *Test_Client) Send_MessagePack(packet string) {
+	frame, err := json_to_msgpack([]byte(packet))
+	if err != nil {
+		c.Bridge.t.Fatalf("%s failed to encode %s: %v", c.Name, packet, err)
+	}
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		c.Bridge.t.Fatalf("%s failed to send: %v", c.Name, err)
+	}
+}
+
+// Waits until no client has received a frame for the quiet period.
+func (b *Test_Bridge) Settle() {
+	last := -1
+	for {
+		total := 0
+		for _, c := range b.clients {
+			total += c.pending()
+		}
+		if total == last {
+			return
+		}
+		last = total
+		time.Sleep(quiet_period)
+	}
+}
+
+// Replaces the IDs and UUIDs that the bridge generated with stable placeholders.
+func (b *Test_Bridge) normalize(frame string) string {
+	for _, c := range b.known {
+		frame = strings.ReplaceAll(frame, c.UUID, "<uuid:"+c.Name+">")
+		frame = strings.ReplaceAll(frame, c.ID, "<id:"+c.Name+">")
+	}
+	return frame
+}
+
+// Transcript records what every client receives in response to each step of a scenario.
+type Transcript struct {
+	bridge *Test_Bridge
+	sb     strings.Builder
+}
+
+func (b *Test_Bridge) Transcript() *Transcript {
+	return &Transcript{bridge: b}
+}
+
+// Step sends a frame from a client, waits for the bridge to settle, and records every frame received as a result.
+func (tr *Transcript) Step(from *Test_Client, frame string) {
+	fmt.Fprintf(&tr.sb, ">>> %s: %s\n", from.Name, strings.ReplaceAll(frame, "\n", `\n`))
+	from.Send(frame)
+	tr.Collect()
+}
+
+// Step_MessagePack is like Step, but sends the frame as MessagePack.
+func (tr *Transcript) Step_MessagePack(from *Test_Client, frame string) {
+	fmt.Fprintf(&tr.sb, ">>> %s (msgpack): %s\n", from.Name, frame)
+	from.Send_MessagePack(frame)
+	tr.Collect()
+}
+
+// Disconnect closes a client's connection and records the frames that other clients receive as a result.
+func (tr *Transcript) Disconnect(from *Test_Client) {
+	fmt.Fprintf(&tr.sb, "--- %s disconnects\n", from.Name)
+	from.Conn.Close()
+	<-from.done
+	tr.bridge.clients = slices.DeleteFunc(tr.bridge.clients, func(c *Test_Client) bool { return c == from })
+	tr.Collect()
+}
+
+// Collect waits for the bridge to settle and records every pending frame.
+func (tr *Transcript) Collect() {
+	tr.bridge.Settle()
+	clients := slices.Clone(tr.bridge.clients)
+	slices.SortFunc(clients, func(a, b *Test_Client) int { return strings.Compare(a.Name, b.Name) })
+	for _, c := range clients {
+		for _, frame := range c.Drain() {
+			fmt.Fprintf(&tr.sb, "<<< %s: %s\n", c.Name, strings.ReplaceAll(tr.bridge.normalize(frame), "\n", `\n`))
+		}
+	}
+	tr.sb.WriteString("\n")
+}
+
+func (tr *Transcript) String() string {
+	return tr.sb.String()
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gofiber/contrib/v3/websocket"
+)
+
+// Classic clients are pinged every Ping_Interval, and must send something, even if only a pong, within every
+// Idle_Timeout. Any frame counts, so CL4's ping command keeps a client alive as well. Clients must also be
+// detected and finish their handshake within Handshake_Timeout. Timed out clients are closed with Timeout_Error,
+// and then removed by Destroy_Client like any other disconnected client.
+
+func validate_timeouts(config *Config) error {
+	if config.Ping_Interval < 0 || config.Idle_Timeout < 0 || config.Handshake_Timeout < 0 {
+		return errors.New("timeouts cannot be negative")
+	}
+	if config.Ping_Interval > 0 && config.Idle_Timeout > 0 && config.Ping_Interval >= config.Idle_Timeout {
+		return errors.New("the ping interval must be shorter than the idle timeout")
+	}
+	return nil
+}
+
+// Complete_Handshake marks a client as having finished its handshake, which stops Handshake_Timeout from closing it.
+// Protocols call this once a client has identified itself, or once it turns out to use a dialect without a handshake.
+func (c *BridgeClient) Complete_Handshake() {
+	c.handshaken.Store(true)
+}
+
+// Handshake_Completed reports whether a client has finished its handshake.
+func (c *BridgeClient) Handshake_Completed() bool {
+	return c.handshaken.Load()
+}
+
+// Closes a client if it hasn't finished its handshake once Handshake_Timeout elapses. Returns nil if disabled.
+func (s *Server) start_handshake_timer(c *BridgeClient) *time.Timer {
+	if s.Config().Handshake_Timeout <= 0 {
+		return nil
+	}
+	return time.AfterFunc(s.Config().Handshake_Timeout, func() {
+		if c.Handshake_Completed() {
+			return
+		}
+		s.Logger.Warn().Msgf("%s ⚠️  Aborting connection to client: Handshake timed out.", c.GiveName())
+		s.Metrics.Timeouts.Inc("handshake")
+		s.Evict_Client(c, Timeout_Error)
+	})
+}
+
+// Pushes back the read deadline of a client by Idle_Timeout. Called whenever the client sends a frame or a pong.
+func (c *BridgeClient) extend_idle_deadline() {
+	if idle := c.Server.Config().Idle_Timeout; idle > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(idle))
+	}
+}
+
+// Starts the idle timer of a client, and refreshes it whenever the client answers a ping.
+func (c *BridgeClient) watch_idle() {
+	if c.Server.Config().Idle_Timeout <= 0 {
+		return
+	}
+	c.extend_idle_deadline()
+	c.Conn.SetPongHandler(func(string) error {
+		c.extend_idle_deadline()
+		return nil
+	})
+}
+
+// Returns a channel that ticks every Ping_Interval, or nil if pings are disabled. The ticker must be stopped.
+func (c *BridgeClient) ping_ticker() (*time.Ticker, <-chan time.Time) {
+	if c.Server.Config().Ping_Interval <= 0 {
+		return nil, nil
+	}
+	ticker := time.NewTicker(c.Server.Config().Ping_Interval)
+	return ticker, ticker.C
+}
+
+func (c *BridgeClient) send_ping() {
+	deadline := time.Now().Add(c.Server.Config().Ping_Interval)
+	if err := c.Conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+		c.Server.Logger.Debug().Msgf("%s Failed to ping client: %v", c.GiveName(), err)
+	}
+}
+
+// Reports whether a read failed because the client went idle for longer than Idle_Timeout.
+func is_timeout(err error) bool {
+	var net_err net.Error
+	return errors.As(err, &net_err) && net_err.Timeout()
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reports whether the bridge still has a classic client connected.
+func (b *Test_Bridge) connected(c *Test_Client) bool {
+	b.classicclientsmu.RLock()
+	defer b.classicclientsmu.RUnlock()
+	for client := range b.ClassicClients {
+		if client.UUID == c.UUID {
+			return true
+		}
+	}
+	return false
+}
+
+func timed_out(c *Test_Client) bool {
+	return slices.Contains(c.Drain(), "close 4011 Timed out")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	config := New_Test_Config()
+	config.Ping_Interval = 0
+	config.Idle_Timeout = 100 * time.Millisecond
+	b := Start_Test_Bridge(t, config)
+
+	idle := b.Connect("idle")
+	busy := b.Connect("busy")
+	busy.Send(`{"cmd":"handshake"}`)
+	for range 5 {
+		time.Sleep(40 * time.Millisecond)
+		busy.Send(`{"cmd":"ping"}`)
+	}
+
+	if b.connected(idle) || !timed_out(idle) {
+		t.Error("idle client wasn't closed with Timeout_Error")
+	}
+	if !b.connected(busy) {
+		t.Error("client that kept sending packets was closed")
+	}
+
+	var sb strings.Builder
+	b.Write_Metrics(&sb)
+	if !strings.Contains(sb.String(), `bridge_timeouts_total{reason="idle"} 1`) {
+		t.Errorf("idle timeout missing from metrics:\n%s", sb.String())
+	}
+}
+
+func TestPingsKeepClientsAlive(t *testing.T) {
+	config := New_Test_Config()
+	config.Ping_Interval = 20 * time.Millisecond
+	config.Idle_Timeout = 100 * time.Millisecond
+	b := Start_Test_Bridge(t, config)
+
+	// The test client answers pings while it reads, without ever sending a packet
+	c := b.Connect("quiet")
+	time.Sleep(300 * time.Millisecond)
+	if !b.connected(c) {
+		t.Fatalf("client answering pings was closed: %v", c.Drain())
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	config := New_Test_Config()
+	config.Handshake_Timeout = 100 * time.Millisecond
+	b := Start_Test_Bridge(t, config)
+
+	silent := b.Connect("silent")
+	unidentified := b.Connect_To("unidentified", "/cl4/0.2.0", nil)
+	unidentified.Send(`{"cmd":"setid","val":"unidentified","listener":"x"}`)
+	cl4 := b.Connect("cl4")
+	cl4.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	cl3 := b.Connect("cl3")
+	cl3.Send(`{"cmd":"gmsg","val":"hello"}`)
+	scratch := b.Connect("scratch")
+	scratch.Send(`{"method":"handshake","user":"scratcher","project_id":"1"}`)
+	cl2 := b.Connect("cl2")
+	cl2.Send("<%sh>\n")
+
+	time.Sleep(200 * time.Millisecond)
+	b.Settle()
+
+	if b.connected(silent) || !timed_out(silent) {
+		t.Error("client that never sent a packet wasn't closed with Timeout_Error")
+	}
+	if b.connected(unidentified) || !timed_out(unidentified) {
+		t.Error("CL4 0.2.0 client that never sent a handshake wasn't closed with Timeout_Error")
+	}
+	for _, c := range []*Test_Client{cl4, cl3, scratch, cl2} {
+		if !b.connected(c) {
+			t.Errorf("%s was closed after completing its handshake: %v", c.Name, c.Drain())
+		}
+	}
+}
+
+func TestCL4Ping(t *testing.T) {
+	b := Start_Test_Bridge(t, New_Test_Config())
+
+	c := b.Connect("pinger")
+	c.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	b.Settle()
+	c.Drain()
+
+	c.Send(`{"cmd":"ping","listener":"hi"}`)
+	b.Settle()
+	frames := c.Drain()
+	if len(frames) != 1 || !strings.Contains(frames[0], `"cmd":"statuscode"`) || !strings.Contains(frames[0], `"code_id":100`) || !strings.Contains(frames[0], `"listener":"hi"`) {
+		t.Errorf("ping was answered with %v, expected a statuscode OK with the listener", frames)
+	}
+}
+
+func TestValidateTimeouts(t *testing.T) {
+	for _, config := range []Config{
+		{Ping_Interval: time.Minute, Idle_Timeout: time.Minute},
+		{Ping_Interval: time.Minute, Idle_Timeout: time.Second},
+		{Handshake_Timeout: -time.Second},
+	} {
+		if err := validate_timeouts(&config); err == nil {
+			t.Errorf("validate_timeouts accepted ping interval %v, idle timeout %v and handshake timeout %v",
+				config.Ping_Interval, config.Idle_Timeout, config.Handshake_Timeout)
+		}
+	}
+	if err := validate_timeouts(&Config{Ping_Interval: time.Second, Idle_Timeout: time.Minute}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// ip_limiter counts concurrent classic connections per source IP.
+type ip_limiter struct {
+	mux        sync.Mutex
+	counts     map[string]int
+	limit      int
+	exemptions []netip.Prefix
+}
+
+func new_ip_limiter(limit uint, exemptions []string) (*ip_limiter, error) {
+	l := &ip_limiter{counts: make(map[string]int)}
+	if err := l.configure(limit, exemptions); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Sets the per-IP limit and parses its CIDR exemptions. Single addresses are accepted as well.
+func (l *ip_limiter) configure(limit uint, exemptions []string) error {
+	var prefixes []netip.Prefix
+	for _, raw := range exemptions {
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			addr, addr_err := netip.ParseAddr(raw)
+			if addr_err != nil {
+				return fmt.Errorf("invalid IP limit exemption %q: %w", raw, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.limit = int(limit)
+	l.exemptions = prefixes
+	return nil
+}
+
+func (l *ip_limiter) exempt(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(l.exemptions, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// Counts a new connection from an IP. Returns false, without counting it, if the IP is over the limit.
+func (l *ip_limiter) acquire(ip string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.limit > 0 && l.counts[ip] >= l.limit && !l.exempt(ip) {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+// Forgets a connection from an IP, and returns how many connections from it are left.
+func (l *ip_limiter) release(ip string) int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+		return 0
+	}
+	l.counts[ip]--
+	return l.counts[ip]
+}
+
+// Returns the number of distinct connected IPs, and the highest number of connections from a single IP.
+func (l *ip_limiter) stats() (ips int, busiest int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, count := range l.counts {
+		busiest = max(busiest, count)
+	}
+	return len(l.counts), busiest
+}
+
+// Connections_Per_IP returns a snapshot of the number of classic connections from each source IP.
+func (s *Server) Connections_Per_IP() map[string]int {
+	s.ip_limits.mux.Lock()
+	defer s.ip_limits.mux.Unlock()
+	counts := make(map[string]int, len(s.ip_limits.counts))
+	for ip, count := range s.ip_limits.counts {
+		counts[ip] = count
+	}
+	return counts
+}
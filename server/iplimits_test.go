@@ -0,0 +1,54 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestIPLimiter(t *testing.T) {
+	l, err := new_ip_limiter(2, []string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1"} {
+		if !l.acquire(ip) {
+			t.Fatalf("connection from %s refused below the limit", ip)
+		}
+	}
+	if l.acquire("192.0.2.1") {
+		t.Error("connection over the limit was accepted")
+	}
+	if !l.acquire("192.0.2.2") {
+		t.Error("connection from another address was refused")
+	}
+	for range 3 {
+		if !l.acquire("10.1.2.3") || !l.acquire("::1") {
+			t.Fatal("exempt address was refused")
+		}
+	}
+
+	l.release("192.0.2.1")
+	if !l.acquire("192.0.2.1") {
+		t.Error("connection refused after another one was released")
+	}
+
+	if ips, busiest := l.stats(); ips != 4 || busiest != 3 {
+		t.Errorf("stats() = %d, %d, expected 4, 3", ips, busiest)
+	}
+
+	if _, err := new_ip_limiter(1, []string{"not an address"}); err == nil {
+		t.Error("invalid exemption was accepted")
+	}
+}
+
+func TestPerIPConnectionLimit(t *testing.T) {
+	config := New_Test_Config()
+	config.Maximum_Clients_Per_IP = 2
+	b := Start_Test_Bridge(t, config)
+
+	b.Connect("first")
+	b.Connect("second")
+	if _, code := b.Exchange("/", nil); code != int(Overloaded_Status.Code) {
+		t.Errorf("connection over the limit closed with %d, expected %d", code, Overloaded_Status.Code)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Subsystems that can be given their own log level with Config.Subsystem_Log_Levels.
+const (
+	Subsystem_Rooms   = "rooms"
+	Subsystem_CL2     = "cl2"
+	Subsystem_CL4     = "cl4"
+	Subsystem_Scratch = "scratch"
+	Subsystem_Delta   = "delta"
+)
+
+var Subsystems = []string{Subsystem_Rooms, Subsystem_CL2, Subsystem_CL4, Subsystem_Scratch, Subsystem_Delta}
+
+// Log formats accepted by Config.Log_Format.
+const (
+	Log_Format_Console = "console"
+	Log_Format_JSON    = "json"
+)
+
+// Checks the logging options of a configuration.
+func validate_logging(config *Config) error {
+	switch config.Log_Format {
+	case "", Log_Format_Console, Log_Format_JSON:
+	default:
+		return fmt.Errorf("invalid log format %q", config.Log_Format)
+	}
+	for subsystem := range config.Subsystem_Log_Levels {
+		if !slices.Contains(Subsystems, subsystem) {
+			return fmt.Errorf("unknown logging subsystem %q", subsystem)
+		}
+	}
+	return nil
+}
+
+// Creates the base logger of the server, and the log file it writes to if any.
+func (s *Server) new_logger(config *Config) (*zerolog.Logger, *rotating_file, error) {
+	if config.Logger != nil {
+		logger := config.Logger.Level(config.Log_Level)
+		return &logger, nil, nil
+	}
+
+	var output io.Writer = os.Stdout
+	var file *rotating_file
+	if config.Log_File != "" {
+		var err error
+		if file, err = open_rotating_file(config.Log_File, int64(config.Log_File_Max_Size)*1024*1024, config.Log_File_Backups); err != nil {
+			return nil, nil, err
+		}
+		output = file
+	}
+
+	if config.Log_Format != Log_Format_JSON {
+		output = zerolog.ConsoleWriter{Out: output, TimeFormat: time.RFC3339, NoColor: file != nil}
+	}
+
+	logger := zerolog.New(output).With().Timestamp().Str("instance", s.Self).Logger().Level(config.Log_Level)
+	return &logger, file, nil
+}
+
+// Derives the logger of every subsystem from the base logger, then applies the levels and sample rate of a
+// configuration. Loggers are only created once, since other goroutines use them without a lock: reloading the
+// configuration updates their log_filter instead.
+func (s *Server) configure_loggers(config *Config) {
+	if s.loggers == nil {
+		s.log_filters = make(map[string]*log_filter, len(Subsystems)+1)
+		s.log_filters[""] = &log_filter{}
+		*s.Logger = s.Logger.Level(zerolog.TraceLevel).Sample(s.log_filters[""])
+
+		s.loggers = make(map[string]*zerolog.Logger, len(Subsystems))
+		for _, subsystem := range Subsystems {
+			s.log_filters[subsystem] = &log_filter{}
+			logger := s.Logger.With().Str("subsystem", subsystem).Logger().Sample(s.log_filters[subsystem])
+			s.loggers[subsystem] = &logger
+		}
+	}
+
+	// Only the subsystems are sampled
+	s.log_filters[""].set(config.Log_Level, 0)
+	for _, subsystem := range Subsystems {
+		level, ok := config.Subsystem_Log_Levels[subsystem]
+		if !ok {
+			level = config.Log_Level
+		}
+		s.log_filters[subsystem].set(level, config.Log_Sample_Rate)
+	}
+}
+
+// log_filter is the zerolog.Sampler of a logger. It drops the events below a minimum level, and keeps only 1 in
+// every sample_rate trace and debug events if sample_rate is over 1.
+type log_filter struct {
+	level       atomic.Int32
+	sample_rate atomic.Uint32
+	counters    [2]atomic.Uint32 // Trace, Debug
+}
+
+func (f *log_filter) set(level zerolog.Level, sample_rate uint32) {
+	f.level.Store(int32(level))
+	f.sample_rate.Store(sample_rate)
+}
+
+func (f *log_filter) Sample(level zerolog.Level) bool {
+	if level < zerolog.Level(f.level.Load()) {
+		return false
+	}
+	n := f.sample_rate.Load()
+	if n <= 1 || level > zerolog.DebugLevel {
+		return true
+	}
+	return f.counters[level-zerolog.TraceLevel].Add(1)%n == 1
+}
+
+// Log returns the logger of a subsystem, or the base logger for anything else.
+func (s *Server) Log(subsystem string) *zerolog.Logger {
+	if logger, ok := s.loggers[subsystem]; ok {
+		return logger
+	}
+	return s.Logger
+}
+
+// rotating_file is a log file that is renamed to <path>.1 once it grows over a maximum size. Older files are
+// shifted to <path>.2 and so on, up to the number of backups to keep.
+type rotating_file struct {
+	mux      sync.Mutex
+	path     string
+	max_size int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+func open_rotating_file(path string, max_size int64, backups int) (*rotating_file, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f := &rotating_file{path: path, max_size: max_size, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotating_file) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotating_file) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.backups <= 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+	for i := f.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *rotating_file) Write(p []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.max_size > 0 && f.size > 0 && f.size+int64(len(p)) > f.max_size {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotating_file) Close() error {
+	if f == nil {
+		return nil
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "bridge.log")
+	f, err := open_rotating_file(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for range 5 {
+		if _, err := f.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, line) {
+			t.Errorf("%s holds %d bytes, expected a single line", filepath.Base(name), len(data))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("more backups were kept than configured")
+	}
+}
+
+// A buffer that may be written to concurrently.
+type log_buffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *log_buffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+// Returns the JSON log lines written so far.
+func (b *log_buffer) Lines(t *testing.T) []map[string]any {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	var lines []map[string]any
+	for line := range strings.SplitSeq(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line isn't JSON: %s", line)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestSubsystemLogging(t *testing.T) {
+	var output log_buffer
+	logger := zerolog.New(&output)
+
+	config := New_Test_Config()
+	config.Logger = &logger
+	config.Log_Level = zerolog.WarnLevel
+	config.Subsystem_Log_Levels = map[string]zerolog.Level{Subsystem_Rooms: zerolog.DebugLevel}
+	b := Start_Test_Bridge(t, config)
+
+	a := b.Connect("a")
+	a.Send(`{"cmd":"handshake","listener":"hello"}`)
+	b.Settle()
+
+	rooms := 0
+	for _, line := range output.Lines(t) {
+		if line["level"] == "debug" && line["subsystem"] != Subsystem_Rooms {
+			t.Errorf("debug line logged outside of the rooms subsystem: %v", line)
+		}
+		if line["level"] == "debug" && line["subsystem"] == Subsystem_Rooms {
+			rooms++
+		}
+	}
+	if rooms == 0 {
+		t.Error("debug lines of the rooms subsystem weren't logged")
+	}
+
+	// Debug lines are sampled once reloaded with a sample rate
+	reloaded := *config
+	reloaded.Log_Sample_Rate = 10
+	if _, err := b.Reload_Config(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	output.mux.Lock()
+	output.buf.Reset()
+	output.mux.Unlock()
+
+	for range 100 {
+		b.Log(Subsystem_Rooms).Debug().Msg("sampled")
+	}
+	b.Log(Subsystem_Rooms).Warn().Msg("not sampled")
+	if lines := output.Lines(t); len(lines) != 11 {
+		t.Errorf("logged %d lines, expected 10 sampled debug lines and a warning", len(lines))
+	}
+}
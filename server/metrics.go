@@ -0,0 +1,303 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// Commands that are reported as-is in metric labels. Anything else is reported as "unknown",
+// so that clients can't inflate the number of exported series by sending made-up commands.
+var known_commands = map[string]bool{
+	// CL3/CL4
+	"handshake": true, "setid": true, "gmsg": true, "gvar": true, "pmsg": true, "pvar": true,
+	"direct": true, "link": true, "unlink": true, "ping": true, "statuscode": true, "ulist": true,
+	"server_version": true, "motd": true, "client_obj": true, "client_ip": true,
+	"linked_gmsg": true, "linked_pmsg": true, "gvar_delete": true, "gvar_rename": true,
+
+	// Scratch
+	"set": true, "create": true, "rename": true, "delete": true,
+
+	// CL2
+	"sh": true, "rl": true, "rt": true, "sn": true, "rf": true, "gs": true, "ps": true,
+	"l_g": true, "l_p": true, "ds": true, "global": true, "private": true, "disconnect": true,
+}
+
+func metric_command(command string) string {
+	if known_commands[command] {
+		return command
+	}
+	return "unknown"
+}
+
+// Returns the command (or method) of a packet for use in metric labels.
+func packet_command(p Packet) string {
+	switch packet := p.(type) {
+	case *Common_Packet:
+		return metric_command(packet.Command)
+	case *ScratchPacket:
+		return metric_command(packet.Method)
+	case *CL2Packet:
+		return metric_command(packet.Command)
+	default:
+		return "unknown"
+	}
+}
+
+// Returns the protocol name of a client for use in metric labels.
+func client_protocol(c *BridgeClient) string {
+	if c == nil {
+		return "undetected"
+	}
+	protocol := c.GetProtocol()
+	if protocol == nil {
+		return "undetected"
+	}
+	return protocol.Name()
+}
+
+type counter_entry struct {
+	labels []string
+	value  atomic.Uint64
+}
+
+// counter_vec is a Prometheus counter partitioned by a fixed set of labels.
+type counter_vec struct {
+	name    string
+	help    string
+	labels  []string
+	mux     sync.RWMutex
+	entries map[string]*counter_entry
+}
+
+func new_counter_vec(name string, help string, labels ...string) *counter_vec {
+	return &counter_vec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		entries: make(map[string]*counter_entry),
+	}
+}
+
+func (v *counter_vec) Inc(values ...string) {
+	v.Add(1, values...)
+}
+
+func (v *counter_vec) Add(n uint64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	v.mux.RLock()
+	entry, ok := v.entries[key]
+	v.mux.RUnlock()
+
+	if !ok {
+		v.mux.Lock()
+		if entry, ok = v.entries[key]; !ok {
+			entry = &counter_entry{labels: slices.Clone(values)}
+			v.entries[key] = entry
+		}
+		v.mux.Unlock()
+	}
+
+	entry.value.Add(n)
+}
+
+func (v *counter_vec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+
+	v.mux.RLock()
+	keys := make([]string, 0, len(v.entries))
+	for key := range v.entries {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		entry := v.entries[key]
+		fmt.Fprintf(w, "%s%s %d\n", v.name, format_labels(v.labels, entry.labels), entry.value.Load())
+	}
+	v.mux.RUnlock()
+}
+
+type counter_value struct {
+	labels []string
+	value  uint64
+}
+
+// Returns a snapshot of every counter, keyed by its joined labels.
+func (v *counter_vec) values() map[string]counter_value {
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+	values := make(map[string]counter_value, len(v.entries))
+	for key, entry := range v.entries {
+		values[key] = counter_value{labels: entry.labels, value: entry.value.Load()}
+	}
+	return values
+}
+
+type gauge_sample struct {
+	labels []string
+	value  float64
+}
+
+// Writes a single gauge family.
+func write_gauge(w io.Writer, name string, help string, labels []string, samples ...gauge_sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s %v\n", name, format_labels(labels, sample.labels), sample.value)
+	}
+}
+
+var label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func format_labels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(label_escaper.Replace(value))
+		sb.WriteString(`"`)
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// Metrics holds the bridge's Prometheus counters. Gauges are sampled from the server when scraped.
+type Metrics struct {
+	Packets_Received *counter_vec
+	Packets_Sent     *counter_vec
+	Send_Drops       *counter_vec
+	Quirks_Drops     *counter_vec
+	Rate_Limit_Hits  *counter_vec
+	IP_Limit_Hits    *counter_vec
+
+	Slow_Consumer_Evictions *counter_vec
+	Timeouts                *counter_vec
+
+	// Bytes of the frames sent compressed, before and after compression
+	Compression_Input  *counter_vec
+	Compression_Output *counter_vec
+}
+
+func New_Metrics() *Metrics {
+	return &Metrics{
+		Packets_Received: new_counter_vec("bridge_packets_received_total", "Packets received from classic clients.", "protocol", "command"),
+		Packets_Sent:     new_counter_vec("bridge_packets_sent_total", "Packets queued for classic clients.", "protocol", "command"),
+		Send_Drops:       new_counter_vec("bridge_send_queue_drops_total", "Packets dropped because a client's writer queue was full.", "protocol"),
+		Quirks_Drops:     new_counter_vec("bridge_quirks_drops_total", "Packets dropped because they could not be translated to a client's dialect.", "protocol", "dialect", "command"),
+		Rate_Limit_Hits:  new_counter_vec("bridge_rate_limit_hits_total", "Packets that exceeded the rate limit.", "protocol"),
+		IP_Limit_Hits:    new_counter_vec("bridge_ip_limit_rejections_total", "Connections refused because their source IP had too many connections."),
+
+		Slow_Consumer_Evictions: new_counter_vec("bridge_slow_consumer_evictions_total", "Clients disconnected because they could not keep up with their writer queue.", "protocol"),
+		Timeouts:                new_counter_vec("bridge_timeouts_total", "Clients disconnected because they went idle or didn't finish their handshake in time.", "reason"),
+
+		Compression_Input:  new_counter_vec("bridge_compression_input_bytes_total", "Bytes of the frames queued for compression with permessage-deflate, before compression.", "protocol"),
+		Compression_Output: new_counter_vec("bridge_compression_output_bytes_total", "Bytes of the frames queued for compression with permessage-deflate, after compression.", "protocol"),
+	}
+}
+
+// Write_Metrics writes every bridge metric in the Prometheus text exposition format.
+func (s *Server) Write_Metrics(w io.Writer) {
+
+	// Connected classic clients per protocol and dialect
+	clients := make(map[string]*gauge_sample)
+	stalled, msgpack := 0, 0
+	s.classicclientsmu.RLock()
+	for client := range s.ClassicClients {
+		if client.Is_Stalled() {
+			stalled++
+		}
+		if client.Uses_MessagePack() {
+			msgpack++
+		}
+		labels := []string{client_protocol(client), Dialect_Name(client.GetDialect())}
+		key := strings.Join(labels, "\xff")
+		if _, ok := clients[key]; !ok {
+			clients[key] = &gauge_sample{labels: labels}
+		}
+		clients[key].value++
+	}
+	s.classicclientsmu.RUnlock()
+	client_samples := make([]gauge_sample, 0, len(clients))
+	for _, key := range slices.Sorted(maps.Keys(clients)) {
+		client_samples = append(client_samples, *clients[key])
+	}
+	write_gauge(w, "bridge_clients", "Connected classic clients.", []string{"protocol", "dialect"}, client_samples...)
+	write_gauge(w, "bridge_stalled_clients", "Classic clients whose writer queue is full.", nil, gauge_sample{value: float64(stalled)})
+	write_gauge(w, "bridge_msgpack_clients", "Classic clients using MessagePack framing.", nil, gauge_sample{value: float64(msgpack)})
+
+	// Rooms and global variables
+	rooms := s.Get_Rooms()
+	gvars := 0
+	for _, room := range rooms {
+		if gv := s.GetRoomGlobalVars(room); gv != nil {
+			gv.Range(func(_, _ any) bool {
+				gvars++
+				return true
+			})
+		}
+	}
+	write_gauge(w, "bridge_rooms", "Open rooms.", nil, gauge_sample{value: float64(len(rooms))})
+	write_gauge(w, "bridge_gvars", "Global variables stored across all open rooms.", nil, gauge_sample{value: float64(gvars)})
+
+	// Source IPs
+	ips, busiest := s.ip_limits.stats()
+	write_gauge(w, "bridge_unique_ips", "Distinct source IPs of connected classic clients.", nil, gauge_sample{value: float64(ips)})
+	write_gauge(w, "bridge_ip_connections_max", "Highest number of classic connections from a single source IP.", nil, gauge_sample{value: float64(busiest)})
+
+	// Duplex registries
+	discoveryCount, bridgeCount := s.GetRegistryCounts()
+	s.deltaclientsmu.RLock()
+	resolverCount := len(s.DeltaResolverCache)
+	s.deltaclientsmu.RUnlock()
+	write_gauge(w, "bridge_registry_peers", "Peers held in each duplex registry.", []string{"registry"},
+		gauge_sample{labels: []string{"bridge"}, value: float64(bridgeCount)},
+		gauge_sample{labels: []string{"discovery"}, value: float64(discoveryCount)},
+		gauge_sample{labels: []string{"resolver"}, value: float64(resolverCount)},
+	)
+
+	// Counters
+	s.Metrics.Packets_Received.write(w)
+	s.Metrics.Packets_Sent.write(w)
+	s.Metrics.Send_Drops.write(w)
+	s.Metrics.Quirks_Drops.write(w)
+	s.Metrics.Rate_Limit_Hits.write(w)
+	s.Metrics.IP_Limit_Hits.write(w)
+	s.Metrics.Slow_Consumer_Evictions.write(w)
+	s.Metrics.Timeouts.write(w)
+	s.Metrics.Compression_Input.write(w)
+	s.Metrics.Compression_Output.write(w)
+
+	// Compression ratios, as compressed size over original size
+	input, output := s.Metrics.Compression_Input.values(), s.Metrics.Compression_Output.values()
+	var ratios []gauge_sample
+	for _, key := range slices.Sorted(maps.Keys(input)) {
+		if in := input[key]; in.value > 0 {
+			ratios = append(ratios, gauge_sample{labels: in.labels, value: float64(output[key].value) / float64(in.value)})
+		}
+	}
+	write_gauge(w, "bridge_compression_ratio", "Size of compressed frames relative to their original size.", []string{"protocol"}, ratios...)
+}
+
+func (s *Server) metrics_handler(c fiber.Ctx) error {
+	var sb strings.Builder
+	s.Write_Metrics(&sb)
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	return c.SendString(sb.String())
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Scrapes /metrics after some traffic, so that changes to the exposition format are caught.
+func TestMetricsExposition(t *testing.T) {
+	b := Start_Test_Bridge(t, New_Test_Config())
+
+	cl4 := b.Connect("cl4")
+	cl4.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	b.Settle()
+	cl4.Send(`{"cmd":"gvar","name":"score","val":"1"}`)
+	cl4.Send(`{"cmd":"made_up"}`)
+	b.Settle()
+	cl2 := b.Connect("cl2")
+	cl2.Send("<%sn>\ncl2")
+	b.Settle()
+
+	res, err := http.Get("http://" + b.Address + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exposition := string(data)
+	if content_type := res.Header.Get("Content-Type"); !strings.HasPrefix(content_type, "text/plain; version=0.0.4") {
+		t.Errorf("metrics served as %q", content_type)
+	}
+
+	// Every sample belongs to a family declared with a type, and has a numeric value
+	types := make(map[string]string)
+	for line := range strings.SplitSeq(strings.TrimSpace(exposition), "\n") {
+		if declaration, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, kind, _ := strings.Cut(declaration, " ")
+			types[name] = kind
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		series, value, found := strings.Cut(line, " ")
+		name, _, _ := strings.Cut(series, "{")
+		if !found || types[name] == "" {
+			t.Errorf("sample without a declared type: %q", line)
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			t.Errorf("sample with an invalid value: %q", line)
+		}
+	}
+
+	for name, kind := range map[string]string{
+		"bridge_clients":                "gauge",
+		"bridge_rooms":                  "gauge",
+		"bridge_gvars":                  "gauge",
+		"bridge_registry_peers":         "gauge",
+		"bridge_packets_received_total": "counter",
+		"bridge_packets_sent_total":     "counter",
+		"bridge_send_queue_drops_total": "counter",
+		"bridge_quirks_drops_total":     "counter",
+		"bridge_rate_limit_hits_total":  "counter",
+	} {
+		if types[name] != kind {
+			t.Errorf("%s has type %q, expected %s", name, types[name], kind)
+		}
+	}
+
+	for _, sample := range []string{
+		`bridge_clients{protocol="cl4",dialect="cl4-0.2.0"} 1`,
+		`bridge_clients{protocol="cl2",dialect="cl2-early"} 1`,
+		`bridge_rooms 1`,
+		`bridge_gvars 1`,
+		`bridge_packets_received_total{protocol="cl4",command="gvar"} 1`,
+		`bridge_packets_received_total{protocol="cl4",command="unknown"} 1`,
+		`bridge_packets_sent_total{protocol="cl4",command="gvar"} 1`,
+	} {
+		if !strings.Contains(exposition, "\n"+sample+"\n") {
+			t.Errorf("missing %s in:\n%s", sample, exposition)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+
+	"github.com/goccy/go-json"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// CL4 clients may send their packets as MessagePack maps in binary frames, rather than as JSON in text frames.
+// A client opts in by sending a binary frame, and from then on, the bridge only sends binary frames to it.
+// Either way, packets carry the same fields, so the protocol handlers only ever see JSON.
+
+// Converts a MessagePack frame into the equivalent JSON.
+func msgpack_to_json(data []byte) ([]byte, error) {
+	value, rest, err := msgp.ReadIntfBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after MessagePack value")
+	}
+	return json.Marshal(value)
+}
+
+// Converts JSON into the equivalent MessagePack. Whole numbers are encoded as integers.
+func json_to_msgpack(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return msgp.AppendIntf(nil, msgpack_numbers(value))
+}
+
+func msgpack_numbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = msgpack_numbers(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = msgpack_numbers(item)
+		}
+	}
+	return value
+}
+
+// Marshals a translated packet for a client, using the framing that the client negotiated.
+func encode_frame(p any, binary bool) (frame, error) {
+	data, err := json.Marshal(p)
+	if err != nil || !binary {
+		return frame{data: data}, err
+	}
+	data, err = json_to_msgpack(data)
+	return frame{data: data, binary: true}, err
+}
+
+// Uses_MessagePack reports whether the client has switched to MessagePack framing.
+func (c *BridgeClient) Uses_MessagePack() bool {
+	return c.msgpack.Load()
+}
+
+// Reads a binary frame from a client, switching it to MessagePack framing. Returns false if the frame
+// isn't a valid MessagePack packet, or if the client speaks a protocol other than CL4.
+func (c *BridgeClient) read_msgpack(data []byte) bool {
+	s := c.Server
+	packet, err := msgpack_to_json(data)
+	if err != nil {
+		s.Log(Subsystem_CL4).Debug().Msgf("%s Invalid MessagePack frame: %v", c.GiveName(), err)
+		return false
+	}
+	s.recorder.Record_Binary(c, Capture_Rx, packet)
+
+	protocol := c.GetProtocol()
+	if protocol != nil {
+		if protocol.Name() != Protocol_CL4 {
+			return false
+		}
+		if !c.msgpack.Swap(true) {
+			s.Log(Subsystem_CL4).Debug().Msgf("%s Switched to MessagePack framing", c.GiveName())
+		}
+		go protocol.Reader(c, packet)
+		return true
+	}
+
+	// Binary frames can only be CL4, so detection is skipped
+	i := slices.IndexFunc(s.protocols, func(entry Protocol_Entry) bool { return entry.Name == Protocol_CL4 })
+	if i < 0 {
+		return false
+	}
+	protocol = s.protocols[i].New(s)
+	c.SetProtocol(protocol)
+	c.msgpack.Store(true)
+	if !protocol.Reader(c, packet) {
+		c.SetProtocol(nil)
+		c.msgpack.Store(false)
+		return false
+	}
+	s.Log(Subsystem_CL4).Debug().Msgf("%s Switched to MessagePack framing", c.GiveName())
+	return true
+}
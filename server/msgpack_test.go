@@ -0,0 +1,76 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestMessagePackConversion(t *testing.T) {
+	data, err := json_to_msgpack([]byte(`{"cmd":"gmsg","val":{"n":3,"f":0.5,"list":[1,"two",null,true]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whole numbers are sent as integers
+	value, _, err := msgp.ReadIntfBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val := value.(map[string]any)["val"].(map[string]any)
+	if _, ok := val["n"].(int64); !ok {
+		t.Errorf("whole number was encoded as %T", val["n"])
+	}
+
+	back, err := msgpack_to_json(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"cmd":"gmsg","val":{"f":0.5,"list":[1,"two",null,true],"n":3}}`; string(back) != want {
+		t.Errorf("round trip returned %s, expected %s", back, want)
+	}
+
+	if _, err := msgpack_to_json(append(data, 0xc0)); err == nil {
+		t.Error("trailing data was accepted")
+	}
+}
+
+func TestMessagePackFraming(t *testing.T) {
+	b := Start_Test_Bridge(t, New_Test_Config())
+	tr := b.Transcript()
+	binary := b.Connect("binary")
+	text := b.Connect("text")
+	scratch := b.Connect("scratch")
+
+	tr.Step_MessagePack(binary, `{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"},"listener":"hello"}`)
+	tr.Step(text, `{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	tr.Step(scratch, `{"method":"handshake","project_id":"default","user":"scratch"}`)
+	tr.Step_MessagePack(binary, `{"cmd":"gvar","name":"☁ score","val":10}`)
+	tr.Step(text, `{"cmd":"gmsg","val":{"x":1}}`)
+
+	transcript := tr.String()
+	for _, want := range []string{
+		`<<< binary: (msgpack) {"cmd":"statuscode","code":"I:100 | OK","code_id":100,"listener":"hello"}`,
+		`<<< text: {"cmd":"gvar","name":"☁ score","val":10`,
+		`<<< scratch: {"method":"set","name":"☁ score","value":10}`,
+		`<<< binary: (msgpack) {"cmd":"gmsg","origin":{"id":"<id:text>","uuid":"<uuid:text>"},"rooms":"default","val":{"x":1}}`,
+	} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("transcript is missing %s:\n%s", want, transcript)
+		}
+	}
+	if strings.Contains(transcript, "<<< text: (msgpack)") || strings.Contains(transcript, "<<< scratch: (msgpack)") {
+		t.Errorf("JSON clients received MessagePack frames:\n%s", transcript)
+	}
+
+	// Only CL4 clients may send binary frames, and only valid MessagePack
+	scratch.Send_MessagePack(`{"method":"set","name":"☁ score","value":3}`)
+	b.Settle()
+	if frames := scratch.Drain(); len(frames) == 0 || !strings.Contains(frames[0], "Binary frames must contain CL4 packets") {
+		t.Errorf("Scratch client sending a binary frame wasn't refused: %v", frames)
+	}
+	if b.Is_Client_In_Room(&BridgeClient{UUID: scratch.UUID}, DEFAULT_ROOM) {
+		t.Error("Scratch client sending a binary frame is still connected")
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"strings"
+)
+
+// Reports whether a pattern from an origin allowlist matches an origin. Patterns are either an exact origin
+// (https://turbowarp.org), an origin with a wildcard subdomain (https://*.example.com), or * for any origin.
+func match_origin(pattern string, origin string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+
+	prefix, suffix, found := strings.Cut(pattern, "*")
+	if !found || len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+
+	// The wildcard only stands in for subdomains
+	return !strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:")
+}
+
+func origin_in(allowlist []string, origin string) bool {
+	for _, pattern := range allowlist {
+		if match_origin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Origin_Allowed reports whether a client with a given Origin header may join a room. Clients must pass both
+// the global allowlist and the allowlist of the room (or Scratch project ID), if either is configured.
+// Clients without an origin pass every allowlist, unless Require_Origin is set.
+func (s *Server) Origin_Allowed(origin string, room RoomKey) bool {
+	config := s.Config()
+	lists := [][]string{config.Allowed_Origins}
+	if room_list, ok := config.Room_Allowed_Origins[string(room)]; ok {
+		lists = append(lists, room_list)
+	}
+
+	for _, allowlist := range lists {
+		if len(allowlist) == 0 {
+			continue
+		}
+
+		// Non-browser clients usually don't send an origin
+		if origin == "" {
+			if config.Require_Origin {
+				return false
+			}
+			continue
+		}
+
+		if !origin_in(allowlist, origin) {
+			return false
+		}
+	}
+	return true
+}
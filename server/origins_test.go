@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	cases := []struct {
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{"*", "https://anything.example", true},
+		{"https://turbowarp.org", "https://turbowarp.org", true},
+		{"https://turbowarp.org/", "https://TurboWarp.org", true},
+		{"https://turbowarp.org", "http://turbowarp.org", false},
+		{"https://*.example.com", "https://a.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evil.com/.example.com", false},
+		{"https://*.example.com", "https://evil.com:.example.com", false},
+	}
+	for _, c := range cases {
+		if got := match_origin(c.pattern, c.origin); got != c.want {
+			t.Errorf("match_origin(%q, %q) = %v, expected %v", c.pattern, c.origin, got, c.want)
+		}
+	}
+}
+
+func dial_with_origin(t *testing.T, b *Test_Bridge, origin string, frames ...string) int {
+	t.Helper()
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	_, code := b.Exchange("/", header, frames...)
+	return code
+}
+
+func TestOriginAllowlists(t *testing.T) {
+	config := New_Test_Config()
+	config.Allowed_Origins = []string{"https://*.example.com", "https://turbowarp.org"}
+	config.Room_Allowed_Origins = map[string][]string{"1234": {"https://turbowarp.org"}}
+	b := Start_Test_Bridge(t, config)
+
+	handshake := `{"method":"handshake","project_id":"1234","user":"scratch"}`
+
+	if code := dial_with_origin(t, b, "https://evil.com"); code != int(Security_Error.Code) {
+		t.Errorf("disallowed origin closed with %d, expected %d", code, Security_Error.Code)
+	}
+	if code := dial_with_origin(t, b, "https://games.example.com", handshake); code != int(Unavailable_Status.Code) {
+		t.Errorf("disallowed project closed with %d, expected %d", code, Unavailable_Status.Code)
+	}
+	if code := dial_with_origin(t, b, "https://turbowarp.org", handshake); code != 0 {
+		t.Errorf("allowed project closed with %d", code)
+	}
+	if code := dial_with_origin(t, b, "", handshake); code != 0 {
+		t.Errorf("client without an origin closed with %d", code)
+	}
+
+	required := *b.Config()
+	required.Require_Origin = true
+	b.config.Store(&required)
+	if code := dial_with_origin(t, b, ""); code != int(Security_Error.Code) {
+		t.Errorf("client without an origin closed with %d, expected %d", code, Security_Error.Code)
+	}
+}
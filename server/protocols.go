@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/contrib/v3/websocket"
+)
+
+// Names of the built-in classic protocols, as used by Config.Disabled_Protocols.
+const (
+	Protocol_CL4     = "cl4" // Also handles CL3 dialects
+	Protocol_Scratch = "scratch"
+	Protocol_CL2     = "cl2"
+	Protocol_Delta   = "delta"
+)
+
+// Protocol_Entry describes a classic protocol that can be detected on the WebSocket gateway.
+type Protocol_Entry struct {
+
+	// Unique name of the protocol.
+	Name string
+
+	// Detection priority. Protocols with lower values are tried first on a client's first packet.
+	Priority int
+
+	// Creates a new handler for a single client.
+	New func(*Server) Protocol
+}
+
+var (
+	protocol_registry_mux sync.RWMutex
+	protocol_registry     []Protocol_Entry
+)
+
+// Register_Protocol makes a protocol available for detection. It is meant to be called from init functions,
+// and panics if a protocol with the same name was already registered.
+func Register_Protocol(name string, priority int, constructor func(*Server) Protocol) {
+	protocol_registry_mux.Lock()
+	defer protocol_registry_mux.Unlock()
+
+	if name == "" || constructor == nil {
+		panic("protocol name and constructor required")
+	}
+
+	for _, entry := range protocol_registry {
+		if entry.Name == name {
+			panic(fmt.Sprintf("protocol %q already registered", name))
+		}
+	}
+
+	protocol_registry = append(protocol_registry, Protocol_Entry{
+		Name:     name,
+		Priority: priority,
+		New:      constructor,
+	})
+}
+
+// Registered_Protocols returns every registered protocol, ordered by detection priority.
+func Registered_Protocols() []Protocol_Entry {
+	protocol_registry_mux.RLock()
+	entries := slices.Clone(protocol_registry)
+	protocol_registry_mux.RUnlock()
+
+	slices.SortStableFunc(entries, func(a, b Protocol_Entry) int {
+		return a.Priority - b.Priority
+	})
+	return entries
+}
+
+// Resolves the protocols that the server will attempt to detect, honoring Config.Disabled_Protocols.
+func enabled_protocols(config *Config) []Protocol_Entry {
+	registered := Registered_Protocols()
+
+	for _, name := range config.Disabled_Protocols {
+		if !slices.ContainsFunc(registered, func(entry Protocol_Entry) bool { return entry.Name == name }) {
+			panic(fmt.Sprintf("cannot disable unknown protocol %q", name))
+		}
+	}
+
+	return slices.DeleteFunc(registered, func(entry Protocol_Entry) bool {
+		return slices.Contains(config.Disabled_Protocols, entry.Name)
+	})
+}
+
+// Query parameter with which clients may declare their protocol. See Parse_Declaration.
+const Protocol_Query_Param = "protocol"
+
+// Protocol that each dialect belongs to.
+var dialect_protocols = map[uint]string{
+	Dialect_CL2_Early: Protocol_CL2,
+	Dialect_CL2_Late:  Protocol_CL2,
+	Dialect_CL3_0_1_5: Protocol_CL4,
+	Dialect_CL3_0_1_7: Protocol_CL4,
+	Dialect_CL4_0_1_8: Protocol_CL4,
+	Dialect_CL4_0_1_9: Protocol_CL4,
+	Dialect_CL4_0_2_0: Protocol_CL4,
+}
+
+// Declaration is the protocol, and optionally the dialect, that a client declared when it connected.
+// Declared clients skip detection entirely, and their declared dialect is never changed.
+type Declaration struct {
+	Protocol string
+	Dialect  uint // Dialect_Undefined if only the protocol was declared
+}
+
+// Parse_Declaration reads a declared protocol, either on its own (e.g. "scratch" or "cl4"), or followed by a
+// dialect (e.g. "cl4-0.2.0", "cl4/0.1.9" or "cl2-early"). CL3 is handled by the CL4 protocol, so "cl3" and "cl4"
+// may be used interchangeably.
+func Parse_Declaration(value string) (Declaration, bool) {
+	value = strings.ToLower(strings.Trim(value, "/ "))
+	name, version, _ := strings.Cut(strings.ReplaceAll(value, "/", "-"), "-")
+	if name == "cl3" {
+		name = Protocol_CL4
+	}
+
+	if version == "" {
+		registered := slices.ContainsFunc(Registered_Protocols(), func(entry Protocol_Entry) bool { return entry.Name == name })
+		return Declaration{Protocol: name}, registered
+	}
+
+	for dialect, protocol := range dialect_protocols {
+		if _, dialect_version, _ := strings.Cut(Dialect_Name(dialect), "-"); protocol == name && dialect_version == version {
+			return Declaration{Protocol: name, Dialect: dialect}, true
+		}
+	}
+	return Declaration{}, false
+}
+
+// Returns the WebSocket subprotocols that clients may declare: the name of every enabled protocol, and of
+// every dialect of those protocols.
+func (s *Server) subprotocols() []string {
+	var subprotocols []string
+	for _, entry := range s.protocols {
+		subprotocols = append(subprotocols, entry.Name)
+	}
+	for _, dialect := range slices.Sorted(maps.Keys(dialect_protocols)) {
+		if protocol := dialect_protocols[dialect]; slices.Contains(subprotocols, protocol) {
+			subprotocols = append(subprotocols, Dialect_Name(dialect))
+		}
+	}
+	return subprotocols
+}
+
+// Returns the protocol that a client declared with a WebSocket subprotocol, the path of its URL
+// (e.g. /cl4/0.2.0), or a query parameter, in that order. Returns nil if it didn't declare one.
+func (s *Server) declared_protocol(c *websocket.Conn) (*Declaration, error) {
+	value := c.Subprotocol()
+	if value == "" && c.Params("protocol") != "" {
+		value = c.Params("protocol") + "/" + c.Params("version")
+	}
+	if value == "" {
+		value = c.Query(Protocol_Query_Param)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	declaration, ok := Parse_Declaration(value)
+	if !ok {
+		return nil, fmt.Errorf("unknown protocol %q", value)
+	}
+	if !slices.ContainsFunc(s.protocols, func(entry Protocol_Entry) bool { return entry.Name == declaration.Protocol }) {
+		return nil, fmt.Errorf("protocol %q is disabled", declaration.Protocol)
+	}
+	return &declaration, nil
+}
+
+// Assigns a declared protocol and dialect to a client.
+func (s *Server) pin_protocol(c *BridgeClient, declaration *Declaration) {
+	i := slices.IndexFunc(s.protocols, func(entry Protocol_Entry) bool { return entry.Name == declaration.Protocol })
+	c.SetProtocol(s.protocols[i].New(s))
+	if declaration.Dialect != Dialect_Undefined {
+		c.PinDialect(declaration.Dialect)
+	}
+	s.Logger.Debug().Str("protocol", declaration.Protocol).Str("dialect", Dialect_Name(declaration.Dialect)).Msgf("%s 📌 Declared protocol", c.GiveName())
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestParseDeclaration(t *testing.T) {
+	for value, want := range map[string]Declaration{
+		"scratch":    {Protocol: Protocol_Scratch},
+		"cl4":        {Protocol: Protocol_CL4},
+		"cl3":        {Protocol: Protocol_CL4},
+		"cl4-0.2.0":  {Protocol: Protocol_CL4, Dialect: Dialect_CL4_0_2_0},
+		"/cl4/0.1.9": {Protocol: Protocol_CL4, Dialect: Dialect_CL4_0_1_9},
+		"CL3/0.1.5":  {Protocol: Protocol_CL4, Dialect: Dialect_CL3_0_1_5},
+		"cl2-early":  {Protocol: Protocol_CL2, Dialect: Dialect_CL2_Early},
+	} {
+		if got, ok := Parse_Declaration(value); !ok || got != want {
+			t.Errorf("Parse_Declaration(%q) = %+v, %v; expected %+v", value, got, ok, want)
+		}
+	}
+
+	for _, value := range []string{"", "cl5", "cl4-9.9.9", "scratch-0.2.0", "cl2-0.2.0"} {
+		if got, ok := Parse_Declaration(value); ok {
+			t.Errorf("Parse_Declaration(%q) = %+v, expected it to be refused", value, got)
+		}
+	}
+}
+
+func TestDeclaredProtocols(t *testing.T) {
+	config := New_Test_Config()
+	config.Disabled_Protocols = []string{Protocol_CL2}
+	b := Start_Test_Bridge(t, config)
+
+	// Dialects are offered in order, and only for the protocols that are enabled
+	dialects := []string{"cl3-0.1.5", "cl3-0.1.7", "cl4-0.1.8", "cl4-0.1.9", "cl4-0.2.0"}
+	if offered := b.subprotocols(); len(offered) < len(dialects) || !slices.Equal(offered[len(offered)-len(dialects):], dialects) {
+		t.Errorf("offered subprotocols %v, expected them to end with %v", offered, dialects)
+	}
+
+	// Returns the protocol and dialect of a client as seen by the bridge
+	state := func(c *Test_Client) (string, uint) {
+		b.Settle()
+		b.classicclientsmu.RLock()
+		defer b.classicclientsmu.RUnlock()
+		for client := range b.ClassicClients {
+			if client.UUID == c.UUID {
+				return client_protocol(client), client.GetDialect()
+			}
+		}
+		t.Fatalf("%s isn't connected", c.Name)
+		return "", 0
+	}
+
+	// Without a listener, a gmsg would otherwise be taken for CL3 0.1.5
+	for name, c := range map[string]*Test_Client{
+		"path":        b.Connect_To("path", "/cl4/0.1.9", nil),
+		"subprotocol": b.Connect_To("subprotocol", "/", http.Header{"Sec-WebSocket-Protocol": {"cl4-0.1.9"}}),
+		"query":       b.Connect_To("query", "/?protocol=cl4/0.1.9", nil),
+	} {
+		c.Send(`{"cmd":"gmsg","val":"hello"}`)
+		c.Send(`{"cmd":"handshake"}`)
+		if protocol, dialect := state(c); protocol != Protocol_CL4 || dialect != Dialect_CL4_0_1_9 {
+			t.Errorf("client declaring its dialect in the %s was detected as %s %s", name, protocol, Dialect_Name(dialect))
+		}
+	}
+
+	// A declared protocol is used even if a packet looks like another one
+	scratch := b.Connect_To("scratch", "/scratch", nil)
+	scratch.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	if protocol, _ := state(scratch); protocol != Protocol_Scratch {
+		t.Errorf("client declaring Scratch was detected as %s", protocol)
+	}
+
+	// Only the protocol may be declared, in which case the dialect is still detected
+	cl4 := b.Connect_To("cl4", "/cl4", nil)
+	cl4.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	if protocol, dialect := state(cl4); protocol != Protocol_CL4 || dialect != Dialect_CL4_0_2_0 {
+		t.Errorf("client declaring CL4 was detected as %s %s", protocol, Dialect_Name(dialect))
+	}
+
+	// Unknown and disabled protocols are refused
+	for _, path := range []string{"/cl5", "/cl2", "/cl4/9.9.9", "/?protocol=nope"} {
+		if _, code := b.Exchange(path, nil); code != int(Protocol_Detection_Failure.Code) {
+			t.Errorf("declaring %s closed with %d, expected %d", path, code, Protocol_Detection_Failure.Code)
+		}
+	}
+}
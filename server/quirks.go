@@ -15,11 +15,15 @@ func (s *Scratch_Handler) Apply_Quirks(c *BridgeClient, p any) any {
 		// Marshal the payload value to protect against type crashing
 		switch packet.Value.(type) {
 		case map[string]interface{}:
-			if b, err := json.Marshal(packet.Value); err == nil {
-				packet.Value = string(b)
+
+			// Copy the packet so the broadcasted packet isn't mutated for other clients
+			clone := *packet
+			if b, err := json.Marshal(clone.Value); err == nil {
+				clone.Value = string(b)
 			} else {
 				panic(err)
 			}
+			return &clone
 		}
 		return packet
 
@@ -28,12 +32,24 @@ func (s *Scratch_Handler) Apply_Quirks(c *BridgeClient, p any) any {
 
 	case *Common_Packet:
 		// Cross-protocol translation: CL4/CL3 -> Scratch
-		if packet.Command == "gvar" {
+		switch packet.Command {
+		case "gvar":
 			return &ScratchPacket{
 				Method: "set",
 				Name:   packet.Name,
 				Value:  packet.Value,
 			}
+		case "gvar_rename":
+			return &ScratchPacket{
+				Method:  "rename",
+				Name:    packet.Name,
+				NewName: packet.Value,
+			}
+		case "gvar_delete":
+			return &ScratchPacket{
+				Method: "delete",
+				Name:   packet.Name,
+			}
 		}
 		return nil // Silently drop ulist, gmsg, statuscodes, etc.
 
@@ -112,6 +128,16 @@ func (s *CL2) Apply_Quirks(c *BridgeClient, p any) any {
 				return nil
 			}
 
+		case "gvar_rename":
+			// CL2 has no concept of renaming, so the variable simply appears under its new name
+			value, ok := s.Renamed_Value(original)
+			if c.GetDialect() == Dialect_CL2_Late && ok {
+				reply.Type = "sf"
+				reply.Data = CL2Packet_TxData{Type: "vm", Mode: "g", Var: original.Value, Data: value}
+			} else {
+				return nil
+			}
+
 		case "pvar":
 			if c.GetDialect() == Dialect_CL2_Late {
 				reply.Type = "sf"
@@ -179,10 +205,10 @@ func (s *CL4_or_CL3) Apply_Quirks(c *BridgeClient, p any) any {
 				Command: "gvar",
 				Name:    original_packet.Name,
 				Value:   original_packet.Value,
-				Origin:  s.UserObject(c),
+				Origin:  original_packet.Origin, // The Scratch client that set it, not the recipient
 			}
 		} else {
-			return nil // Drop unmappable Scratch commands (like rename/delete)
+			return nil // Scratch renames and deletes are broadcast as gvar_rename and gvar_delete instead
 		}
 
 	default:
@@ -200,8 +226,25 @@ func (s *CL4_or_CL3) Apply_Quirks(c *BridgeClient, p any) any {
 		}
 	}
 
+	// The gvar_rename and gvar_delete extensions are only understood by 0.2.0 clients.
+	// Older dialects see a renamed variable appear under its new name, and cannot represent deletions.
+	if c.GetDialect() < Dialect_CL4_0_2_0 {
+		switch packet.Command {
+		case "gvar_rename":
+			value, ok := s.Renamed_Value(packet)
+			if !ok {
+				return nil
+			}
+			packet.Command = "gvar"
+			packet.Name = packet.Value
+			packet.Value = value
+		case "gvar_delete":
+			return nil
+		}
+	}
+
 	// Force_Set override to address known bugs with older CL clients
-	if s.Config.Force_Set && packet.Command == "ulist" && (packet.Mode == "add" || packet.Mode == "remove") {
+	if s.Config().Force_Set && packet.Command == "ulist" && (packet.Mode == "add" || packet.Mode == "remove") {
 		packet.Mode = "set"
 		packet.Value = s.Get_User_List(targetRoom)
 	}
@@ -343,7 +386,7 @@ func (d *CLDelta) Apply_Quirks(c *BridgeClient, p any) any {
 
 		switch packet.Command {
 		case "gmsg":
-			c.Peer.Write(&duplex.TxPacket{
+			d.write_peer(c, &duplex.TxPacket{
 				Packet: duplex.Packet{
 					Opcode: "G_MSG",
 					Origin: originStr,
@@ -352,7 +395,7 @@ func (d *CLDelta) Apply_Quirks(c *BridgeClient, p any) any {
 				Payload: packet.Value,
 			})
 		case "pmsg":
-			c.Peer.Write(&duplex.TxPacket{
+			d.write_peer(c, &duplex.TxPacket{
 				Packet: duplex.Packet{
 					Opcode: "P_MSG",
 					Origin: originStr,
@@ -361,7 +404,7 @@ func (d *CLDelta) Apply_Quirks(c *BridgeClient, p any) any {
 				Payload: packet.Value,
 			})
 		case "gvar":
-			c.Peer.Write(&duplex.TxPacket{
+			d.write_peer(c, &duplex.TxPacket{
 				Packet: duplex.Packet{
 					Opcode: "G_VAR",
 					Origin: originStr,
@@ -370,8 +413,27 @@ func (d *CLDelta) Apply_Quirks(c *BridgeClient, p any) any {
 				},
 				Payload: packet.Value,
 			})
+		case "gvar_rename":
+			d.write_peer(c, &duplex.TxPacket{
+				Packet: duplex.Packet{
+					Opcode: "G_VAR_RENAME",
+					Origin: originStr,
+					Id:     fmt.Sprintf("%v", packet.Name),
+					TTL:    1,
+				},
+				Payload: fmt.Sprintf("%v", packet.Value),
+			})
+		case "gvar_delete":
+			d.write_peer(c, &duplex.TxPacket{
+				Packet: duplex.Packet{
+					Opcode: "G_VAR_DELETE",
+					Origin: originStr,
+					Id:     fmt.Sprintf("%v", packet.Name),
+					TTL:    1,
+				},
+			})
 		case "pvar":
-			c.Peer.Write(&duplex.TxPacket{
+			d.write_peer(c, &duplex.TxPacket{
 				Packet: duplex.Packet{
 					Opcode: "P_VAR",
 					Origin: originStr,
@@ -442,7 +504,7 @@ func (d *CLDelta) Apply_Quirks(c *BridgeClient, p any) any {
 			}
 
 			if len(users) > 0 || packet.Mode == "set" {
-				c.Peer.Write(&duplex.TxPacket{
+				d.write_peer(c, &duplex.TxPacket{
 					Packet:  duplex.Packet{Opcode: "CLASSIC_ULIST", TTL: 1},
 					Payload: map[string]any{"mode": packet.Mode, "users": users, "rooms": rooms},
 				})
@@ -457,10 +519,14 @@ func (d *CLDelta) Apply_Quirks(c *BridgeClient, p any) any {
 	case *ScratchPacket:
 		switch packet.Method {
 		case "set", "create":
-			c.Peer.Write(&duplex.TxPacket{
+			origin := d.Server.Self
+			if originObj, ok := packet.Origin.(*CL4_UserObject); ok && originObj != nil && originObj.Username != nil && originObj.Username != "" {
+				origin = fmt.Sprintf("%v", originObj.Username)
+			}
+			d.write_peer(c, &duplex.TxPacket{
 				Packet: duplex.Packet{
 					Opcode: "G_VAR",
-					Origin: d.Server.Self,
+					Origin: origin,
 					Id:     fmt.Sprintf("%v", packet.Name),
 					TTL:    1,
 				},
@@ -471,3 +537,18 @@ func (d *CLDelta) Apply_Quirks(c *BridgeClient, p any) any {
 
 	return nil
 }
+
+// Renamed_Value looks up the value of a variable that a gvar_rename packet moved to its new name.
+func (s *Server) Renamed_Value(packet *Common_Packet) (any, bool) {
+	room := DEFAULT_ROOM
+	if r, ok := packet.Rooms.(RoomKey); ok {
+		room = r
+	} else if rStr, ok := packet.Rooms.(string); ok && rStr != "" {
+		room = RoomKey(rStr)
+	}
+	gv := s.GetRoomGlobalVars(room)
+	if gv == nil {
+		return nil, false
+	}
+	return gv.Load(packet.Value)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// Default cost of each command, in tokens. Commands that aren't listed cost 1.
+// Variable updates are cheap since projects stream them, while joining rooms is expensive.
+var Default_Rate_Limit_Costs = map[string]float64{
+	"gvar": 0.5, "pvar": 0.5, "set": 0.5, "create": 0.5, "l_g": 0.5, "l_p": 0.5,
+	"gmsg": 1, "pmsg": 1, "direct": 1, "gs": 1, "ps": 1,
+	"link": 5, "unlink": 5, "rename": 2, "delete": 2, "gvar_rename": 2, "gvar_delete": 2,
+}
+
+// Every frame is charged this many tokens as soon as it is received, before it is parsed, so that frames that turn
+// out to be invalid are limited as well. Valid packets are then charged the rest of the cost of their command.
+// This is the cost of the cheapest default commands, so that their total cost doesn't change. If Rate_Limit_Costs
+// makes a command cheaper, frames are charged the cost of that command instead.
+const Rate_Limit_Frame_Cost = 0.5
+
+// token_bucket holds up to burst tokens, and refills them at a constant rate.
+type token_bucket struct {
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+	burst  float64
+	rate   float64 // Tokens per second
+}
+
+func new_token_bucket(burst int, interval time.Duration) *token_bucket {
+	return &token_bucket{
+		tokens: float64(burst),
+		last:   time.Now(),
+		burst:  float64(burst),
+		rate:   float64(burst) / interval.Seconds(),
+	}
+}
+
+func (b *token_bucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Takes tokens from the bucket. If there aren't enough, nothing is taken and the time until there will be is returned.
+// Costs larger than the bucket take the whole bucket, so that they can still pass eventually.
+func (b *token_bucket) take(cost float64, now time.Time) (bool, time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.refill(now)
+	cost = min(cost, b.burst)
+	if b.tokens >= cost {
+		b.tokens -= cost
+		return true, 0
+	}
+	return false, time.Duration((cost - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Returns tokens taken by take, when a packet turns out to be dropped by another bucket.
+func (b *token_bucket) give(cost float64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.tokens = min(b.burst, b.tokens+cost)
+}
+
+// Changes the size and refill interval of the bucket, keeping the tokens it has left.
+func (b *token_bucket) resize(burst int, interval time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.refill(time.Now())
+	b.burst = float64(burst)
+	b.rate = float64(burst) / interval.Seconds()
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// rate_limiter tracks the buckets of every classic client, and optionally of every source IP.
+type rate_limiter struct {
+	config func() *Config
+	mux    sync.Mutex
+	ips    map[string]*token_bucket
+}
+
+func new_rate_limiter(config func() *Config) *rate_limiter {
+	return &rate_limiter{
+		config: config,
+		ips:    make(map[string]*token_bucket),
+	}
+}
+
+func (l *rate_limiter) cost(command string) float64 {
+	if cost, ok := l.config().Rate_Limit_Costs[command]; ok {
+		return cost
+	}
+	if cost, ok := Default_Rate_Limit_Costs[command]; ok {
+		return cost
+	}
+	return 1
+}
+
+// Returns how many tokens every frame is charged before it is parsed, see Rate_Limit_Frame_Cost.
+func (l *rate_limiter) frame_cost() float64 {
+	cost := Rate_Limit_Frame_Cost
+	for _, command_cost := range l.config().Rate_Limit_Costs {
+		cost = min(cost, command_cost)
+	}
+	return max(cost, 0)
+}
+
+func (l *rate_limiter) ip_bucket(ip string) *token_bucket {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	bucket, ok := l.ips[ip]
+	if !ok {
+		config := l.config()
+		bucket = new_token_bucket(config.Rate_Limit_IP_Burst, config.Rate_Limit_Interval)
+		l.ips[ip] = bucket
+	}
+	return bucket
+}
+
+// Applies a reloaded configuration to the buckets of every source IP.
+func (l *rate_limiter) reconfigure(config *Config) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if config.Rate_Limit_IP_Burst <= 0 {
+		clear(l.ips)
+		return
+	}
+	for _, bucket := range l.ips {
+		bucket.resize(config.Rate_Limit_IP_Burst, config.Rate_Limit_Interval)
+	}
+}
+
+// Forgets the bucket of an IP once it has no connections left.
+func (l *rate_limiter) forget(ip string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	delete(l.ips, ip)
+}
+
+// Charges tokens against the buckets of a client. Returns how long to wait before retrying if it must be dropped.
+func (l *rate_limiter) allow(c *BridgeClient, cost float64) (bool, time.Duration) {
+	now := time.Now()
+
+	ok, wait := c.bucket.take(cost, now)
+	if !ok || l.config().Rate_Limit_IP_Burst <= 0 {
+		return ok, wait
+	}
+
+	if ok, wait = l.ip_bucket(c.ip).take(cost, now); !ok {
+		c.bucket.give(cost)
+	}
+	return ok, wait
+}
+
+// Allow_Frame charges a frame that was just received against the rate limits of a client, see Rate_Limit_Frame_Cost.
+// It returns false if the frame must be dropped without being parsed. CL4 clients are still told that it was
+// throttled, with its listener.
+func (s *Server) Allow_Frame(c *BridgeClient, data []byte, binary bool) bool {
+	ok, reason := s.charge(c, s.rate_limits.frame_cost(), "")
+	if !ok && reason != "" {
+		s.refuse_frame(c, data, binary, reason)
+	}
+	return ok
+}
+
+// Allow_Packet charges the rest of the cost of a command, after Allow_Frame charged its frame. It returns false if the
+// packet must be dropped, in which case the client has already been disconnected if Kick_On_Rate_Limit is enabled.
+// The second return value is a human-readable reason that protocols may pass on to the client.
+func (s *Server) Allow_Packet(c *BridgeClient, command string) (bool, string) {
+	if !s.Config().Enable_Rate_Limit || c.bucket == nil {
+		return true, ""
+	}
+	cost := s.rate_limits.cost(command) - s.rate_limits.frame_cost()
+	if cost <= 0 {
+		return true, ""
+	}
+	return s.charge(c, cost, command)
+}
+
+func (s *Server) charge(c *BridgeClient, cost float64, command string) (bool, string) {
+	if !s.Config().Enable_Rate_Limit || c.bucket == nil {
+		return true, ""
+	}
+
+	ok, wait := s.rate_limits.allow(c, cost)
+	if ok {
+		return true, ""
+	}
+
+	s.Metrics.Rate_Limit_Hits.Inc(client_protocol(c))
+
+	if s.Config().Kick_On_Rate_Limit {
+		s.Logger.Error().Msgf("%s ⚠️  Aborting connection to client: Exceeded ratelimit.", c.GiveName())
+		s.safeSend(c, []byte("Your client has exceeded the ratelimit allowed by the server. Please reduce the messages that you send."))
+		s.Evict_Client(c, Ratelimit_Exceeded)
+		return false, ""
+	}
+
+	s.Logger.Warn().Str("command", command).Msgf("%s ⚠️  Client exceeding rate limit...", c.GiveName())
+	return false, fmt.Sprintf("Rate limit exceeded. Try again in %v.", wait.Round(time.Millisecond))
+}
+
+// Tells a CL4 client that a frame was throttled. Nothing but the listener of the frame is decoded.
+func (s *Server) refuse_frame(c *BridgeClient, data []byte, binary bool, reason string) {
+	if client_protocol(c) != Protocol_CL4 {
+		return
+	}
+	if binary {
+		var err error
+		if data, err = msgpack_to_json(data); err != nil {
+			return
+		}
+	}
+	var frame struct {
+		Listener any `json:"listener"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return
+	}
+	s.Unicast(c, &Common_Packet{
+		Command:  "statuscode",
+		Code:     StatusRefused.String(),
+		CodeID:   StatusRefused.Code,
+		Listener: frame.Listener,
+		Details:  reason,
+	})
+}
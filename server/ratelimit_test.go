@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := new_token_bucket(2, time.Second)
+	now := b.last
+
+	if ok, _ := b.take(1, now); !ok {
+		t.Fatal("first token refused")
+	}
+	if ok, _ := b.take(0.5, now); !ok {
+		t.Fatal("half token refused")
+	}
+	ok, wait := b.take(1, now)
+	if ok {
+		t.Fatal("took more tokens than the bucket holds")
+	}
+	if wait != 250*time.Millisecond {
+		t.Errorf("expected to wait 250ms, got %v", wait)
+	}
+	if ok, _ := b.take(1, now.Add(wait)); !ok {
+		t.Error("token refused after waiting")
+	}
+
+	// The bucket never holds more than its burst, no matter how long it sits idle
+	now = now.Add(time.Hour)
+	if ok, _ := b.take(2, now); !ok {
+		t.Error("full bucket refused its burst")
+	}
+	if ok, _ := b.take(0.1, now); ok {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+func TestRateLimitFeedback(t *testing.T) {
+	config := New_Test_Config()
+	config.Enable_Rate_Limit = true
+	config.Rate_Limit_Burst = 3
+	config.Rate_Limit_Interval = time.Minute
+	b := Start_Test_Bridge(t, config)
+
+	frames, code := b.Exchange("/", nil,
+		`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"},"listener":"a"}`,
+		`{"cmd":"gvar","name":"x","val":1,"listener":"b"}`,
+		`{"cmd":"gvar","name":"x","val":2,"listener":"c"}`,
+		`{"cmd":"gmsg","val":"last one","listener":"c2"}`,
+		`{"cmd":"gmsg","val":"too much","listener":"d"}`,
+		`{"cmd":"gvar","name":"x","val":3,"listener":"e"}`,
+	)
+	if code != 0 {
+		t.Fatalf("throttled client closed with %d", code)
+	}
+
+	transcript := strings.Join(frames, "\n")
+	for _, listener := range []string{"a", "b", "c", "c2"} {
+		if !strings.Contains(transcript, `"listener":"`+listener+`","code":"I:100 | OK"`) {
+			t.Errorf("packet %s was throttled:\n%s", listener, transcript)
+		}
+	}
+	for _, listener := range []string{"d", "e"} {
+		if !strings.Contains(transcript, `"listener":"`+listener+`","code":"E:108 | Refused"`) {
+			t.Errorf("packet %s was not refused:\n%s", listener, transcript)
+		}
+	}
+}
+
+// Commands can be configured to cost less than what every frame is charged before it is parsed.
+func TestRateLimitCheapCommands(t *testing.T) {
+	config := New_Test_Config()
+	config.Enable_Rate_Limit = true
+	config.Rate_Limit_Burst = 2
+	config.Rate_Limit_Interval = time.Hour
+	config.Rate_Limit_Costs = map[string]float64{"gvar": 0.125}
+	b := Start_Test_Bridge(t, config)
+
+	frames := []string{`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`}
+	for i := range 9 {
+		frames = append(frames, fmt.Sprintf(`{"cmd":"gvar","name":"x","val":%d,"listener":"%d"}`, i, i))
+	}
+	received, code := b.Exchange("/", nil, frames...)
+	if code != 0 {
+		t.Fatalf("throttled client closed with %d", code)
+	}
+
+	// The handshake costs 1, which leaves enough for 8 variable updates
+	transcript := strings.Join(received, "\n")
+	for i := range 8 {
+		if !strings.Contains(transcript, fmt.Sprintf(`"listener":"%d","code":"I:100 | OK"`, i)) {
+			t.Errorf("update %d was throttled:\n%s", i, transcript)
+		}
+	}
+	if !strings.Contains(transcript, `"listener":"8","code":"E:108 | Refused"`) {
+		t.Errorf("update 8 was not refused:\n%s", transcript)
+	}
+}
+
+// Frames are charged before they are parsed, so invalid ones can't be sent for free.
+func TestRateLimitInvalidFrames(t *testing.T) {
+	config := New_Test_Config()
+	config.Enable_Rate_Limit = true
+	config.Rate_Limit_Burst = 3
+	config.Rate_Limit_Interval = time.Minute
+	b := Start_Test_Bridge(t, config)
+
+	frames, code := b.Exchange("/", nil,
+		`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"},"listener":"a"}`,
+		`{"nope":1}`, `not json`, `{"cmd":""}`, `[]`,
+		`{"cmd":"gmsg","val":"too much","listener":"b"}`,
+	)
+	if code != 0 {
+		t.Fatalf("throttled client closed with %d", code)
+	}
+
+	transcript := strings.Join(frames, "\n")
+	if !strings.Contains(transcript, `"listener":"b","code":"E:108 | Refused"`) {
+		t.Errorf("packet after invalid frames was not refused:\n%s", transcript)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Fields of Config that are applied to a running server by Reload_Config. Changes to any other field
+// are reported, but only take effect after a restart.
+var Live_Config_Fields = []string{
+	"Enable_MOTD", "MOTD_Message",
+	"Maximum_Rooms", "Maximum_Room_Members", "Maximum_Clients", "Maximum_Clients_Per_IP", "IP_Limit_Exemptions",
+	"Force_Set",
+	"Enable_Rate_Limit", "Rate_Limit_Burst", "Rate_Limit_Interval", "Rate_Limit_Costs", "Rate_Limit_IP_Burst", "Kick_On_Rate_Limit",
+	"Slow_Consumer_Max_Drops", "Slow_Consumer_Timeout",
+	"Shutdown_Message", "Shutdown_Timeout",
+	"Scratch_Max_Value_Length", "Scratch_Max_Variables",
+	"Log_Level", "Subsystem_Log_Levels", "Log_Sample_Rate",
+}
+
+// Fields of Config whose values are never logged.
+var secret_config_fields = []string{"Admin_Token", "Auth_HMAC_Key"}
+
+// Config_Change is a field that differs between the running configuration and a reloaded one.
+type Config_Change struct {
+	Field string
+	Old   any
+	New   any
+
+	// Whether the change was applied. Other changes require a restart.
+	Live bool
+}
+
+func (c Config_Change) String() string {
+	if slices.Contains(secret_config_fields, c.Field) {
+		return c.Field + ": (redacted)"
+	}
+	return fmt.Sprintf("%s: %v → %v", c.Field, c.Old, c.New)
+}
+
+// Compares two configurations field by field.
+func diff_config(old *Config, new *Config) []Config_Change {
+	var changes []Config_Change
+	old_value, new_value := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := range old_value.NumField() {
+		field := old_value.Type().Field(i).Name
+		a, b := old_value.Field(i).Interface(), new_value.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		changes = append(changes, Config_Change{
+			Field: field,
+			Old:   a,
+			New:   b,
+			Live:  slices.Contains(Live_Config_Fields, field),
+		})
+	}
+	return changes
+}
+
+// Reload_Config applies the live fields of a new configuration (see Live_Config_Fields) to the running server,
+// and returns every field that changed. Nothing is applied if the new configuration is invalid.
+func (s *Server) Reload_Config(config *Config) ([]Config_Change, error) {
+	if config == nil {
+		return nil, errors.New("config required")
+	}
+	if config.Maximum_Rooms <= 0 {
+		return nil, errors.New("invalid maximum rooms")
+	}
+	if config.Maximum_Clients <= 0 {
+		return nil, errors.New("invalid maximum clients")
+	}
+	if config.Rate_Limit_Burst <= 0 || config.Rate_Limit_Interval <= 0 {
+		return nil, errors.New("invalid rate limit burst or interval")
+	}
+	if config.Address == "" {
+		config.Address = ":3000"
+	}
+
+	// Fields that only exist when embedding the bridge can't come from a config file
+	if config.Authenticator == nil {
+		config.Authenticator = s.Config().Authenticator
+	}
+	if config.Logger == nil {
+		config.Logger = s.Config().Logger
+	}
+	if err := validate_compression(config); err != nil {
+		return nil, err
+	}
+	if err := validate_timeouts(config); err != nil {
+		return nil, err
+	}
+	if err := validate_logging(config); err != nil {
+		return nil, err
+	}
+
+	s.config_mux.Lock()
+	current := s.Config()
+	changes := diff_config(current, config)
+	live := 0
+	for _, change := range changes {
+		if change.Live {
+			live++
+		}
+	}
+	if live > 0 {
+		if err := s.ip_limits.configure(config.Maximum_Clients_Per_IP, config.IP_Limit_Exemptions); err != nil {
+			s.config_mux.Unlock()
+			return nil, err
+		}
+
+		// Readers keep using the snapshot they loaded, so the live fields are copied into a new one
+		next := *current
+		updated, reloaded := reflect.ValueOf(&next).Elem(), reflect.ValueOf(config).Elem()
+		for _, field := range Live_Config_Fields {
+			updated.FieldByName(field).Set(reloaded.FieldByName(field))
+		}
+		s.config.Store(&next)
+		s.configure_loggers(&next)
+	}
+	s.config_mux.Unlock()
+
+	if live > 0 {
+		s.rate_limits.reconfigure(config)
+		s.classicclientsmu.RLock()
+		for client := range s.ClassicClients {
+			client.bucket.resize(config.Rate_Limit_Burst, config.Rate_Limit_Interval)
+		}
+		s.classicclientsmu.RUnlock()
+	}
+
+	if len(changes) == 0 {
+		s.Logger.Info().Msg("🔄 Reloaded configuration, nothing changed.")
+	}
+	for _, change := range changes {
+		if change.Live {
+			s.Logger.Info().Msgf("🔄 %s", change)
+		} else {
+			s.Logger.Warn().Msgf("⚠️  %s (requires a restart)", change)
+		}
+	}
+	return changes, nil
+}
+
+// Get_MOTD returns whether the MOTD is enabled, and the MOTD itself.
+func (s *Server) Get_MOTD() (bool, string) {
+	config := s.Config()
+	return config.Enable_MOTD, config.MOTD_Message
+}
+
+// Config returns the current configuration. Reloading replaces it rather than modifying it, so callers that read
+// several fields should keep the returned pointer to see them consistently.
+func (s *Server) Config() *Config {
+	return s.config.Load()
+}
+
+// Reload_Predisposed_Instances replaces the list of instances that the bridge connects to on startup, and
+// connects to any instances that were added. Instances that were removed stay connected until they disconnect.
+func (s *Server) Reload_Predisposed_Instances(instances []string) {
+	s.registry_mux.Lock()
+	previous := s.Predisposed_Instances
+	s.Predisposed_Instances = instances
+	s.registry_mux.Unlock()
+
+	for _, instance := range instances {
+		if slices.Contains(previous, instance) {
+			continue
+		}
+		s.Logger.Info().Msgf("🔄 Predisposed instance added: %s", instance)
+		if !s.Config().Standalone_Mode {
+			s.instance.Connect(instance)
+		}
+	}
+	for _, instance := range previous {
+		if !slices.Contains(instances, instance) {
+			s.Logger.Info().Msgf("🔄 Predisposed instance removed: %s", instance)
+		}
+	}
+}
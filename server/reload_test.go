@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	config := New_Test_Config()
+	b := Start_Test_Bridge(t, config)
+
+	a := b.Connect("a")
+	a.Send(`{"cmd":"handshake","listener":"hello"}`)
+	b.Settle()
+	a.Drain()
+
+	reloaded := *config
+	reloaded.MOTD_Message = "Reloaded!"
+	reloaded.Rate_Limit_Burst = 5
+	reloaded.Rate_Limit_Costs = map[string]float64{"gmsg": 2}
+	reloaded.Address = "127.0.0.1:1"
+	reloaded.Admin_Token = "secret"
+
+	changes, err := b.Reload_Config(&reloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := map[string]bool{}
+	for _, change := range changes {
+		live[change.Field] = change.Live
+	}
+	expected := map[string]bool{
+		"MOTD_Message": true, "Rate_Limit_Burst": true, "Rate_Limit_Costs": true,
+		"Address": false, "Admin_Token": false,
+	}
+	if len(live) != len(expected) {
+		t.Errorf("changes = %v, expected %v", changes, expected)
+	}
+	for field, want := range expected {
+		if got, ok := live[field]; !ok || got != want {
+			t.Errorf("%s: live = %v (reported %v), expected %v", field, got, ok, want)
+		}
+	}
+
+	if _, motd := b.Get_MOTD(); motd != "Reloaded!" {
+		t.Errorf("MOTD is %q after reloading", motd)
+	}
+	if b.Config().Address == reloaded.Address || b.Config().Admin_Token != "" {
+		t.Error("a field that requires a restart was applied")
+	}
+	if cost := b.rate_limits.cost("gmsg"); cost != 2 {
+		t.Errorf("gmsg costs %v after reloading, expected 2", cost)
+	}
+
+	// Buckets of connected clients are resized
+	b.classicclientsmu.RLock()
+	for client := range b.ClassicClients {
+		client.bucket.mux.Lock()
+		if client.bucket.burst != 5 {
+			t.Errorf("bucket holds %v tokens after reloading, expected 5", client.bucket.burst)
+		}
+		client.bucket.mux.Unlock()
+	}
+	b.classicclientsmu.RUnlock()
+
+	for _, change := range changes {
+		if change.Field == "Admin_Token" && change.String() != "Admin_Token: (redacted)" {
+			t.Errorf("secret logged as %q", change.String())
+		}
+	}
+
+	invalid := reloaded
+	invalid.Rate_Limit_Interval = 0
+	invalid.MOTD_Message = "Invalid"
+	if _, err := b.Reload_Config(&invalid); err == nil {
+		t.Error("invalid configuration was accepted")
+	}
+	if _, motd := b.Get_MOTD(); motd != "Reloaded!" {
+		t.Error("invalid configuration was partially applied")
+	}
+
+	// Fields that require a restart keep being reported until then
+	if changes, err := b.Reload_Config(&reloaded); err != nil || len(changes) != 2 {
+		t.Errorf("second reload reported %v, %v", changes, err)
+	}
+}
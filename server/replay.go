@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v3"
+)
+
+// How long a replay waits without any client receiving a frame before it sends the next one.
+const Replay_Quiet_Period = 100 * time.Millisecond
+
+// Replay_Mismatch is a frame that a client received during a replay that differs from the capture.
+// Either side is empty if one run received more frames than the other.
+type Replay_Mismatch struct {
+	Client   string // UUID of the client in the capture
+	Index    int    // Position among the frames sent to the client
+	Expected string
+	Actual   string
+}
+
+func (m Replay_Mismatch) String() string {
+	return fmt.Sprintf("client %s, frame %d:\n  - %s\n  + %s", m.Client, m.Index, m.Expected, m.Actual)
+}
+
+type replay_client struct {
+	conn   *websocket.Conn
+	client *BridgeClient
+	mux    sync.Mutex
+	frames []string
+}
+
+func (c *replay_client) read() {
+	for {
+		msg_type, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		// Binary frames are captured as the equivalent JSON
+		if msg_type == websocket.BinaryMessage {
+			if msg, err = msgpack_to_json(msg); err != nil {
+				continue
+			}
+		}
+		c.mux.Lock()
+		c.frames = append(c.frames, string(msg))
+		c.mux.Unlock()
+	}
+}
+
+func (c *replay_client) count() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.frames)
+}
+
+// Replay feeds the frames that clients sent in a capture into a fresh standalone server, and compares what
+// every client receives against what was originally sent to it.
+//
+// Timestamps are ignored: every frame is sent once the server has gone quiet, which makes the replay
+// deterministic. Generated IDs and UUIDs are normalized on both sides before comparing.
+func Replay(config *Config, records []Capture_Record) ([]Replay_Mismatch, error) {
+	cfg := *config
+	cfg.Standalone_Mode = true
+	cfg.Address = "127.0.0.1:0"
+	cfg.Capture_Path = ""
+	cfg.Storage = nil
+	cfg.Storage_Driver = "memory"
+	cfg.Admin_Token = ""
+
+	ln, err := net.Listen(fiber.NetworkTCP4, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := New(&cfg, nil)
+	go s.Serve(ln)
+	defer func() {
+		s.Close <- true
+		<-s.Done
+	}()
+
+	clients := make(map[string]*replay_client)
+	order := make([]string, 0)
+	expected := make(map[string][]string)
+
+	defer func() {
+		for _, c := range clients {
+			c.conn.Close()
+		}
+	}()
+
+	for _, record := range records {
+		switch record.Direction {
+		case Capture_Open:
+			if _, exists := clients[record.Client]; exists {
+				continue
+			}
+			c, err := s.replay_connect(ln.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			clients[record.Client] = c
+			order = append(order, record.Client)
+
+		case Capture_Rx:
+			c, ok := clients[record.Client]
+			if !ok {
+				continue
+			}
+			if !record.Binary {
+				c.conn.WriteMessage(websocket.TextMessage, []byte(record.Frame))
+			} else if msg, err := json_to_msgpack([]byte(record.Frame)); err == nil {
+				c.conn.WriteMessage(websocket.BinaryMessage, msg)
+			}
+
+		case Capture_Tx:
+			expected[record.Client] = append(expected[record.Client], record.Frame)
+			continue
+
+		case Capture_Close:
+			if c, ok := clients[record.Client]; ok {
+				c.conn.Close()
+			}
+
+		default:
+			continue
+		}
+
+		settle(clients)
+	}
+
+	// Map generated identifiers on both sides to the same placeholders
+	recorded := strings.NewReplacer(capture_identities(records, order)...)
+	var replayed []string
+	for i, uuid := range order {
+		c := clients[uuid].client
+		replayed = append(replayed, c.UUID, fmt.Sprintf("<uuid:%d>", i), c.ID, fmt.Sprintf("<id:%d>", i))
+	}
+	actual := strings.NewReplacer(replayed...)
+
+	var mismatches []Replay_Mismatch
+	for _, uuid := range order {
+		c := clients[uuid]
+		c.mux.Lock()
+		got := c.frames
+		c.mux.Unlock()
+
+		want := expected[uuid]
+		for i := 0; i < max(len(got), len(want)); i++ {
+			var w, g string
+			if i < len(want) {
+				w = recorded.Replace(want[i])
+			}
+			if i < len(got) {
+				g = actual.Replace(got[i])
+			}
+			if w != g {
+				mismatches = append(mismatches, Replay_Mismatch{Client: uuid, Index: i, Expected: w, Actual: g})
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// Connects a new replay client and waits for the server to register it.
+func (s *Server) replay_connect(address string) (*replay_client, error) {
+	known := make(map[*BridgeClient]bool)
+	s.classicclientsmu.RLock()
+	for c := range s.ClassicClients {
+		known[c] = true
+	}
+	s.classicclientsmu.RUnlock()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+address+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &replay_client{conn: conn}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.client == nil {
+		if time.Now().After(deadline) {
+			conn.Close()
+			return nil, fmt.Errorf("replayed client was never registered")
+		}
+		s.classicclientsmu.RLock()
+		for client := range s.ClassicClients {
+			if !known[client] {
+				c.client = client
+			}
+		}
+		s.classicclientsmu.RUnlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	go c.read()
+	return c, nil
+}
+
+// Waits until no replay client has received a frame for the quiet period.
+func settle(clients map[string]*replay_client) {
+	last := -1
+	for {
+		total := 0
+		for _, c := range clients {
+			total += c.count()
+		}
+		if total == last {
+			return
+		}
+		last = total
+		time.Sleep(Replay_Quiet_Period)
+	}
+}
+
+// Returns replacer pairs that map the IDs and UUIDs recorded in a capture to placeholders.
+func capture_identities(records []Capture_Record, order []string) []string {
+	ids := make(map[string]string)
+	for _, record := range records {
+		if record.ID != "" {
+			ids[record.Client] = record.ID
+		}
+	}
+
+	var pairs []string
+	for i, uuid := range order {
+		pairs = append(pairs, uuid, fmt.Sprintf("<uuid:%d>", i))
+		if id := ids[uuid]; id != "" {
+			pairs = append(pairs, id, fmt.Sprintf("<id:%d>", i))
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,505 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"hash/maphash"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of shards in a Room_Store. Rooms are spread across shards by the hash of their key,
+// so that clients of different rooms rarely wait on the same lock.
+const room_shards = 64
+
+type room_shard struct {
+	mux    sync.RWMutex
+	rooms  map[RoomKey]*Room
+	opened uint64 // Rooms opened in this shard so far
+}
+
+// Room_Store holds every open room. A room is opened when its first client joins, and closed when its last
+// client leaves. Rooms are only opened or closed while holding the write lock of their shard, and their
+// members are only changed while holding both that and the room's own lock, so readers only need the latter.
+type Room_Store struct {
+	seed   maphash.Seed
+	shards [room_shards]room_shard
+	count  atomic.Int64 // Open rooms
+}
+
+func New_Room_Store() *Room_Store {
+	store := &Room_Store{seed: maphash.MakeSeed()}
+	for i := range store.shards {
+		store.shards[i].rooms = make(map[RoomKey]*Room)
+	}
+	return store
+}
+
+func (rs *Room_Store) shard(key RoomKey) *room_shard {
+	return &rs.shards[maphash.String(rs.seed, string(key))%room_shards]
+}
+
+// Returns an open room, or nil.
+func (rs *Room_Store) get(key RoomKey) *Room {
+	shard := rs.shard(key)
+	shard.mux.RLock()
+	defer shard.mux.RUnlock()
+	return shard.rooms[key]
+}
+
+// Adds a client to a room, opening the room if needed. If a request is given, the access rules of an open room
+// are enforced, and the settings of the request are applied to a room that it opens. Returns the invite token of
+// a private room that the client opened.
+func (s *Server) join_room(client *BridgeClient, key RoomKey, req *Room_Request) (string, error) {
+	s.Log(Subsystem_Rooms).Debug().Any("room", key).Msgf("%s 🚪 joining", client.GiveName())
+
+	shard, vars := s.lock_shard_for_join(key)
+	defer shard.mux.Unlock()
+
+	r, exists := shard.rooms[key]
+	invite := ""
+	if !exists {
+		s.Log(Subsystem_Rooms).Info().Any("client", client).Any("room", key).Msgf("🚪 creating")
+		r = &Room{Clients: make(Targets), GlobalVars: &sync.Map{}}
+		if req != nil && key != DEFAULT_ROOM {
+			invite = r.access.configure(req)
+		}
+		s.rehydrate_room(key, r, vars)
+		shard.rooms[key] = r
+		shard.opened++
+		s.rooms.count.Add(1)
+		if s.Is_Federated(key) {
+			go s.request_federated_state(key)
+		}
+	}
+
+	// The client is admitted and added under the same lock, so that the room can't change in between
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if exists && req != nil {
+		if err := s.admit(client, r, req); err != nil {
+			return "", err
+		}
+	}
+	r.Clients[client] = true
+	return invite, nil
+}
+
+// Locks the shard of a room that a client joins. If the room isn't open, its persisted global variables are loaded
+// first, so that the shard isn't locked while reading from the store. Loading is retried if the room was opened
+// in the meantime, since its variables may have changed before it closed again.
+func (s *Server) lock_shard_for_join(key RoomKey) (*room_shard, map[string]any) {
+	shard := s.rooms.shard(key)
+	if s.store == nil {
+		shard.mux.Lock()
+		return shard, nil
+	}
+
+	for {
+		shard.mux.RLock()
+		_, open := shard.rooms[key]
+		opened := shard.opened
+		shard.mux.RUnlock()
+
+		var vars map[string]any
+		if !open {
+			vars = s.load_room_vars(key)
+		}
+
+		shard.mux.Lock()
+		if _, still_open := shard.rooms[key]; still_open || (!open && shard.opened == opened) {
+			return shard, vars
+		}
+		shard.mux.Unlock()
+	}
+}
+
+// Removes a client from a room, closing the room if it was the last one in it.
+func (s *Server) leave_room(client *BridgeClient, key RoomKey) {
+	s.Log(Subsystem_Rooms).Debug().Any("room", key).Msgf("%s 🚪 leaving", client.GiveName())
+
+	shard := s.rooms.shard(key)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	r, exists := shard.rooms[key]
+	if !exists {
+		return
+	}
+
+	r.mux.Lock()
+	delete(r.Clients, client)
+	empty := len(r.Clients) == 0
+	r.mux.Unlock()
+
+	if empty {
+		delete(shard.rooms, key)
+		s.rooms.count.Add(-1)
+		s.Log(Subsystem_Rooms).Info().Any("client", client).Any("room", key).Msgf("🚪 destroying")
+	}
+}
+
+// Room_Request asks to join a room. Private rooms can only be joined with their password or invite token,
+// and the remaining settings are only applied if the request opens the room.
+type Room_Request struct {
+	Room        RoomKey `json:"name"`
+	Password    string  `json:"password,omitempty"`
+	Invite      string  `json:"invite,omitempty"`
+	Private     bool    `json:"private,omitempty"`     // Opens the room with an invite token
+	Max_Members int     `json:"max_members,omitempty"` // Opens the room with a member limit
+}
+
+// Room_Access_Error explains why a client may not join a room. If it isn't full and its username doesn't conflict,
+// the room is private.
+type Room_Access_Error struct {
+	Room     RoomKey
+	Full     bool
+	Conflict bool // The username policy of the room rejects the client's username
+}
+
+func (e *Room_Access_Error) Error() string {
+	if e.Full {
+		return "the room is full"
+	}
+	if e.Conflict {
+		return "your username is already in use in the room"
+	}
+	return "the room is private, and requires a valid password or invite token"
+}
+
+// room_access holds the rules for joining a room, which are set by the client that opened it.
+type room_access struct {
+	password    string
+	invite      string
+	max_members int
+}
+
+// Applies the settings of the request that opened a room. Returns the generated invite token, if any.
+func (a *room_access) configure(req *Room_Request) string {
+	a.password = req.Password
+	a.max_members = max(req.Max_Members, 0)
+	if req.Private {
+		a.invite = rand.Text()
+	}
+	return a.invite
+}
+
+func (a *room_access) private() bool {
+	return a.password != "" || a.invite != ""
+}
+
+func (a *room_access) unlocks(req *Room_Request) bool {
+	matches := func(secret string, given string) bool {
+		return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(given)) == 1
+	}
+	return matches(a.password, req.Password) || matches(a.invite, req.Invite)
+}
+
+// Returns the member limit of a room, which is the lowest of its own and the configured one.
+func (s *Server) member_limit(r *Room) int {
+	limit := r.access.max_members
+	if configured := int(s.Config().Maximum_Room_Members); configured > 0 && (limit == 0 || configured < limit) {
+		limit = configured
+	}
+	return limit
+}
+
+// Checks whether a client may join an open room. The caller must hold the room's lock.
+// The default room only enforces its username policy, and members may always rejoin their rooms.
+func (s *Server) admit(client *BridgeClient, r *Room, req *Room_Request) error {
+	if r.Clients[client] {
+		return nil
+	}
+	username := client.GetUsername()
+	if s.Username_Policy(req.Room) == Username_Policy_Reject && (len(username_conflicts(r, client, username)) > 0 || s.remote_username(req.Room, username)) {
+		return &Room_Access_Error{Room: req.Room, Conflict: true}
+	}
+	if req.Room == DEFAULT_ROOM {
+		return nil
+	}
+	if r.access.private() && !r.access.unlocks(req) {
+		return &Room_Access_Error{Room: req.Room}
+	}
+	if limit := s.member_limit(r); limit > 0 && len(r.Clients) >= limit {
+		return &Room_Access_Error{Room: req.Room, Full: true}
+	}
+	return nil
+}
+
+// Check_Room_Access reports whether a client may join every requested room, without joining them. Rooms that
+// aren't open yet are always accessible. Join_Rooms checks again, since rooms may change in the meantime.
+func (s *Server) Check_Room_Access(client *BridgeClient, requests []Room_Request) error {
+	for _, req := range requests {
+		r := s.rooms.get(req.Room)
+		if r == nil {
+			continue
+		}
+		r.mux.RLock()
+		err := s.admit(client, r, &req)
+		r.mux.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Join_Rooms subscribes a client to every requested room, enforcing their access rules. If any room refuses the
+// client, the client leaves the rooms that it joined along the way, and the returned error explains why.
+// Otherwise, it returns the invite tokens of the private rooms that the client opened.
+func (s *Server) Join_Rooms(client *BridgeClient, requests []Room_Request) (map[RoomKey]string, error) {
+	var joined RoomKeys
+	invites := make(map[RoomKey]string)
+	for _, req := range requests {
+		member := slices.Contains(client.GetRooms(), req.Room)
+		invite, err := s.join_room(client, req.Room, &req)
+		if err != nil {
+			s.Log(Subsystem_Rooms).Warn().Any("room", req.Room).Msgf("%s ⚠️  Refused to join: %v.", client.GiveName(), err)
+			for _, room := range joined {
+				s.Unsubscribe(client, room)
+			}
+			return nil, err
+		}
+		if !member {
+			joined = append(joined, req.Room)
+			client.track_room(req.Room)
+		}
+		if invite != "" {
+			invites[req.Room] = invite
+		}
+	}
+	return invites, nil
+}
+
+// Parse_Room_Requests reads the rooms that a client asks to join. Each room is either a name, or an object with
+// the fields of a Room_Request. Either one may be given on its own, or in an array.
+func Parse_Room_Requests(value any) []Room_Request {
+	var requests []Room_Request
+	switch v := value.(type) {
+	case nil:
+	case []any:
+		for _, item := range v {
+			requests = append(requests, Parse_Room_Requests(item)...)
+		}
+	case map[string]any:
+		name, ok := v["name"]
+		if !ok || name == nil || fmt.Sprintf("%v", name) == "" {
+			break
+		}
+		req := Room_Request{Room: RoomKey(fmt.Sprintf("%v", name))}
+		req.Password, _ = v["password"].(string)
+		req.Invite, _ = v["invite"].(string)
+		req.Private, _ = v["private"].(bool)
+		switch limit := v["max_members"].(type) {
+		case float64:
+			req.Max_Members = int(limit)
+		case int:
+			req.Max_Members = limit
+		}
+		requests = append(requests, req)
+	default:
+		if name := fmt.Sprintf("%v", v); name != "" {
+			requests = append(requests, Room_Request{Room: RoomKey(name)})
+		}
+	}
+	return requests
+}
+
+// Returns the names of the requested rooms.
+func Requested_Rooms(requests []Room_Request) RoomKeys {
+	rooms := make(RoomKeys, len(requests))
+	for i, req := range requests {
+		rooms[i] = req.Room
+	}
+	return rooms
+}
+
+// Returns the persisted global variables of a room, or nil if they can't be loaded.
+func (s *Server) load_room_vars(key RoomKey) map[string]any {
+	vars, err := s.store.Load(key)
+	if err != nil {
+		s.Log(Subsystem_Rooms).Error().Any("room", key).Msgf("⚠️  Failed to load persisted global variables: %v", err)
+		return nil
+	}
+	return vars
+}
+
+// Loads the persisted global variables of a newly created room into it.
+func (s *Server) rehydrate_room(key RoomKey, r *Room, vars map[string]any) {
+	for name, value := range vars {
+		r.GlobalVars.Store(name, value)
+	}
+	if len(vars) > 0 {
+		s.Log(Subsystem_Rooms).Info().Any("room", key).Msgf("🚪 restored %d global variable(s)", len(vars))
+	}
+}
+
+// DeleteRoomGlobalVar deletes a global variable. Returns false if the room or the variable doesn't exist.
+func (s *Server) DeleteRoomGlobalVar(room RoomKey, key any) bool {
+	r := s.rooms.get(room)
+	if r == nil {
+		return false
+	}
+
+	// Changes are serialized per room, so that they are queued in the same order as they are applied
+	r.vars_mux.Lock()
+	defer r.vars_mux.Unlock()
+
+	if _, ok := r.GlobalVars.Load(key); !ok {
+		return false
+	}
+	s.Log(Subsystem_Rooms).Info().Any("room", room).Any("gvar", key).Msgf("🚪 deleting")
+
+	r.GlobalVars.Delete(key)
+	if s.store != nil {
+		s.store.Delete(room, fmt.Sprintf("%v", key))
+	}
+	return true
+}
+
+func (s *Server) SetRoomGlobalVar(client *BridgeClient, room RoomKey, key any, value any) bool {
+	r := s.rooms.get(room)
+	if r == nil {
+		return false
+	}
+
+	r.vars_mux.Lock()
+	defer r.vars_mux.Unlock()
+
+	if _, ok := r.GlobalVars.Load(key); !ok {
+		s.Log(Subsystem_Rooms).Info().Any("client", client).Any("room", room).Any("gvar", key).Msgf("🚪 creating")
+	}
+
+	r.GlobalVars.Store(key, value)
+	if s.store != nil {
+		s.store.Store(room, fmt.Sprintf("%v", key), value)
+	}
+	return true
+}
+
+// RenameRoomGlobalVar moves a global variable to a new name, keeping its value. Nobody sees the variable
+// under both names or neither, and the rename is persisted as one change. Returns false if the room or the
+// variable doesn't exist, or if another variable already has the new name, which is never overwritten.
+func (s *Server) RenameRoomGlobalVar(client *BridgeClient, room RoomKey, key any, newKey any) bool {
+	r := s.rooms.get(room)
+	if r == nil {
+		return false
+	}
+
+	r.vars_mux.Lock()
+	defer r.vars_mux.Unlock()
+
+	value, ok := r.GlobalVars.Load(key)
+	if !ok {
+		return false
+	}
+	if fmt.Sprintf("%v", key) == fmt.Sprintf("%v", newKey) {
+		return true
+	}
+	if _, taken := r.GlobalVars.Load(newKey); taken {
+		return false
+	}
+	s.Log(Subsystem_Rooms).Info().Any("client", client).Any("room", room).Any("gvar", key).Any("name", newKey).Msgf("🚪 renaming")
+
+	r.GlobalVars.Store(newKey, value)
+	r.GlobalVars.Delete(key)
+	if s.store != nil {
+		s.store.Rename(room, fmt.Sprintf("%v", key), fmt.Sprintf("%v", newKey), value)
+	}
+	return true
+}
+
+func (s *Server) GetRoomGlobalVars(room RoomKey) *sync.Map {
+	if r := s.rooms.get(room); r != nil {
+		return r.GlobalVars
+	}
+	return nil
+}
+
+func (s *Server) Copy_Clients(room RoomKey) BridgeClients {
+	r := s.rooms.get(room)
+	if r == nil {
+		return nil
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	clients := make(BridgeClients, 0, len(r.Clients))
+	for c := range r.Clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (s *Server) Get_Targets(room RoomKey) Targets {
+	r := s.rooms.get(room)
+	if r == nil {
+		return nil
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	targets := make(Targets, len(r.Clients))
+	for c := range r.Clients {
+		targets[c] = true
+	}
+	return targets
+}
+
+// Is_Client_In_Room checks if the client is currently subscribed to a specific room
+func (s *Server) Is_Client_In_Room(client *BridgeClient, room RoomKey) bool {
+	r := s.rooms.get(room)
+	if r == nil {
+		return false
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if r.Clients[client] {
+		return true
+	}
+	for c := range r.Clients {
+		if c.UUID == client.UUID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) DoesRoomExist(room RoomKey) bool {
+	return s.rooms.get(room) != nil
+}
+
+func (s *Server) ReportActiveRooms() int {
+	return int(s.rooms.count.Load())
+}
+
+// Returns the keys of every open room.
+func (s *Server) Get_Rooms() RoomKeys {
+	rooms := make(RoomKeys, 0, s.rooms.count.Load())
+	for i := range s.rooms.shards {
+		shard := &s.rooms.shards[i]
+		shard.mux.RLock()
+		for room := range shard.rooms {
+			rooms = append(rooms, room)
+		}
+		shard.mux.RUnlock()
+	}
+	return rooms
+}
+
+// CanAllocateNRooms checks if the current room count + n doesn't exceed the limit.
+// Decreases the projected total by 1 if the client is the only connected peer in the default room.
+// This function assumes that if granted, the client joins the n allocated rooms
+// and frees the default room from memory.
+func (s *Server) CanAllocateNRooms(c *BridgeClient, n int) bool {
+	active_rooms := s.ReportActiveRooms()
+	decrement := 0
+	if default_room := s.rooms.get(DEFAULT_ROOM); default_room != nil {
+		default_room.mux.RLock()
+		if len(default_room.Clients) == 1 && default_room.Clients[c] {
+			decrement = -1
+		}
+		default_room.mux.RUnlock()
+	}
+	return active_rooms+n+decrement <= int(s.Config().Maximum_Rooms)
+}
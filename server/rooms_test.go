@@ -0,0 +1,221 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/contrib/v3/websocket"
+)
+
+// Creates a CL4 client that is registered in rooms, but isn't connected to anything.
+func detached_client(s *Server, id int) *BridgeClient {
+	c := &BridgeClient{
+		Conn:     &websocket.Conn{},
+		ID:       fmt.Sprint(id),
+		UUID:     fmt.Sprintf("client-%d", id),
+		writer:   make(chan frame, 256),
+		exit:     make(chan bool, 1),
+		Server:   s,
+		Protocol: New_CL4_or_CL3(s),
+	}
+	c.SetDialect(Dialect_CL4_0_2_0)
+	return c
+}
+
+func TestRoomStore(t *testing.T) {
+	config := New_Test_Config()
+	config.Maximum_Rooms = 3
+	s := New(config, nil)
+
+	a, b := detached_client(s, 1), detached_client(s, 2)
+	s.Subscribe(a, DEFAULT_ROOM)
+	if !s.CanAllocateNRooms(a, 3) {
+		t.Error("the only client of the default room can't allocate every room")
+	}
+
+	s.Subscribe(b, DEFAULT_ROOM)
+	if s.CanAllocateNRooms(a, 3) {
+		t.Error("a client allocated a room over the limit")
+	}
+
+	s.Subscribe(a, "room")
+	if !s.Is_Client_In_Room(a, "room") || s.Is_Client_In_Room(b, "room") {
+		t.Error("room membership is wrong")
+	}
+	if !s.SetRoomGlobalVar(a, "room", "x", 1) || s.SetRoomGlobalVar(a, "missing", "x", 1) {
+		t.Error("global variables were set in the wrong rooms")
+	}
+	if !s.DeleteRoomGlobalVar("room", "x") || s.DeleteRoomGlobalVar("room", "x") {
+		t.Error("deleting a global variable didn't report whether it existed")
+	}
+	if rooms := s.ReportActiveRooms(); rooms != 2 || len(s.Get_Rooms()) != 2 {
+		t.Errorf("%d rooms are open, expected 2", rooms)
+	}
+
+	s.Unsubscribe(a, "room")
+	if s.DoesRoomExist("room") || s.GetRoomGlobalVars("room") != nil {
+		t.Error("room wasn't closed after its last client left")
+	}
+
+	// Concurrent joins and leaves keep the room count consistent
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Go(func() {
+			c := detached_client(s, 100+i)
+			room := RoomKey(fmt.Sprint("room-", i%5))
+			for range 20 {
+				s.Subscribe(c, room)
+				s.Broadcast(room, &Common_Packet{Command: "gmsg", Value: "hi"})
+				s.Unsubscribe(c, room)
+			}
+		})
+	}
+	wg.Wait()
+	if rooms := s.ReportActiveRooms(); rooms != 1 || len(s.Get_Rooms()) != 1 {
+		t.Errorf("%d rooms are open after every client left, expected 1", rooms)
+	}
+}
+
+func TestPrivateRooms(t *testing.T) {
+	b := Start_Test_Bridge(t, New_Test_Config())
+
+	// Connects a CL4 client and links it to a room, returning the status code of the link
+	link := func(name string, room string) (*Test_Client, Common_Packet) {
+		c := b.Connect(name)
+		c.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+		b.Settle()
+		c.Send(`{"cmd":"setid","val":"` + name + `"}`)
+		b.Settle()
+		c.Send(`{"cmd":"link","val":` + room + `,"listener":"link"}`)
+		b.Settle()
+		for _, frame := range c.Drain() {
+			var p Common_Packet
+			if json.Unmarshal([]byte(frame), &p) == nil && p.Command == "statuscode" && p.Listener == "link" {
+				return c, p
+			}
+		}
+		t.Fatalf("%s never got a response to linking", name)
+		return nil, Common_Packet{}
+	}
+
+	_, status := link("owner", `{"name":"secret","private":true,"password":"hunter2","max_members":3}`)
+	invites, _ := status.Value.(map[string]any)
+	invite, _ := invites["secret"].(string)
+	if status.CodeID != StatusOK.Code || invite == "" {
+		t.Fatalf("opening a private room returned %+v, expected an invite token", status)
+	}
+
+	for name, room := range map[string]string{
+		"no credentials": `"secret"`,
+		"wrong password": `{"name":"secret","password":"hunter3"}`,
+		"wrong invite":   `{"name":"secret","invite":"nope"}`,
+	} {
+		if _, status := link(name, room); status.CodeID != StatusRefused.Code || !strings.Contains(fmt.Sprint(status.Details), "private") {
+			t.Errorf("joining with %s returned %+v, expected a refusal", name, status)
+		}
+	}
+
+	if _, status := link("guest", `[{"name":"secret","invite":"`+invite+`"},"lobby"]`); status.CodeID != StatusOK.Code || status.Value != nil {
+		t.Errorf("joining with an invite returned %+v", status)
+	}
+	if _, status := link("friend", `{"name":"secret","password":"hunter2"}`); status.CodeID != StatusOK.Code {
+		t.Errorf("joining with the password returned %+v", status)
+	}
+
+	// The room is full, and clients that are refused don't join the other rooms they asked for
+	if _, status := link("latecomer", `["lobby",{"name":"secret","password":"hunter2"}]`); status.CodeID != StatusRefused.Code || !strings.Contains(fmt.Sprint(status.Details), "full") {
+		t.Errorf("joining a full room returned %+v", status)
+	}
+	if n := len(b.Copy_Clients("lobby")); n != 1 {
+		t.Errorf("lobby has %d clients, expected 1", n)
+	}
+
+	// The same rules apply to Scratch projects
+	if _, code := b.Exchange("/", nil, `{"method":"handshake","project_id":"secret","user":"scratch"}`); code != int(Unavailable_Status.Code) {
+		t.Errorf("Scratch client without a password closed with %d, expected %d", code, Unavailable_Status.Code)
+	}
+	if _, code := b.Exchange("/", nil, `{"method":"handshake","project_id":"secret","user":"scratch","password":"hunter2"}`); code != int(Overloaded_Status.Code) {
+		t.Errorf("Scratch client joining a full project closed with %d, expected %d", code, Overloaded_Status.Code)
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{1_000, 10_000, 50_000} {
+		b.Run(fmt.Sprintf("%d clients", n), func(b *testing.B) {
+			s := New(New_Test_Config(), nil)
+			clients := make([]*BridgeClient, n)
+			for i := range clients {
+				clients[i] = detached_client(s, i)
+				s.Subscribe(clients[i], DEFAULT_ROOM)
+			}
+			packet := &Common_Packet{Command: "gmsg", Value: "Hello, world!"}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+
+				// Empty the queues before they fill up, without counting it
+				if i%200 == 199 {
+					b.StopTimer()
+					for _, c := range clients {
+						for len(c.writer) > 0 {
+							<-c.writer
+						}
+					}
+					b.StartTimer()
+				}
+
+				s.Broadcast(DEFAULT_ROOM, packet)
+			}
+			b.ReportMetric(float64(n)*float64(b.N)/b.Elapsed().Seconds(), "deliveries/s")
+		})
+	}
+}
+
+// Renames and deletes that don't apply are refused, and never broadcast.
+func TestGlobalVariableChanges(t *testing.T) {
+	b := Start_Test_Bridge(t, New_Test_Config())
+	connect := func(name string) *Test_Client {
+		c := b.Connect(name)
+		c.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+		c.Send(`{"cmd":"setid","val":"` + name + `"}`)
+		return c
+	}
+	alice, bob := connect("alice"), connect("bob")
+	alice.Send(`{"cmd":"gvar","name":"a","val":"1"}`)
+	alice.Send(`{"cmd":"gvar","name":"b","val":"2"}`)
+	b.Settle()
+	alice.Drain()
+	bob.Drain()
+
+	for _, step := range []struct {
+		frame string
+		code  StatusCode
+	}{
+		{`{"cmd":"gvar_rename","name":"missing","val":"c","listener":"x"}`, StatusIDNotFound},
+		{`{"cmd":"gvar_rename","name":"a","val":"b","listener":"x"}`, StatusIDConflict},
+		{`{"cmd":"gvar_delete","name":"missing","listener":"x"}`, StatusIDNotFound},
+		{`{"cmd":"gvar_rename","name":"a","val":"c","listener":"x"}`, StatusOK},
+	} {
+		frame, code := step.frame, step.code
+		alice.Send(frame)
+		b.Settle()
+		if got := received(alice, "statuscode"); len(got) != 1 || got[0].CodeID != code.Code {
+			t.Errorf("%s returned %+v, expected %s", frame, got, code)
+		}
+		if got := received(bob, "gvar_rename"); (len(got) == 1) != (code == StatusOK) {
+			t.Errorf("%s was broadcast as %+v", frame, got)
+		}
+	}
+
+	vars := b.GetRoomGlobalVars(DEFAULT_ROOM)
+	_, a := vars.Load("a")
+	c, _ := vars.Load("c")
+	b_value, _ := vars.Load("b")
+	if a || c != "1" || b_value != "2" {
+		t.Errorf("after renaming a to c, a exists: %t, b is %v and c is %v", a, b_value, c)
+	}
+}
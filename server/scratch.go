@@ -1,15 +1,34 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
 	"github.com/goccy/go-json"
 	"github.com/kaptinlin/jsonschema"
 )
 
+// Every cloud variable name must start with this prefix.
+const Scratch_Variable_Prefix = "☁ "
+
+// Maximum length of a cloud variable name.
+const Scratch_Max_Name_Length = 1024
+
+// Matches the numeric values that Scratch is able to store in cloud variables.
+var scratchNumberRegex = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
 type Scratch_Handler struct {
 	Schema *jsonschema.Schema
 	*Server
 }
 
+func init() {
+	Register_Protocol(Protocol_Scratch, 20, New_Scratch)
+}
+
 func New_Scratch(parent *Server) Protocol {
 	return &Scratch_Handler{
 		Schema: GetScratchPacketSchema(),
@@ -17,6 +36,10 @@ func New_Scratch(parent *Server) Protocol {
 	}
 }
 
+func (Scratch_Handler) Name() string {
+	return Protocol_Scratch
+}
+
 func (s Scratch_Handler) On_Disconnect(c *BridgeClient, rooms RoomKeys) {
 	username := c.GetUsername()
 	if username == nil || username == "" {
@@ -51,6 +74,13 @@ func (s Scratch_Handler) Reader(client *BridgeClient, data []byte) bool {
 		return false
 	}
 
+	s.Metrics.Packets_Received.Inc(Protocol_Scratch, metric_command(p.Method))
+
+	// Scratch has no way to report errors, so throttled packets are dropped silently
+	if ok, _ := s.Allow_Packet(client, p.Method); !ok {
+		return true
+	}
+
 	go s.Handler(client, p)
 	return true
 }
@@ -60,7 +90,7 @@ func (s Scratch_Handler) Handler(client *BridgeClient, p *ScratchPacket) {
 		return
 	}
 
-	s.Logger.Debug().Any("packet", p).Any("client", client).Msg("Received Scratch packet")
+	s.Log(Subsystem_Scratch).Debug().Any("packet", p).Any("client", client).Msg("Received Scratch packet")
 
 	if client.Conn != nil {
 		s.classicclientsmu.RLock()
@@ -71,6 +101,10 @@ func (s Scratch_Handler) Handler(client *BridgeClient, p *ScratchPacket) {
 		}
 	}
 
+	if !s.Require_Identity(client) {
+		return
+	}
+
 	switch p.Method {
 	case "handshake":
 
@@ -89,10 +123,39 @@ func (s Scratch_Handler) Handler(client *BridgeClient, p *ScratchPacket) {
 			return
 		}
 
+		// Authenticated clients may only use the username of their identity
+		if !s.Pinned_Username(client, p.User) {
+			s.Respond_With_Code(client.Conn, Identity_Error)
+			client.Conn.Close()
+			return
+		}
+
 		// Set values for setup
-		client.SetUsername(p.User)
 		projectRoom := RoomKey(p.ProjectID)
 
+		// Refuse projects that can't be used from this origin
+		if !s.Origin_Allowed(client.origin, projectRoom) {
+			s.Log(Subsystem_Scratch).Warn().Str("origin", client.origin).Msgf("%s ⚠️  Refused project %s: Origin not allowed.", client.GiveName(), projectRoom)
+			s.Respond_With_Code(client.Conn, Unavailable_Status)
+			client.Conn.Close()
+			return
+		}
+
+		// Refuse private projects without a valid password or invite token, and full projects
+		join := []Room_Request{{Room: projectRoom, Password: p.Password, Invite: p.Invite}}
+		if err := s.Check_Room_Access(client, join); err != nil {
+			s.refuse_project(client, projectRoom, err)
+			return
+		}
+		s.mark_project(projectRoom)
+
+		// Enforce the username policy of the project
+		if !s.Claim_Username(client, p.User, RoomKeys{projectRoom}) {
+			s.Respond_With_Code(client.Conn, Username_Error)
+			client.Conn.Close()
+			return
+		}
+
 		// Abort if the server is "busy"
 		if !s.DoesRoomExist(projectRoom) && !s.CanAllocateNRooms(client, 1) {
 			s.Respond_With_Code(client.Conn, Overloaded_Status)
@@ -102,7 +165,11 @@ func (s Scratch_Handler) Handler(client *BridgeClient, p *ScratchPacket) {
 
 		// The Scratch protocol cannot use differing room contexts
 		s.Unsubscribe(client, DEFAULT_ROOM)
-		s.Subscribe(client, projectRoom)
+		if _, err := s.Join_Rooms(client, join); err != nil {
+			s.refuse_project(client, projectRoom, err)
+			return
+		}
+		client.Complete_Handshake()
 
 		// Emit join event for other protocols
 		s.Broadcast(projectRoom, &Common_Packet{
@@ -113,14 +180,11 @@ func (s Scratch_Handler) Handler(client *BridgeClient, p *ScratchPacket) {
 		}, client)
 
 		// Sync Shared Variables!
-		if gv := s.GetRoomGlobalVars(projectRoom); gv != nil {
-			gv.Range(func(key, value any) bool {
-				s.Unicast(client, &ScratchPacket{
-					Method: "set",
-					Name:   key,
-					Value:  value,
-				})
-				return true
+		for _, v := range s.Get_Room_Vars(projectRoom) {
+			s.Unicast(client, &ScratchPacket{
+				Method: "set",
+				Name:   v.Name,
+				Value:  v.Value,
 			})
 		}
 
@@ -131,12 +195,17 @@ func (s Scratch_Handler) Handler(client *BridgeClient, p *ScratchPacket) {
 		}
 		projectRoom := rooms[0]
 
+		if !s.Enforce_Variable_Rules(client, projectRoom, p) {
+			return
+		}
+
 		s.SetRoomGlobalVar(client, projectRoom, p.Name, p.Value)
 
 		s.Broadcast(projectRoom, &ScratchPacket{
 			Method: p.Method,
 			Name:   p.Name,
 			Value:  p.Value,
+			Origin: s.UserObject(client),
 		})
 
 	case "rename":
@@ -146,17 +215,21 @@ func (s Scratch_Handler) Handler(client *BridgeClient, p *ScratchPacket) {
 		}
 		projectRoom := rooms[0]
 
-		if gv := s.GetRoomGlobalVars(projectRoom); gv != nil {
-			if oldVal, ok := gv.Load(p.Name); ok {
-				gv.Store(p.NewName, oldVal)
-				gv.Delete(p.Name)
-			}
+		if !s.Enforce_Variable_Rules(client, projectRoom, p) {
+			return
 		}
 
-		s.Broadcast(projectRoom, &ScratchPacket{
-			Method:  "rename",
+		if !s.RenameRoomGlobalVar(client, projectRoom, p.Name, p.NewName) {
+			return
+		}
+
+		// Broadcast using the bridge extension so that every protocol can follow along
+		s.Broadcast(projectRoom, &Common_Packet{
+			Command: "gvar_rename",
 			Name:    p.Name,
-			NewName: p.NewName,
+			Value:   p.NewName,
+			Origin:  s.UserObject(client),
+			Rooms:   projectRoom,
 		})
 
 	case "delete":
@@ -166,13 +239,147 @@ func (s Scratch_Handler) Handler(client *BridgeClient, p *ScratchPacket) {
 		}
 		projectRoom := rooms[0]
 
-		if gv := s.GetRoomGlobalVars(projectRoom); gv != nil {
-			gv.Delete(p.Name)
+		if !s.Enforce_Variable_Rules(client, projectRoom, p) {
+			return
+		}
+
+		if !s.DeleteRoomGlobalVar(projectRoom, p.Name) {
+			return
 		}
 
-		s.Broadcast(projectRoom, &ScratchPacket{
-			Method: "delete",
-			Name:   p.Name,
+		// Broadcast using the bridge extension so that every protocol can follow along
+		s.Broadcast(projectRoom, &Common_Packet{
+			Command: "gvar_delete",
+			Name:    p.Name,
+			Origin:  s.UserObject(client),
+			Rooms:   projectRoom,
 		})
 	}
 }
+
+// Disconnects a client that may not join a project. Full projects are reported as overloaded, private ones as
+// unavailable, the same as projects that can't be used from the client's origin, and username conflicts as such.
+func (s Scratch_Handler) refuse_project(client *BridgeClient, project RoomKey, err error) {
+	s.Log(Subsystem_Scratch).Warn().Msgf("%s ⚠️  Refused project %s: %v.", client.GiveName(), project, err)
+	code := Unavailable_Status
+	var access_err *Room_Access_Error
+	if errors.As(err, &access_err) {
+		if access_err.Full {
+			code = Overloaded_Status
+		} else if access_err.Conflict {
+			code = Username_Error
+		}
+	}
+	s.Respond_With_Code(client.Conn, code)
+	client.Conn.Close()
+}
+
+// Checks a cloud variable name against the rules of the TurboWarp cloud server.
+func valid_cloud_name(name any) bool {
+	str, ok := name.(string)
+	return ok && strings.HasPrefix(str, Scratch_Variable_Prefix) && len(str) <= Scratch_Max_Name_Length
+}
+
+// Checks a cloud variable value against the rules of the TurboWarp cloud server. Only numbers are allowed.
+func valid_cloud_value(value any, max_length int) bool {
+	var str string
+	switch v := value.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+		str = fmt.Sprintf("%v", v)
+	case string:
+		if !scratchNumberRegex.MatchString(v) {
+			return false
+		}
+		str = v
+	case json.RawMessage: // From Delta peers
+		var decoded any
+		if json.Unmarshal(v, &decoded) != nil {
+			return false
+		}
+		return valid_cloud_value(decoded, max_length)
+	default:
+		return false
+	}
+	return max_length <= 0 || len(str) <= max_length
+}
+
+// Variable_Rule_Error is a change to a cloud variable that breaks a rule of Scratch validation.
+type Variable_Rule_Error struct {
+	Code   SocketCodes // Scratch clients are disconnected with this code
+	Reason string
+}
+
+func (e *Variable_Rule_Error) Error() string {
+	return e.Reason
+}
+
+// Marks a room as a Scratch project, whose variables follow the rules of Scratch validation from then on.
+func (s *Server) mark_project(room RoomKey) {
+	if r := s.rooms.get(room); r != nil {
+		r.project.Store(true)
+	}
+}
+
+// Is_Project reports whether a Scratch client has joined a room since it was opened.
+func (s *Server) Is_Project(room RoomKey) bool {
+	r := s.rooms.get(room)
+	return r != nil && r.project.Load()
+}
+
+// Check_Variable_Rules checks a change to a global variable against the rules of the TurboWarp cloud server, if
+// Scratch validation is enabled and the room is a Scratch project. This applies to every protocol, since they all
+// write into the variables that Scratch clients see. The method is "set", "create", "rename" or "delete", as
+// Scratch clients send them. Returns a Variable_Rule_Error if the change breaks a rule.
+func (s *Server) Check_Variable_Rules(room RoomKey, method string, name any, new_name any, value any) error {
+	config := s.Config()
+	if !config.Scratch_Validation || !s.Is_Project(room) {
+		return nil
+	}
+
+	switch {
+	case !valid_cloud_name(name):
+		return &Variable_Rule_Error{Generic_Error, fmt.Sprintf("cloud variable names must start with %q", Scratch_Variable_Prefix)}
+	case method == "rename" && !valid_cloud_name(new_name):
+		return &Variable_Rule_Error{Generic_Error, fmt.Sprintf("cloud variable names must start with %q", Scratch_Variable_Prefix)}
+	case method != "set" && method != "create":
+		return nil
+	case !valid_cloud_value(value, config.Scratch_Max_Value_Length):
+		if config.Scratch_Max_Value_Length > 0 {
+			return &Variable_Rule_Error{Generic_Error, fmt.Sprintf("cloud variable values must be numbers of at most %d characters", config.Scratch_Max_Value_Length)}
+		}
+		return &Variable_Rule_Error{Generic_Error, "cloud variable values must be numbers"}
+	}
+
+	if config.Scratch_Max_Variables > 0 {
+		if gv := s.GetRoomGlobalVars(room); gv != nil {
+			if _, exists := gv.Load(name); !exists {
+				count := 0
+				gv.Range(func(_, _ any) bool {
+					count++
+					return true
+				})
+				if count >= config.Scratch_Max_Variables {
+					return &Variable_Rule_Error{Overloaded_Status, "the project has too many cloud variables"}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Enforce_Variable_Rules validates a cloud variable command, see Check_Variable_Rules.
+// If the command breaks a rule, the connection is closed and false is returned.
+func (s Scratch_Handler) Enforce_Variable_Rules(client *BridgeClient, room RoomKey, p *ScratchPacket) bool {
+	var rule_err *Variable_Rule_Error
+	if !errors.As(s.Check_Variable_Rules(room, p.Method, p.Name, p.NewName, p.Value), &rule_err) {
+		return true
+	}
+
+	s.Log(Subsystem_Scratch).Warn().Any("room", room).Any("packet", p).Msgf("%s ⚠️  Aborting connection to client: Invalid cloud variable command: %v.", client.GiveName(), rule_err)
+	s.Respond_With_Code(client.Conn, rule_err.Code)
+	client.Conn.Close()
+	return false
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+// Every protocol is held to the rules of Scratch validation in rooms that Scratch clients joined.
+func TestScratchValidation(t *testing.T) {
+	config := New_Test_Config()
+	config.Scratch_Validation = true
+	config.Scratch_Max_Value_Length = 5
+	config.Scratch_Max_Variables = 2
+	b := Start_Test_Bridge(t, config)
+
+	scratch := b.Connect("scratch")
+	cl4 := b.Connect("cl4")
+	delta := b.Connect_Delta("delta")
+	for _, step := range []struct {
+		client *Test_Client
+		frame  string
+	}{
+		{scratch, `{"method":"handshake","project_id":"default","user":"scratch"}`},
+		{scratch, `{"method":"set","name":"☁ a","value":"1"}`},
+		{cl4, `{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`},
+		{cl4, `{"cmd":"setid","val":"cl4"}`},
+		{cl4, `{"cmd":"link","val":["default","lobby"]}`},
+	} {
+		step.client.Send(step.frame)
+		b.Settle()
+	}
+	scratch.Drain()
+	cl4.Drain()
+
+	for _, step := range []struct {
+		frame string
+		code  StatusCode
+	}{
+		{`{"cmd":"gvar","name":"score","val":"1","rooms":"default","listener":"x"}`, StatusRefused},
+		{`{"cmd":"gvar","name":"☁ b","val":"abc","rooms":"default","listener":"x"}`, StatusRefused},
+		{`{"cmd":"gvar","name":"☁ b","val":"123456","rooms":"default","listener":"x"}`, StatusRefused},
+		{`{"cmd":"gvar","name":"☁ b","val":"12","rooms":"default","listener":"x"}`, StatusOK},
+		{`{"cmd":"gvar","name":"☁ c","val":"1","rooms":"default","listener":"x"}`, StatusRefused},
+		{`{"cmd":"gvar_rename","name":"☁ a","val":"a","rooms":"default","listener":"x"}`, StatusRefused},
+		{`{"cmd":"gvar","name":"score","val":"abc","rooms":"lobby","listener":"x"}`, StatusOK},
+	} {
+		cl4.Send(step.frame)
+		b.Settle()
+		if got := received(cl4, "statuscode"); len(got) != 1 || got[0].CodeID != step.code.Code {
+			t.Errorf("%s returned %+v, expected %s", step.frame, got, step.code)
+		}
+	}
+
+	delta.Send(`{"opcode":"G_VAR","id":"☁ a","payload":"\"abc\"","ttl":1}`)
+	b.Settle()
+	delta.Send(`{"opcode":"G_VAR","id":"☁ a","payload":"7","ttl":1}`)
+	b.Settle()
+	if got := strings.Join(scratch.Drain(), "\n"); strings.Contains(got, "abc") || !strings.Contains(got, `"value":"7"`) && !strings.Contains(got, `"value":7`) {
+		t.Errorf("scratch received invalid variables, or missed valid ones:\n%s", got)
+	}
+
+	// Scratch clients that break the rules are disconnected
+	for frame, code := range map[string]SocketCodes{
+		`{"method":"set","name":"score","value":"1"}`: Generic_Error,
+		`{"method":"set","name":"☁ c","value":"1"}`:   Overloaded_Status,
+	} {
+		handshake := `{"method":"handshake","project_id":"default","user":"other"}`
+		if _, got := b.Exchange("/", nil, handshake, frame); got != int(code.Code) {
+			t.Errorf("%s closed with %d, expected %d", frame, got, code.Code)
+		}
+	}
+}
@@ -1,7 +1,8 @@
 package server
 
 import (
-	"os"
+	"crypto/tls"
+	"net"
 	"slices"
 	"sync"
 	"time"
@@ -13,15 +14,9 @@ import (
 	"github.com/gofiber/contrib/v3/websocket"
 	"github.com/gofiber/fiber/v3"
 	"github.com/google/uuid"
-	"github.com/rs/zerolog"
 )
 
 func New(server_config *Config, duplex_config *duplex.Config) *Server {
-	node, err := snowflake.NewNode(1)
-	if err != nil {
-		panic(err)
-	}
-
 	if server_config == nil {
 		panic("config required")
 	}
@@ -46,16 +41,55 @@ func New(server_config *Config, duplex_config *duplex.Config) *Server {
 		panic("invalid rate limit interval")
 	}
 
+	if !valid_username_policy(server_config.Username_Policy) {
+		panic("invalid username policy")
+	}
+
+	for _, policy := range server_config.Room_Username_Policies {
+		if !valid_username_policy(policy) {
+			panic("invalid room username policy")
+		}
+	}
+
 	if server_config.Address == "" {
 		server_config.Address = ":3000"
 	}
 
+	if err := validate_compression(server_config); err != nil {
+		panic(err)
+	}
+	if err := validate_timeouts(server_config); err != nil {
+		panic(err)
+	}
+
+	store, err := New_Var_Store(server_config)
+	if err != nil {
+		panic(err)
+	}
+
+	ip_limits, err := new_ip_limiter(server_config.Maximum_Clients_Per_IP, server_config.IP_Limit_Exemptions)
+	if err != nil {
+		panic(err)
+	}
+
+	var recorder *Recorder
+	if server_config.Capture_Path != "" {
+		if recorder, err = New_Recorder(server_config.Capture_Path); err != nil {
+			panic(err)
+		}
+	}
+
 	self := "bridge@" + server_config.Designation
 
 	if server_config.Standalone_Mode {
 		self += "standalone"
 	}
 
+	node, err := snowflake.NewNode(snowflake_node(server_config.Snowflake_Node, self))
+	if err != nil {
+		panic(err)
+	}
+
 	// Create bridge manager
 	server := &Server{
 		Self:               self,
@@ -65,10 +99,15 @@ func New(server_config *Config, duplex_config *duplex.Config) *Server {
 		DeltaResolverCache: make(map[*duplex.Peer]HelloArgs),
 		BridgeRegistry:     make(Registry),
 		DiscoveryRegistry:  make(Registry),
-		Config:             server_config,
-		RoomsMap:           make(map[RoomKey]*Room),
-		roomEvents:         make(chan RoomEvent),
+		rooms:              New_Room_Store(),
+		federation:         new_federation(),
 		snowflakeGen:       node,
+		write_peer:         write_peer,
+		recorder:           recorder,
+		ip_limits:          ip_limits,
+		auth:               new_authenticator(server_config),
+		Metrics:            New_Metrics(),
+		protocols:          enabled_protocols(server_config),
 		App: fiber.New(fiber.Config{
 			JSONEncoder:   json.Marshal,
 			JSONDecoder:   json.Unmarshal,
@@ -76,12 +115,40 @@ func New(server_config *Config, duplex_config *duplex.Config) *Server {
 		}),
 	}
 
-	server.Logger = server.default_logger(server_config.Log_Level)
+	server.config.Store(server_config)
+	server.rate_limits = new_rate_limiter(server.Config)
+
+	if err := validate_logging(server_config); err != nil {
+		panic(err)
+	}
+	if server.Logger, server.log_file, err = server.new_logger(server_config); err != nil {
+		panic(err)
+	}
+	server.configure_loggers(server_config)
+	if store != nil {
+		server.store = new_var_writer(store, server.Log(Subsystem_Rooms))
+	}
+	server.configure_deflaters(server_config.Compression_Level)
+	server.federation.send = server.send_to_bridges
+
+	if server_config.Require_Auth && server.auth == nil {
+		panic("Require_Auth requires an authenticator")
+	}
+
+	// Load TLS certificates
+	if server_config.TLS_Address != "" {
+		if server.certs, err = New_Cert_Store(server_config, server.Logger); err != nil {
+			panic(err)
+		}
+	} else if server_config.TLS_Only {
+		panic("TLS_Only requires a TLS address")
+	}
 
 	// Create instance
 	if !server_config.Standalone_Mode {
 		i := duplex.New(self, duplex_config)
 		i.IsBridge = true
+		i.Logger = server.Log(Subsystem_Delta)
 		server.instance = i
 	}
 
@@ -98,10 +165,17 @@ func New(server_config *Config, duplex_config *duplex.Config) *Server {
 			"active_rooms":    server.ReportActiveRooms(),
 			"discovery_count": discoveryCount,
 			"bridge_count":    bridgeCount,
+			"unique_ips":      len(server.Connections_Per_IP()),
 		})
 	})
 
-	server.App.Get("/metrics", monitor.New())
+	server.App.Get("/metrics", server.metrics_handler)
+	server.App.Get("/monitor", monitor.New())
+
+	// Configure Admin API
+	if server_config.Admin_Token != "" {
+		server.ConfigureAdmin()
+	}
 
 	// Configure CL2 / CL3 / CL4 / Scratch CloudVars Gateway
 	server.App.Use("/", func(c fiber.Ctx) error {
@@ -112,9 +186,15 @@ func New(server_config *Config, duplex_config *duplex.Config) *Server {
 		return fiber.ErrUpgradeRequired
 	})
 
-	server.App.Get("/", websocket.New(func(c *websocket.Conn) {
+	// Clients may declare their protocol in the path, e.g. /cl4/0.2.0 or /scratch
+	gateway := websocket.New(func(c *websocket.Conn) {
 		server.Run_Client(c)
-	}))
+	}, websocket.Config{
+		EnableCompression: server_config.Enable_Compression,
+		Subprotocols:      server.subprotocols(),
+	})
+	server.App.Get("/", gateway)
+	server.App.Get("/:protocol/:version?", gateway)
 
 	// Configure Delta Peer
 	if !server_config.Standalone_Mode {
@@ -124,31 +204,46 @@ func New(server_config *Config, duplex_config *duplex.Config) *Server {
 	return server
 }
 
-func (i *Server) default_logger(level zerolog.Level) *zerolog.Logger {
-	// Configure zerolog
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
-	logger := zerolog.New(output).With().Timestamp().Logger().Level(level)
-	logger = logger.With().Str("instance", i.Self).Logger()
-	return &logger
+func (s *Server) Run() {
+	var listeners []net.Listener
+
+	if !s.Config().TLS_Only {
+		ln, err := net.Listen(fiber.NetworkTCP4, s.Config().Address)
+		if err != nil {
+			s.Logger.Fatal().Msgf("Fiber app error: %v", err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if s.certs != nil {
+		ln, err := net.Listen(fiber.NetworkTCP4, s.Config().TLS_Address)
+		if err != nil {
+			s.Logger.Fatal().Msgf("Fiber app error: %v", err)
+		}
+		s.Logger.Info().Msgf("🔒 Serving TLS on %s", ln.Addr())
+		listeners = append(listeners, tls.NewListener(ln, s.certs.TLS_Config()))
+	}
+
+	s.Serve(join_listeners(listeners...))
 }
 
-func (s *Server) Run() {
+// Serve runs the bridge on an existing listener until a close signal is received.
+func (s *Server) Serve(ln net.Listener) {
+	s.listener = ln
+
 	// Init waitgroup
 	var wg sync.WaitGroup
 	wg.Add(1) // Add 1 waitgroup task for Fiber app
 
-	// Launch Room Manager
-	go s.RoomManager()
-
 	// Launch fiber app
 	go func() {
 		defer wg.Done()
-		if err := s.App.Listen(s.Config.Address); err != nil {
+		if err := s.App.Listener(ln); err != nil {
 			s.Logger.Fatal().Msgf("Fiber app error: %v", err)
 		}
 	}()
 
-	if !s.Config.Standalone_Mode {
+	if !s.Config().Standalone_Mode {
 		wg.Add(1) // Add 1 waitgroup task for instance app
 		// Launch instance app
 		go func() {
@@ -161,150 +256,27 @@ func (s *Server) Run() {
 	<-s.Close
 
 	// Shutdown components
-	_ = s.App.Shutdown()
-	if !s.Config.Standalone_Mode {
+	s.shutdown()
+	if !s.Config().Standalone_Mode {
 		s.instance.Close <- true
 		<-s.instance.Done
 	}
 
 	wg.Wait() // Wait for both apps to finish
-	s.Done <- true
-}
-
-func (s *Server) make_response(a any, e RoomEvent) {
-	s.Logger.Debug().Any("response", a).Msg("🚪 replying")
-	e.Respond <- a
-}
-
-func (s *Server) RoomManager() {
-	for event := range s.roomEvents {
-		s.Logger.Debug().Str("opcode", event.Op.String()).Any("key", event.Key).Any("value", event.Value).Msg("🚪 processing")
-
-		switch event.Op {
-		case OpJoinRoom:
-			r, exists := s.RoomsMap[event.Room]
-			if !exists {
-				s.Logger.Info().Any("client", event.Client).Any("room", event.Room).Msgf("🚪 creating")
-				r = &Room{Clients: make(Targets), GlobalVars: &sync.Map{}}
-				s.RoomsMap[event.Room] = r
-			}
-			r.Clients[event.Client] = true
-		case OpLeaveRoom:
-			if r, exists := s.RoomsMap[event.Room]; exists {
-				delete(r.Clients, event.Client)
-				if len(r.Clients) == 0 {
-					delete(s.RoomsMap, event.Room)
-					s.Logger.Info().Any("client", event.Client).Any("room", event.Room).Msgf("🚪 destroying")
-				}
-			}
-		case OpGetClients:
-			var clients BridgeClients
-			if r, exists := s.RoomsMap[event.Room]; exists {
-				clients = make(BridgeClients, 0, len(r.Clients))
-				for c := range r.Clients {
-					clients = append(clients, c)
-				}
-			}
-			s.make_response(clients, event)
-		case OpGetTargets:
-			var targets Targets
-			if r, exists := s.RoomsMap[event.Room]; exists {
-				targets = make(Targets)
-				for c := range r.Clients {
-					targets[c] = true
-				}
-			}
-			s.make_response(targets, event)
-		case OpDoesRoomExist:
-			_, exists := s.RoomsMap[event.Room]
-			s.make_response(exists, event)
-		case OpGetActiveRooms:
-			s.make_response(len(s.RoomsMap), event)
-		case OpCanAllocateNRooms:
-			active_rooms := len(s.RoomsMap)
-			decrement := 0
-			if default_room, ok := s.RoomsMap[DEFAULT_ROOM]; ok {
-				if len(default_room.Clients) == 1 && default_room.Clients[event.Client] {
-					decrement = -1
-				}
-			}
-			s.make_response(active_rooms+event.N+decrement <= int(s.Config.Maximum_Rooms), event)
-		case OpGetRoomVars:
-			if r, exists := s.RoomsMap[event.Room]; exists {
-				s.make_response(r.GlobalVars, event)
-			} else {
-				s.make_response((*sync.Map)(nil), event)
-			}
-		case OpSetRoomVar:
-			if r, exists := s.RoomsMap[event.Room]; exists {
 
-				if _, ok := r.GlobalVars.Load(event.Key); !ok {
-					s.Logger.Info().Any("client", event.Client).Any("room", event.Room).Any("gvar", event.Key).Msgf("🚪 creating")
-				}
-
-				r.GlobalVars.Store(event.Key, event.Value)
-				s.make_response(true, event)
-			} else {
-				s.make_response(false, event)
-			}
-		case OpDeleteRoomVar:
-			if r, exists := s.RoomsMap[event.Room]; exists {
-
-				if _, ok := r.GlobalVars.Load(event.Key); !ok {
-					s.Logger.Info().Any("client", event.Client).Any("room", event.Room).Any("gvar", event.Key).Msgf("🚪 deleting")
-				}
-
-				r.GlobalVars.Delete(event.Key)
-				s.make_response(true, event)
-			} else {
-				s.make_response(false, event)
-			}
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			s.Logger.Error().Msgf("⚠️  Failed to close storage: %v", err)
 		}
 	}
-}
-
-func (s *Server) DeleteRoomGlobalVar(room RoomKey, key any) bool {
-	resp := make(chan any, 1)
-	s.roomEvents <- RoomEvent{Op: OpDeleteRoomVar, Room: room, Key: key, Respond: resp}
-	val, ok := (<-resp).(bool)
-	return ok && val
-}
-
-func (s *Server) SetRoomGlobalVar(client *BridgeClient, room RoomKey, key any, value any) bool {
-	resp := make(chan any, 1)
-	s.roomEvents <- RoomEvent{Op: OpSetRoomVar, Client: client, Room: room, Key: key, Value: value, Respond: resp}
-	val, ok := (<-resp).(bool)
-	return ok && val
-}
-
-func (s *Server) GetRoomGlobalVars(room RoomKey) *sync.Map {
-	resp := make(chan any, 1)
-	s.roomEvents <- RoomEvent{Op: OpGetRoomVars, Room: room, Respond: resp}
-	res, ok := (<-resp).(*sync.Map)
-	if !ok {
-		return nil
-	}
-	return res
-}
-
-func (s *Server) Copy_Clients(room RoomKey) BridgeClients {
-	resp := make(chan any, 1)
-	s.roomEvents <- RoomEvent{Op: OpGetClients, Room: room, Respond: resp}
-	res, ok := (<-resp).(BridgeClients)
-	if !ok {
-		return nil
+	if s.certs != nil {
+		s.certs.Close()
 	}
-	return res
-}
-
-func (s *Server) Get_Targets(room RoomKey) Targets {
-	resp := make(chan any, 1)
-	s.roomEvents <- RoomEvent{Op: OpGetTargets, Room: room, Respond: resp}
-	res, ok := (<-resp).(Targets)
-	if !ok {
-		return nil
+	if err := s.recorder.Close(); err != nil {
+		s.Logger.Error().Msgf("⚠️  Failed to close capture: %v", err)
 	}
-	return res
+	s.log_file.Close()
+	s.Done <- true
 }
 
 func (c *BridgeClients) Targets() Targets {
@@ -316,22 +288,32 @@ func (c *BridgeClients) Targets() Targets {
 }
 
 func (s *Server) Unicast(c *BridgeClient, p Packet) {
-	if c == nil || c.Protocol == nil {
+	if c == nil {
+		return
+	}
+	protocol := c.GetProtocol()
+	if protocol == nil {
 		return
 	}
 
 	// Apply translation / quirks
-	patched := c.Protocol.Apply_Quirks(c, p)
+	patched := protocol.Apply_Quirks(c, p)
 	if patched == nil {
+		if c.Conn != nil {
+			s.Metrics.Quirks_Drops.Inc(protocol.Name(), Dialect_Name(c.GetDialect()), packet_command(p))
+		}
 		return
 	}
 
 	// Marshal the packet
-	msg, err := json.Marshal(patched)
+	msg, err := encode_frame(patched, c.Uses_MessagePack())
 	if err != nil {
 		s.Logger.Error().Msgf("⚠️  Failed to marshal packet: %v", err)
 		return
 	}
+	if s.deflate_allowed(c) {
+		s.prepare_deflate(&msg)
+	}
 
 	// Abort if the client somehow turned nil
 	if c.Conn == nil {
@@ -353,25 +335,38 @@ func (s *Server) Unicast(c *BridgeClient, p Packet) {
 		}
 	}()
 
-	s.safeSend(c, msg)
+	if s.send_frame(c, msg) {
+		s.Metrics.Packets_Sent.Inc(protocol.Name(), packet_command(p))
+	}
 }
 
+// Broadcast sends a packet to every member of a room, and relays it to other bridges if the room is federated.
 func (s *Server) Broadcast(room RoomKey, p Packet, exclude ...*BridgeClient) {
 	if p == nil {
 		return
 	}
+	s.federate(room, p)
+	s.broadcast(room, p, exclude...)
+}
 
-	targets := s.Get_Targets(room)
-	if len(targets) == 0 {
+// Like Broadcast, but only sends the packet to the members on this bridge.
+func (s *Server) broadcast(room RoomKey, p Packet, exclude ...*BridgeClient) {
+	r := s.rooms.get(room)
+	if r == nil {
 		return
 	}
 
-	// Filter out targets
-	for _, client := range exclude {
-		delete(targets, client)
+	// Group the members without copying them first
+	groups := make(map[groupKey][]*BridgeClient)
+	r.mux.RLock()
+	for target := range r.Clients {
+		if !slices.Contains(exclude, target) {
+			s.add_to_group(groups, target)
+		}
 	}
+	r.mux.RUnlock()
 
-	s.multicast(p, targets)
+	s.send_to_groups(p, groups)
 }
 
 func (s *Server) Multicast(p Packet, targets Targets) {
@@ -393,34 +388,54 @@ func (s *Server) multicast(p Packet, targets Targets) {
 
 	groups := make(map[groupKey][]*BridgeClient)
 	for target := range targets {
-		if target.Protocol == nil {
-			continue
-		}
-		key := groupKey{target.Protocol, target.GetDialect()}
-		groups[key] = append(groups[key], target)
+		s.add_to_group(groups, target)
 	}
+	s.send_to_groups(p, groups)
+}
+
+// Groups clients that receive the same translation and framing of a packet. Delta peers are translated
+// individually, since their translation is what delivers the packet.
+func (s *Server) add_to_group(groups map[groupKey][]*BridgeClient, target *BridgeClient) {
+	protocol := target.GetProtocol()
+	if protocol == nil {
+		return
+	}
+	key := groupKey{protocol.Name(), target.GetDialect(), target.Uses_MessagePack(), s.deflate_allowed(target), nil}
+	if target.Conn == nil {
+		key.client = target
+	}
+	groups[key] = append(groups[key], target)
+}
 
+// Translates a packet once for each group, and queues it for every client of the group.
+func (s *Server) send_to_groups(p Packet, groups map[groupKey][]*BridgeClient) {
 	for key, g_targets := range groups {
-		var representative *BridgeClient
-		if len(g_targets) > 0 {
-			representative = g_targets[0]
-		}
+		representative := g_targets[0]
+		protocol := representative.GetProtocol()
 
-		patched := key.proto.Apply_Quirks(representative, p)
+		patched := protocol.Apply_Quirks(representative, p)
 		if patched == nil {
+			if representative.Conn != nil {
+				s.Metrics.Quirks_Drops.Add(uint64(len(g_targets)), key.protocol, Dialect_Name(key.dialect), packet_command(p))
+			}
 			continue
 		}
 
-		msg, err := json.Marshal(patched)
+		msg, err := encode_frame(patched, key.binary)
 		if err != nil {
 			s.Logger.Error().Msgf("⚠️  Failed to marshal packet: %v", err)
 			continue
 		}
+		if key.deflate {
+			s.prepare_deflate(&msg)
+		}
 		for _, target := range g_targets {
 			if target == nil || target.Conn == nil {
 				continue
 			}
-			s.safeSend(target, msg)
+			if s.send_frame(target, msg) {
+				s.Metrics.Packets_Sent.Inc(key.protocol, packet_command(p))
+			}
 		}
 	}
 }
@@ -441,12 +456,64 @@ func (s *Server) Run_Client(c *websocket.Conn) {
 		return
 	}
 
+	// Abort the connection if the origin isn't allowed to connect, or to join the default room.
+	origin := c.Headers(fiber.HeaderOrigin)
+	if !s.Origin_Allowed(origin, DEFAULT_ROOM) {
+		s.Logger.Warn().Str("origin", origin).Msg("⚠️  Refused connection from a disallowed origin.")
+		s.Respond_With_Code(c, Security_Error)
+		c.Close()
+		return
+	}
+
+	// Abort connection if the source IP has too many connections
+	ip := c.IP()
+	if !s.ip_limits.acquire(ip) {
+		s.Logger.Warn().Str("ip", ip).Msg("⚠️  Refused connection: Too many connections from the same address.")
+		s.Metrics.IP_Limit_Hits.Inc()
+		c.WriteMessage(websocket.TextMessage, []byte("Too many connections from your address. Please try again later."))
+		s.Respond_With_Code(c, Overloaded_Status)
+		c.Close()
+		return
+	}
+	defer func() {
+		if s.ip_limits.release(ip) == 0 {
+			s.rate_limits.forget(ip)
+		}
+	}()
+
+	// Verify the token that the client presented, if any
+	var identity *Identity
+	if s.auth != nil {
+		token := c.Query(s.auth_token_name())
+		if token == "" {
+			token = c.Cookies(s.auth_token_name())
+		}
+		if token != "" {
+			var err error
+			if identity, err = s.auth.Authenticate(token); err != nil {
+				s.Logger.Warn().Msgf("⚠️  Refused connection: Authentication failed: %v", err)
+				s.Respond_With_Code(c, Identity_Error)
+				c.Close()
+				return
+			}
+		}
+	}
+
+	// Abort the connection if the client declared a protocol that it can't use
+	declaration, err := s.declared_protocol(c)
+	if err != nil {
+		s.Logger.Warn().Msgf("⚠️  Refused connection: %v", err)
+		s.Respond_With_Message_And_Code(c, Protocol_Detection_Failure, []byte("The protocol that your client declared is not supported by this server."))
+		c.Close()
+		return
+	}
+
 	// Abort connection if the server is overloaded
 	s.classicclientsmu.RLock()
 	count := len(s.ClassicClients)
 	s.classicclientsmu.RUnlock()
 
-	if count >= int(s.Config.Maximum_Clients) {
+	if count >= int(s.Config().Maximum_Clients) {
 		c.WriteMessage(websocket.TextMessage, []byte("This server is currently full. Please try again later."))
 		s.Respond_With_Code(c, Overloaded_Status)
 		c.Close()
@@ -454,25 +521,52 @@ func (s *Server) Run_Client(c *websocket.Conn) {
 	}
 
 	client := &BridgeClient{
-		Conn:   c,
-		ID:     s.snowflakeGen.Generate().String(),
-		UUID:   uuid.New().String(),
-		writer: make(chan []byte, 256),
-		exit:   make(chan bool, 1),
-		Rooms:  make(RoomKeys, 0),
-		Server: s,
-	}
-
+		Conn:     c,
+		ID:       s.snowflakeGen.Generate().String(),
+		UUID:     uuid.New().String(),
+		writer:   make(chan frame, 256),
+		exit:     make(chan bool, 1),
+		closing:  make(chan time.Time, 1),
+		Rooms:    make(RoomKeys, 0),
+		Server:   s,
+		origin:   origin,
+		identity: identity,
+		ip:       ip,
+		deflate:  s.Config().Enable_Compression && offers_deflate(c.Headers("Sec-WebSocket-Extensions")),
+	}
+	if client.deflate {
+		c.SetCompressionLevel(s.Config().Compression_Level)
+	}
+	client.bucket = new_token_bucket(s.Config().Rate_Limit_Burst, s.Config().Rate_Limit_Interval)
+	if declaration != nil {
+		s.pin_protocol(client, declaration)
+	}
+
+	// Abort the connection if the server is shutting down
 	s.classicclientsmu.Lock()
+	if s.shutting_down {
+		s.classicclientsmu.Unlock()
+		s.Respond_With_Code(c, Unavailable_Status)
+		c.Close()
+		return
+	}
 	s.ClassicClients[client] = true
 	s.classicclientsmu.Unlock()
 
+	s.recorder.Record(client, Capture_Open, nil)
 	s.Subscribe(client, DEFAULT_ROOM)
 
 	go s.ReportActiveConnections(false)
 
+	if timer := s.start_handshake_timer(client); timer != nil {
+		defer timer.Stop()
+	}
+
+	// The connection is released once this returns, so wait for the writer to stop using it
+	var writer sync.WaitGroup
+	defer writer.Wait()
 	defer s.Destroy_Client(client)
-	go client.Writer()
+	writer.Go(client.Writer)
 	client.Reader()
 }
 
@@ -496,14 +590,20 @@ func (s *Server) Destroy_Client(c *BridgeClient) {
 
 	// 3. NOW fire the protocol disconnect handlers.
 	// Because the client is purged, any Get_User_List calls will correctly exclude them!
-	if c.Protocol != nil {
-		c.Protocol.On_Disconnect(c, roomsToLeave)
+	if protocol := c.GetProtocol(); protocol != nil {
+		protocol.On_Disconnect(c, roomsToLeave)
 	}
 
 	s.classicclientsmu.Lock()
 	delete(s.ClassicClients, c)
 	s.classicclientsmu.Unlock()
 
+	s.recorder.Record(c, Capture_Close, nil)
+
+	if drops := c.GetDrops(); drops > 0 {
+		s.Logger.Info().Uint64("drops", drops).Msgf("%s Dropped %d packets for this client.", c.GiveName(), drops)
+	}
+
 	select {
 	case c.exit <- true:
 	default:
@@ -515,37 +615,40 @@ func (s *Server) Destroy_Client(c *BridgeClient) {
 	s.ReportActiveConnections(false)
 }
 
-func (s *Server) safeSend(c *BridgeClient, msg []byte) {
+// Queues a text frame for a client.
+func (s *Server) safeSend(c *BridgeClient, msg []byte) (sent bool) {
+	return s.send_frame(c, frame{data: msg})
+}
+
+func (s *Server) send_frame(c *BridgeClient, msg frame) (sent bool) {
 	defer func() {
 		recover() // Ignore panics from sending to a closed channel
 	}()
 
 	select {
 	case c.writer <- msg:
+		c.note_send()
+		if msg.deflate {
+			protocol := client_protocol(c)
+			s.Metrics.Compression_Input.Add(uint64(len(msg.data)), protocol)
+			s.Metrics.Compression_Output.Add(uint64(msg.deflated_size), protocol)
+		}
+		return true
 	default:
 		// Channel full, drop packet (standard for WebSockets/Real-time)
+		s.note_send_drop(c)
+		return false
 	}
 }
 
-func (s *Server) DoesRoomExist(room RoomKey) bool {
-	resp := make(chan any, 1)
-	s.roomEvents <- RoomEvent{Op: OpDoesRoomExist, Room: room, Respond: resp}
-	val, ok := (<-resp).(bool)
-	return ok && val
-}
-
+// Subscribe adds a client to a room, regardless of its access rules. See Join_Rooms.
 func (s *Server) Subscribe(client *BridgeClient, room RoomKey) {
-	s.roomEvents <- RoomEvent{Op: OpJoinRoom, Client: client, Room: room}
-
-	client.room_mux.Lock()
-	defer client.room_mux.Unlock()
-	if !slices.Contains(client.Rooms, room) {
-		client.Rooms = append(client.Rooms, room)
-	}
+	s.join_room(client, room, nil)
+	client.track_room(room)
 }
 
 func (s *Server) Unsubscribe(client *BridgeClient, room RoomKey) {
-	s.roomEvents <- RoomEvent{Op: OpLeaveRoom, Client: client, Room: room}
+	s.leave_room(client, room)
 
 	client.room_mux.Lock()
 	defer client.room_mux.Unlock()
@@ -563,16 +666,6 @@ func (*Server) Respond_With_Code(c *websocket.Conn, code SocketCodes) error {
 	return c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(int(code.Code), code.Message), time.Now().Add(time.Second))
 }
 
-func (s *Server) ReportActiveRooms() int {
-	resp := make(chan any, 1)
-	s.roomEvents <- RoomEvent{Op: OpGetActiveRooms, Respond: resp}
-	val, ok := (<-resp).(int)
-	if !ok {
-		return 0
-	}
-	return val
-}
-
 func (s *Server) ReportActiveConnections(silent bool) int {
 	s.classicclientsmu.RLock()
 	active_connections := len(s.ClassicClients)
@@ -582,14 +675,3 @@ func (s *Server) ReportActiveConnections(silent bool) int {
 	}
 	return active_connections
 }
-
-// CanAllocateNRooms checks if the current room count + n doesn't exceed the limit.
-// Decreases the projected total by 1 if the client is the only connected peer in the default room.
-// This function assumes that if granted, the client joins the n allocated rooms
-// and frees the default room from memory.
-func (s *Server) CanAllocateNRooms(c *BridgeClient, n int) bool {
-	resp := make(chan any, 1)
-	s.roomEvents <- RoomEvent{Op: OpCanAllocateNRooms, Client: c, N: n, Respond: resp}
-	val, ok := (<-resp).(bool)
-	return ok && val
-}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudlink-delta/duplex"
+)
+
+// Used when Config.Shutdown_Timeout is zero.
+const Default_Shutdown_Timeout = 10 * time.Second
+
+// Opcode sent to Delta peers when the bridge shuts down. The payload is the shutdown message.
+const Delta_Shutdown_Opcode = "SHUTDOWN"
+
+// Shuts the bridge down gracefully. New connections are refused, every classic client is sent the shutdown
+// message and closed with Unavailable_Status once its queued packets are written, and Delta peers are notified.
+// Clients that are still connected when the shutdown timeout runs out are disconnected abruptly.
+func (s *Server) shutdown() {
+	timeout := s.Config().Shutdown_Timeout
+	if timeout <= 0 {
+		timeout = Default_Shutdown_Timeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	// Stop accepting connections
+	s.classicclientsmu.Lock()
+	s.shutting_down = true
+	clients := make(BridgeClients, 0, len(s.ClassicClients))
+	for client := range s.ClassicClients {
+		clients = append(clients, client)
+	}
+	s.classicclientsmu.Unlock()
+
+	if err := s.App.ShutdownWithTimeout(time.Until(deadline)); err != nil {
+		s.Logger.Error().Msgf("⚠️  Failed to stop listening: %v", err)
+	}
+
+	// The app may not have started listening yet, in which case it would start after shutting down
+	s.listener.Close()
+
+	s.Logger.Info().Msgf("👋 Shutting down, disconnecting %d clients...", len(clients))
+
+	// Say goodbye, and ask every writer to flush its queue and close the connection
+	for _, client := range clients {
+		if s.Config().Shutdown_Message != "" {
+			s.safeSend(client, []byte(s.Config().Shutdown_Message))
+		}
+		select {
+		case client.closing <- deadline:
+		default:
+		}
+	}
+
+	if !s.Config().Standalone_Mode {
+		s.notify_delta_peers(deadline)
+	}
+
+	// Wait for the clients to disconnect
+	for time.Now().Before(deadline) && s.count_classic_clients() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.classicclientsmu.RLock()
+	remaining := make(BridgeClients, 0, len(s.ClassicClients))
+	for client := range s.ClassicClients {
+		remaining = append(remaining, client)
+	}
+	s.classicclientsmu.RUnlock()
+
+	if len(remaining) > 0 {
+		s.Logger.Warn().Msgf("⚠️  %d clients didn't disconnect in time, closing them.", len(remaining))
+	}
+	for _, client := range remaining {
+		client.Conn.Close()
+	}
+}
+
+func (s *Server) count_classic_clients() int {
+	s.classicclientsmu.RLock()
+	defer s.classicclientsmu.RUnlock()
+	return len(s.ClassicClients)
+}
+
+// Sends the shutdown message to every known Delta peer, waiting at most until the deadline.
+func (s *Server) notify_delta_peers(deadline time.Time) {
+	peers := make(map[*duplex.Peer]bool)
+
+	s.deltaclientsmu.RLock()
+	for peer := range s.DeltaResolverCache {
+		peers[peer] = true
+	}
+	s.deltaclientsmu.RUnlock()
+
+	s.registry_mux.RLock()
+	for _, peer := range s.BridgeRegistry {
+		peers[peer] = true
+	}
+	for _, peer := range s.DiscoveryRegistry {
+		peers[peer] = true
+	}
+	s.registry_mux.RUnlock()
+
+	var wg sync.WaitGroup
+	for peer := range peers {
+		wg.Go(func() {
+			peer.WriteBlocking(&duplex.TxPacket{
+				Packet: duplex.Packet{
+					Opcode: Delta_Shutdown_Opcode,
+					TTL:    1,
+				},
+				Payload: s.Config().Shutdown_Message,
+			})
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		s.Logger.Warn().Msg("⚠️  Timed out notifying Delta peers of the shutdown.")
+	}
+}
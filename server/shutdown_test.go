@@ -0,0 +1,44 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	config := New_Test_Config()
+	config.Shutdown_Message = "The server is restarting."
+	config.Shutdown_Timeout = 2 * time.Second
+	b := Start_Test_Bridge(t, config)
+
+	a := b.Connect("a")
+	a.Send(`{"cmd":"handshake","listener":"hello"}`)
+	b.Settle()
+	a.Drain()
+
+	stopped := make(chan struct{})
+	go func() {
+		b.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(config.Shutdown_Timeout):
+		t.Fatal("shutdown didn't finish before its timeout")
+	}
+	<-a.done
+
+	frames := a.Drain()
+	want := []string{config.Shutdown_Message, "close 4004 " + Unavailable_Status.Message}
+	if !slices.Equal(frames, want) {
+		t.Errorf("client received %q, expected %q", frames, want)
+	}
+
+	if _, _, err := websocket.DefaultDialer.Dial("ws://"+b.Address+"/", nil); err == nil {
+		t.Error("bridge still accepts connections after shutting down")
+	}
+}
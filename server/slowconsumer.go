@@ -0,0 +1,52 @@
+package server
+
+import (
+	"time"
+)
+
+// Records a packet that was dropped because a client's writer queue was full, and evicts the client with
+// Slow_Consumer if it keeps falling behind. Evicted clients are expected to reconnect and resynchronize.
+func (s *Server) note_send_drop(c *BridgeClient) {
+	s.Metrics.Send_Drops.Inc(client_protocol(c))
+
+	drops := c.drops.Add(1)
+	now := time.Now().UnixNano()
+	if c.full_since.CompareAndSwap(0, now) {
+		s.Logger.Warn().Uint64("drops", drops).Msgf("%s ⚠️  Writer queue is full, dropping packets...", c.GiveName())
+	}
+	stalled := time.Duration(now - c.full_since.Load())
+
+	too_many := s.Config().Slow_Consumer_Max_Drops > 0 && drops >= s.Config().Slow_Consumer_Max_Drops
+	too_long := s.Config().Slow_Consumer_Timeout > 0 && stalled >= s.Config().Slow_Consumer_Timeout
+	if !too_many && !too_long {
+		return
+	}
+
+	// Only evict once, as many senders may be dropping packets at the same time
+	if !c.evicted.CompareAndSwap(false, true) {
+		return
+	}
+
+	s.Metrics.Slow_Consumer_Evictions.Inc(client_protocol(c))
+	s.Logger.Error().Uint64("drops", drops).Dur("stalled", stalled).Msgf("%s ⚠️  Aborting connection to client: Too slow to keep up.", c.GiveName())
+
+	// Closing the connection may block for a while, don't hold up the sender
+	go s.Evict_Client(c, Slow_Consumer)
+}
+
+// Clears the stall timer of a client once its writer queue has drained to half its capacity.
+func (c *BridgeClient) note_send() {
+	if c.full_since.Load() != 0 && len(c.writer) <= cap(c.writer)/2 {
+		c.full_since.Store(0)
+	}
+}
+
+// Returns the number of packets dropped because the client's writer queue was full.
+func (c *BridgeClient) GetDrops() uint64 {
+	return c.drops.Load()
+}
+
+// Reports whether the client's writer queue is currently full.
+func (c *BridgeClient) Is_Stalled() bool {
+	return c.full_since.Load() != 0
+}
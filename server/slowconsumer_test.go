@@ -0,0 +1,70 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func stalled_client(queue int) *BridgeClient {
+	return &BridgeClient{writer: make(chan frame, queue), exit: make(chan bool, 1)}
+}
+
+func TestSlowConsumerMaxDrops(t *testing.T) {
+	config := New_Test_Config()
+	config.Slow_Consumer_Max_Drops = 3
+	b := Start_Test_Bridge(t, config)
+
+	c := stalled_client(2)
+	for range 4 {
+		b.safeSend(c, []byte("packet"))
+	}
+	if drops := c.GetDrops(); drops != 2 {
+		t.Fatalf("client has %d drops, expected 2", drops)
+	}
+	if !c.Is_Stalled() || c.evicted.Load() {
+		t.Fatal("client should be stalled, but not evicted yet")
+	}
+
+	b.safeSend(c, []byte("packet"))
+	b.safeSend(c, []byte("packet"))
+	if !c.evicted.Load() {
+		t.Fatal("client wasn't evicted after reaching the drop limit")
+	}
+
+	var sb strings.Builder
+	b.Write_Metrics(&sb)
+	if !strings.Contains(sb.String(), `bridge_slow_consumer_evictions_total{protocol="undetected"} 1`) {
+		t.Errorf("eviction missing from metrics:\n%s", sb.String())
+	}
+}
+
+func TestSlowConsumerTimeout(t *testing.T) {
+	config := New_Test_Config()
+	config.Slow_Consumer_Timeout = 50 * time.Millisecond
+	b := Start_Test_Bridge(t, config)
+
+	c := stalled_client(2)
+	for range 3 {
+		b.safeSend(c, []byte("packet"))
+	}
+
+	// Draining the queue resets the stall timer
+	<-c.writer
+	<-c.writer
+	b.safeSend(c, []byte("packet"))
+	if c.Is_Stalled() {
+		t.Fatal("client is still stalled after its queue drained")
+	}
+
+	b.safeSend(c, []byte("packet"))
+	b.safeSend(c, []byte("packet"))
+	time.Sleep(60 * time.Millisecond)
+	if c.evicted.Load() {
+		t.Fatal("client was evicted before the queue was full for long enough")
+	}
+	b.safeSend(c, []byte("packet"))
+	if !c.evicted.Load() {
+		t.Fatal("client wasn't evicted after its queue was full for too long")
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+	bolt "go.etcd.io/bbolt"
+)
+
+// VarStore is a pluggable backend that persists room global variables beyond the lifetime of a room.
+// Rooms are rehydrated from the store when they are created, and every gvar write is mirrored to it in the
+// background by a var_writer.
+type VarStore interface {
+
+	// Returns every persisted global variable for a room. A room with no saved state returns an empty map.
+	Load(room RoomKey) (map[string]any, error)
+
+	// Creates or overwrites a single global variable.
+	Store(room RoomKey, key string, value any) error
+
+	// Removes a single global variable. Deleting a missing key is not an error.
+	Delete(room RoomKey, key string) error
+
+	// Flushes and releases the backend.
+	Close() error
+}
+
+// Var_Change is a pending change to a persisted global variable.
+type Var_Change struct {
+	Room   RoomKey
+	Key    string
+	Value  any
+	Delete bool
+}
+
+// VarBatcher may be implemented by a VarStore that can apply several changes in a single transaction.
+// Otherwise, changes are applied one at a time with Store and Delete.
+type VarBatcher interface {
+	Apply(changes []Var_Change) error
+}
+
+// Creates the storage backend selected by the configuration. Returns nil if persistence is disabled.
+func New_Var_Store(config *Config) (VarStore, error) {
+	if config.Storage != nil {
+		return config.Storage, nil
+	}
+
+	switch config.Storage_Driver {
+	case "", "memory":
+		return nil, nil
+	case "bolt":
+		if config.Storage_Path == "" {
+			return nil, fmt.Errorf("storage driver %q requires a storage path", config.Storage_Driver)
+		}
+		return New_Bolt_Store(config.Storage_Path)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", config.Storage_Driver)
+	}
+}
+
+// BoltVarStore is an embedded on-disk VarStore. Each room is kept in its own bucket, and values are stored as JSON.
+type BoltVarStore struct {
+	db *bolt.DB
+}
+
+func New_Bolt_Store(path string) (VarStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltVarStore{db: db}, nil
+}
+
+// Bucket names cannot be empty, so every room bucket is prefixed.
+func (BoltVarStore) bucket(room RoomKey) []byte {
+	return []byte("room:" + string(room))
+}
+
+func (b *BoltVarStore) Load(room RoomKey) (map[string]any, error) {
+	vars := make(map[string]any)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket(room))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var value any
+			if err := json.Unmarshal(v, &value); err != nil {
+				return err
+			}
+			vars[string(k)] = value
+			return nil
+		})
+	})
+	return vars, err
+}
+
+func (b *BoltVarStore) Store(room RoomKey, key string, value any) error {
+	return b.Apply([]Var_Change{{Room: room, Key: key, Value: value}})
+}
+
+func (b *BoltVarStore) Delete(room RoomKey, key string) error {
+	return b.Apply([]Var_Change{{Room: room, Key: key, Delete: true}})
+}
+
+// Apply writes every change in a single transaction, and so with a single fsync.
+func (b *BoltVarStore) Apply(changes []Var_Change) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		emptied := make(map[RoomKey]bool)
+		for _, change := range changes {
+			if change.Delete {
+				bucket := tx.Bucket(b.bucket(change.Room))
+				if bucket == nil {
+					continue
+				}
+				if err := bucket.Delete([]byte(change.Key)); err != nil {
+					return err
+				}
+				emptied[change.Room] = true
+				continue
+			}
+
+			data, err := json.Marshal(change.Value)
+			if err != nil {
+				return err
+			}
+			bucket, err := tx.CreateBucketIfNotExists(b.bucket(change.Room))
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(change.Key), data); err != nil {
+				return err
+			}
+		}
+
+		// Don't leave empty rooms behind
+		for room := range emptied {
+			if bucket := tx.Bucket(b.bucket(room)); bucket != nil {
+				if k, _ := bucket.Cursor().First(); k == nil {
+					if err := tx.DeleteBucket(b.bucket(room)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltVarStore) Close() error {
+	return b.db.Close()
+}
+
+type var_ref struct {
+	room RoomKey
+	key  string
+}
+
+// var_writer persists changes to global variables in the background, so that clients never wait on the disk.
+// Changes are queued by room and key, so a variable that changes again before it is written is only written
+// once, with its latest value. Everything that is queued while a batch is written goes into the next batch.
+type var_writer struct {
+	store   VarStore
+	logger  *zerolog.Logger
+	mux     sync.Mutex // Guards pending
+	pending map[var_ref]Var_Change
+	flush   sync.Mutex // Held while a batch is written, so that loads see either the store or the queue
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func new_var_writer(store VarStore, logger *zerolog.Logger) *var_writer {
+	w := &var_writer{
+		store:   store,
+		logger:  logger,
+		pending: make(map[var_ref]Var_Change),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Queues a change, replacing any change to the same variable that hasn't been written yet.
+func (w *var_writer) queue(changes ...Var_Change) {
+	w.mux.Lock()
+	for _, change := range changes {
+		w.pending[var_ref{change.Room, change.Key}] = change
+	}
+	w.mux.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *var_writer) Store(room RoomKey, key string, value any) {
+	w.queue(Var_Change{Room: room, Key: key, Value: value})
+}
+
+func (w *var_writer) Delete(room RoomKey, key string) {
+	w.queue(Var_Change{Room: room, Key: key, Delete: true})
+}
+
+// Rename queues a variable under its new name and its removal from the old one. Both changes are written in the
+// same batch, so a VarBatcher persists them in a single transaction.
+func (w *var_writer) Rename(room RoomKey, key string, new_key string, value any) {
+	w.queue(Var_Change{Room: room, Key: new_key, Value: value}, Var_Change{Room: room, Key: key, Delete: true})
+}
+
+// Load returns the persisted global variables of a room, including the changes that are still queued.
+func (w *var_writer) Load(room RoomKey) (map[string]any, error) {
+	w.flush.Lock()
+	defer w.flush.Unlock()
+
+	vars, err := w.store.Load(room)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	for ref, change := range w.pending {
+		if ref.room != room {
+			continue
+		}
+		if change.Delete {
+			delete(vars, ref.key)
+		} else {
+			vars[ref.key] = change.Value
+		}
+	}
+	return vars, nil
+}
+
+func (w *var_writer) run() {
+	defer close(w.stopped)
+	for {
+		select {
+		case <-w.wake:
+			w.write()
+		case <-w.done:
+			w.write()
+			return
+		}
+	}
+}
+
+// Writes every queued change.
+func (w *var_writer) write() {
+	w.flush.Lock()
+	defer w.flush.Unlock()
+
+	w.mux.Lock()
+	if len(w.pending) == 0 {
+		w.mux.Unlock()
+		return
+	}
+	changes := make([]Var_Change, 0, len(w.pending))
+	for _, change := range w.pending {
+		changes = append(changes, change)
+	}
+	w.pending = make(map[var_ref]Var_Change)
+	w.mux.Unlock()
+
+	if batcher, ok := w.store.(VarBatcher); ok {
+		if err := batcher.Apply(changes); err != nil {
+			w.logger.Error().Msgf("⚠️  Failed to persist %d global variable change(s): %v", len(changes), err)
+		}
+		return
+	}
+	for _, change := range changes {
+		var err error
+		if change.Delete {
+			err = w.store.Delete(change.Room, change.Key)
+		} else {
+			err = w.store.Store(change.Room, change.Key, change.Value)
+		}
+		if err != nil {
+			w.logger.Error().Any("room", change.Room).Any("gvar", change.Key).Msgf("⚠️  Failed to persist global variable: %v", err)
+		}
+	}
+}
+
+// Close writes the remaining changes, then closes the store.
+func (w *var_writer) Close() error {
+	close(w.done)
+	<-w.stopped
+	return w.store.Close()
+}
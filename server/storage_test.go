@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// counting_store is a VarStore in memory that counts its writes.
+type counting_store struct {
+	vars   map[RoomKey]map[string]any
+	writes int
+}
+
+func (c *counting_store) Load(room RoomKey) (map[string]any, error) {
+	vars := make(map[string]any)
+	for k, v := range c.vars[room] {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+func (c *counting_store) Store(room RoomKey, key string, value any) error {
+	if c.vars[room] == nil {
+		c.vars[room] = make(map[string]any)
+	}
+	c.vars[room][key] = value
+	c.writes++
+	return nil
+}
+
+func (c *counting_store) Delete(room RoomKey, key string) error {
+	delete(c.vars[room], key)
+	c.writes++
+	return nil
+}
+
+func (c *counting_store) Close() error {
+	return nil
+}
+
+func TestVarWriter(t *testing.T) {
+	store := &counting_store{vars: map[RoomKey]map[string]any{"room": {"kept": 1, "gone": 2}}}
+	logger := zerolog.Nop()
+
+	// The writer isn't started, so that changes stay queued until they are written by hand
+	w := &var_writer{store: store, logger: &logger, pending: make(map[var_ref]Var_Change), wake: make(chan struct{}, 1)}
+	for i := range 100 {
+		w.Store("room", "score", i)
+	}
+	w.Delete("room", "gone")
+
+	vars, err := w.Load("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(vars) != "map[kept:1 score:99]" {
+		t.Errorf("loaded %v, expected the queued changes to be applied", vars)
+	}
+	if store.writes != 0 {
+		t.Errorf("%d writes before the queue was written", store.writes)
+	}
+
+	w.write()
+	if fmt.Sprint(store.vars["room"]) != "map[kept:1 score:99]" {
+		t.Errorf("persisted %v", store.vars["room"])
+	}
+	if store.writes != 2 {
+		t.Errorf("%d writes for 2 changed variables, expected them to be coalesced", store.writes)
+	}
+}
+
+// batching_store is a counting_store that also counts the batches it applies.
+type batching_store struct {
+	counting_store
+	batches [][]Var_Change
+}
+
+func (b *batching_store) Apply(changes []Var_Change) error {
+	b.batches = append(b.batches, changes)
+	return nil
+}
+
+// Renaming a variable deletes the old name and stores the new one in the same batch.
+func TestRenamePersistence(t *testing.T) {
+	s := New(New_Test_Config(), nil)
+	store := &batching_store{counting_store: counting_store{vars: make(map[RoomKey]map[string]any)}}
+	s.store = &var_writer{store: store, logger: s.Logger, pending: make(map[var_ref]Var_Change), wake: make(chan struct{}, 1)}
+
+	c := detached_client(s, 1)
+	s.Subscribe(c, "room")
+	s.SetRoomGlobalVar(c, "room", "old", 1)
+	s.store.write()
+
+	if !s.RenameRoomGlobalVar(c, "room", "old", "new") {
+		t.Fatal("the variable wasn't renamed")
+	}
+	if _, ok := s.GetRoomGlobalVars("room").Load("old"); ok {
+		t.Error("the variable is still under its old name")
+	}
+	s.store.write()
+	if len(store.batches) != 2 || len(store.batches[1]) != 2 {
+		t.Fatalf("persisted %v, expected the rename in one batch", store.batches)
+	}
+	for _, change := range store.batches[1] {
+		if change.Key == "old" && !change.Delete || change.Key == "new" && change.Value != 1 {
+			t.Errorf("unexpected change %+v", change)
+		}
+	}
+}
+
+func TestBoltVarStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vars.db")
+	store, err := New_Bolt_Store(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.(VarBatcher).Apply([]Var_Change{
+		{Room: "a", Key: "score", Value: 1},
+		{Room: "a", Key: "name", Value: "x"},
+		{Room: "b", Key: "gone", Value: true},
+		{Room: "a", Key: "name", Delete: true},
+		{Room: "b", Key: "gone", Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store, err = New_Bolt_Store(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for room, expected := range map[RoomKey]string{"a": "map[score:1]", "b": "map[]"} {
+		vars, err := store.Load(room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(vars) != expected {
+			t.Errorf("room %s has %v after reopening, expected %s", room, vars, expected)
+		}
+	}
+}
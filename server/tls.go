@@ -0,0 +1,259 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+)
+
+// How long to wait for writes to settle after a certificate file changes before reloading it.
+const cert_reload_delay = 500 * time.Millisecond
+
+// Cert_Store serves the certificates of the TLS listener. Certificates are reloaded when their files change
+// on disk or when Reload is called, without affecting connections that are already established.
+type Cert_Store struct {
+	cert_file string
+	key_file  string
+	dir       string
+	logger    *zerolog.Logger
+	certs     atomic.Pointer[[]tls.Certificate]
+	watcher   *fsnotify.Watcher
+}
+
+// Loads the certificates selected by the configuration and starts watching them for changes.
+// Either TLS_Cert_File and TLS_Key_File, or TLS_Cert_Dir must be set.
+func New_Cert_Store(config *Config, logger *zerolog.Logger) (*Cert_Store, error) {
+	cs := &Cert_Store{
+		cert_file: config.TLS_Cert_File,
+		key_file:  config.TLS_Key_File,
+		dir:       config.TLS_Cert_Dir,
+		logger:    logger,
+	}
+
+	var watched []string
+	switch {
+	case cs.dir != "":
+		watched = []string{cs.dir}
+	case cs.cert_file != "" && cs.key_file != "":
+		watched = []string{filepath.Dir(cs.cert_file), filepath.Dir(cs.key_file)}
+	default:
+		return nil, errors.New("TLS requires either a certificate and key file, or a certificate directory")
+	}
+
+	if err := cs.Reload(); err != nil {
+		return nil, err
+	}
+
+	// Watch the directories rather than the files, so that atomic replacements are noticed too.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range watched {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	cs.watcher = watcher
+	go cs.watch()
+
+	return cs, nil
+}
+
+// Reload reads every certificate from disk again. The previous certificates are kept if loading fails.
+func (cs *Cert_Store) Reload() error {
+	var certs []tls.Certificate
+	var err error
+
+	if cs.dir != "" {
+		certs, err = load_cert_dir(cs.dir)
+	} else {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(cs.cert_file, cs.key_file); err == nil {
+			certs = []tls.Certificate{cert}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	cs.certs.Store(&certs)
+	return nil
+}
+
+// Loads every certificate in a directory that has a key with the same name, e.g. example.com.crt and example.com.key.
+func load_cert_dir(dir string) ([]tls.Certificate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []tls.Certificate
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+
+		key_file := filepath.Join(dir, strings.TrimSuffix(name, ext)+".key")
+		if _, err := os.Stat(key_file); err != nil {
+			continue
+		}
+
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, name), key_file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates with matching keys found in %s", dir)
+	}
+	return certs, nil
+}
+
+// GetCertificate picks the certificate that matches the server name requested by a client,
+// falling back to the first certificate.
+func (cs *Cert_Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *cs.certs.Load()
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
+
+func (cs *Cert_Store) TLS_Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+		GetCertificate: cs.GetCertificate,
+	}
+}
+
+func (cs *Cert_Store) watch() {
+	var pending <-chan time.Time
+	for {
+		select {
+		case _, ok := <-cs.watcher.Events:
+			if !ok {
+				return
+			}
+			pending = time.After(cert_reload_delay)
+
+		case err, ok := <-cs.watcher.Errors:
+			if !ok {
+				return
+			}
+			cs.logger.Warn().Msgf("⚠️  Certificate watcher error: %v", err)
+
+		case <-pending:
+			pending = nil
+			if err := cs.Reload(); err != nil {
+				cs.logger.Error().Msgf("⚠️  Failed to reload certificates, keeping the previous ones: %v", err)
+			} else {
+				cs.logger.Info().Msg("🔒 Reloaded certificates")
+			}
+		}
+	}
+}
+
+func (cs *Cert_Store) Close() error {
+	return cs.watcher.Close()
+}
+
+// Reload_Certificates reloads the certificates of the TLS listener, if there is one.
+func (s *Server) Reload_Certificates() error {
+	if s.certs == nil {
+		return nil
+	}
+	if err := s.certs.Reload(); err != nil {
+		return err
+	}
+	s.Logger.Info().Msg("🔒 Reloaded certificates")
+	return nil
+}
+
+// multi_listener accepts connections from several listeners at once, so that a single app can serve
+// plain and TLS connections side by side.
+type multi_listener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	once      sync.Once
+}
+
+// Combines listeners into one. A single listener is returned as-is.
+func join_listeners(listeners ...net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+
+	ml := &multi_listener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+		closed:    make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go ml.accept(ln)
+	}
+	return ml
+}
+
+func (ml *multi_listener) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			ml.errs <- err
+			return
+		}
+		select {
+		case ml.conns <- conn:
+		case <-ml.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (ml *multi_listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.conns:
+		return conn, nil
+	case err := <-ml.errs:
+		return nil, err
+	case <-ml.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *multi_listener) Close() error {
+	var errs []error
+	ml.once.Do(func() {
+		close(ml.closed)
+		for _, ln := range ml.listeners {
+			errs = append(errs, ln.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func (ml *multi_listener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
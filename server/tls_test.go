@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// Writes a self-signed certificate for localhost and returns its serial number.
+func write_test_cert(t *testing.T, dir string, name string) *big.Int {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write to temporary files first, so the watcher never sees a half-written pair
+	cert_pem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key_pem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der})
+	for file, data := range map[string][]byte{name + ".crt": cert_pem, name + ".key": key_pem} {
+		tmp := filepath.Join(t.TempDir(), file)
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return serial
+}
+
+// Returns the serial number of the certificate presented by a TLS connection.
+func peer_serial(t *testing.T, conn *websocket.Conn) *big.Int {
+	t.Helper()
+	state := conn.NetConn().(*tls.Conn).ConnectionState()
+	return state.PeerCertificates[0].SerialNumber
+}
+
+func TestPlainAndTLSSideBySide(t *testing.T) {
+	dir := t.TempDir()
+	first := write_test_cert(t, dir, "localhost")
+
+	config := New_Test_Config()
+	config.TLS_Address = "127.0.0.1:0"
+	config.TLS_Cert_Dir = dir
+
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(config, nil)
+	go s.Serve(join_listeners(plain, tls.NewListener(secure, s.certs.TLS_Config())))
+	t.Cleanup(func() {
+		s.Close <- true
+		<-s.Done
+	})
+
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	handshake := []byte(`{"cmd":"handshake"}`)
+
+	// Both listeners serve the gateway
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+plain.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatalf("plain connection failed: %v", err)
+	}
+	defer ws.Close()
+	wss, _, err := dialer.Dial("wss://"+secure.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatalf("TLS connection failed: %v", err)
+	}
+	defer wss.Close()
+	if got := peer_serial(t, wss); got.Cmp(first) != 0 {
+		t.Fatalf("served certificate %v, expected %v", got, first)
+	}
+
+	for _, conn := range []*websocket.Conn{ws, wss} {
+		if err := conn.WriteMessage(websocket.TextMessage, handshake); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Replace the certificate on disk and wait for new connections to pick it up
+	second := write_test_cert(t, dir, "localhost")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, _, err := dialer.Dial("wss://"+secure.Addr().String()+"/", nil)
+		if err != nil {
+			t.Fatalf("TLS connection failed after reload: %v", err)
+		}
+		got := peer_serial(t, conn)
+		conn.Close()
+		if got.Cmp(second) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was never reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The connection established before the reload is still usable
+	if err := wss.WriteMessage(websocket.TextMessage, []byte(`{"cmd":"gmsg","val":"still here"}`)); err != nil {
+		t.Fatalf("existing connection was dropped: %v", err)
+	}
+	if _, _, err := wss.ReadMessage(); err != nil {
+		t.Fatalf("existing connection was dropped: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden transcripts in testdata")
+
+// Runs a scenario where a client of every dialect, and a Delta peer, join the default room and send every kind of
+// message, so that each source protocol reaches each target dialect in Apply_Quirks at least once.
+func run_all_dialects(t *testing.T, config *Config) string {
+	b := Start_Test_Bridge(t, config)
+	tr := b.Transcript()
+
+	// Connect everyone first. Nothing is sent to a client until its protocol has been detected.
+	cl2e := b.Connect("cl2e")
+	cl2l := b.Connect("cl2l")
+	cl3a := b.Connect("cl3a")
+	cl3b := b.Connect("cl3b")
+	cl4a := b.Connect("cl4a")
+	cl4b := b.Connect("cl4b")
+	cl4c := b.Connect("cl4c")
+	scratch := b.Connect("scratch")
+	delta := b.Connect_Delta("delta")
+	tr.Collect()
+
+	// Identify every client in a way that selects its dialect
+	tr.Step(cl2e, "<%sn>\ncl2e")
+	tr.Step(cl2l, "<%sh>\n")
+	tr.Step(cl2l, "<%sn>\ncl2l")
+	tr.Step(cl3a, `{"cmd":"setid","val":"cl3a"}`)
+	tr.Step(cl3b, `{"cmd":"direct","val":{"cmd":"type","val":"js"}}`)
+	tr.Step(cl3b, `{"cmd":"setid","val":"cl3b"}`)
+	tr.Step(cl4a, `{"cmd":"setid","val":"cl4a","listener":"id"}`)
+	tr.Step(cl4b, `{"cmd":"handshake"}`)
+	tr.Step(cl4b, `{"cmd":"setid","val":"cl4b"}`)
+	tr.Step(cl4c, `{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+	tr.Step(cl4c, `{"cmd":"setid","val":"cl4c","listener":"id"}`)
+	tr.Step(scratch, `{"method":"handshake","project_id":"default","user":"scratch"}`)
+
+	// CL4 0.2.0 as the source
+	everyone := `["cl2e","cl2l","cl3a","cl3b","cl4a","cl4b","scratch","delta"]`
+	tr.Step(cl4c, `{"cmd":"gmsg","val":"hello from cl4c","listener":"gmsg"}`)
+	tr.Step(cl4c, `{"cmd":"gvar","name":"☁ score","val":"42","listener":"gvar"}`)
+	tr.Step(cl4c, `{"cmd":"pmsg","val":"secret","id":`+everyone+`,"listener":"pmsg"}`)
+	tr.Step(cl4c, `{"cmd":"pvar","name":"answer","val":"yes","id":`+everyone+`,"listener":"pvar"}`)
+	tr.Step(cl4c, `{"cmd":"direct","val":{"cmd":"custom","val":1},"id":`+everyone+`}`)
+	tr.Step(cl4c, `{"cmd":"gvar_rename","name":"☁ score","val":"☁ points","listener":"rename"}`)
+	tr.Step(cl4c, `{"cmd":"gvar_delete","name":"☁ points","listener":"delete"}`)
+
+	// CL3 as the source
+	tr.Step(cl3a, `{"cmd":"gmsg","val":"hello from cl3a"}`)
+	tr.Step(cl3a, `{"cmd":"gvar","name":"☁ level","val":"7"}`)
+
+	// CL2 as the source
+	tr.Step(cl2e, "<%gs>\ncl2e\nhello from cl2e")
+	tr.Step(cl2e, "<%l_g>\n1\ncl2e\n☁ lives\n3")
+	tr.Step(cl2e, "<%ps>\ncl2e\ncl2l\nhello cl2l")
+	tr.Step(cl2e, "<%rl>\ncl2e\ncl2l")
+	tr.Step(cl2e, "<%l_g>\n0\ncl2e\nlinked to cl2l")
+	tr.Step(cl2l, "<%rl>\ncl2l\ncl4a")
+	tr.Step(cl2l, "<%l_g>\n0\ncl2l\nlinked to cl4a")
+	tr.Step(cl2l, "<%l_p>\n0\ncl2l\ncl3b\nhello cl3b")
+
+	// Early CL2 has no linked messages, so these are dropped and record nothing
+	tr.Step(cl2l, "<%l_p>\n0\ncl2l\ncl2e\nhello cl2e")
+
+	// Scratch as the source
+	tr.Step(scratch, `{"method":"set","name":"☁ score","value":"100"}`)
+	tr.Step(scratch, `{"method":"create","name":"☁ coins","value":"5"}`)
+	tr.Step(scratch, `{"method":"rename","name":"☁ coins","new_name":"☁ gems"}`)
+	tr.Step(scratch, `{"method":"delete","name":"☁ gems"}`)
+
+	// Delta as the source
+	tr.Step(delta, `{"opcode":"G_MSG","payload":"hello from delta","ttl":1}`)
+	tr.Step(delta, `{"opcode":"G_VAR","id":"☁ stars","payload":"9","ttl":1}`)
+	tr.Step(delta, `{"opcode":"P_MSG","target":"cl4c","payload":"hi cl4c","ttl":1}`)
+	tr.Step(delta, `{"opcode":"P_VAR","target":"cl4c","id":"secret","payload":"1","ttl":1}`)
+	tr.Step(delta, `{"opcode":"G_VAR_RENAME","id":"☁ stars","payload":"☁ moons","ttl":1}`)
+	tr.Step(delta, `{"opcode":"G_VAR_DELETE","id":"☁ moons","ttl":1}`)
+
+	tr.Disconnect(cl4b)
+	tr.Disconnect(cl2l)
+
+	return tr.String()
+}
+
+func check_golden(t *testing.T, name string, got string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing golden transcript (run with -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("transcript differs from %s (run with -update to accept)\n--- got ---\n%s", path, got)
+	}
+}
+
+func TestTranscriptAllDialects(t *testing.T) {
+	check_golden(t, "all_dialects", run_all_dialects(t, New_Test_Config()))
+}
+
+func TestTranscriptAllDialectsForceSet(t *testing.T) {
+	config := New_Test_Config()
+	config.Force_Set = true
+	check_golden(t, "all_dialects_force_set", run_all_dialects(t, config))
+}
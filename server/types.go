@@ -1,7 +1,10 @@
 package server
 
 import (
+	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/snowflake"
@@ -26,6 +29,28 @@ const (
 	Dialect_CL4_0_2_0
 )
 
+// Returns a human-readable name for a dialect.
+func Dialect_Name(dialect uint) string {
+	switch dialect {
+	case Dialect_CL2_Early:
+		return "cl2-early"
+	case Dialect_CL2_Late:
+		return "cl2-late"
+	case Dialect_CL3_0_1_5:
+		return "cl3-0.1.5"
+	case Dialect_CL3_0_1_7:
+		return "cl3-0.1.7"
+	case Dialect_CL4_0_1_8:
+		return "cl4-0.1.8"
+	case Dialect_CL4_0_1_9:
+		return "cl4-0.1.9"
+	case Dialect_CL4_0_2_0:
+		return "cl4-0.2.0"
+	default:
+		return "undefined"
+	}
+}
+
 type SocketCodes struct {
 	Code    uint
 	Message string
@@ -41,68 +66,44 @@ var (
 	Protocol_Detection_Failure = SocketCodes{4007, "Protocol detection failed"}
 	Protocol_Handler_Failure   = SocketCodes{4008, "Protocol handler failed"}
 	Ratelimit_Exceeded         = SocketCodes{4009, "Packet ratelimit has been exceeded"}
+	Slow_Consumer              = SocketCodes{4010, "Too slow to keep up"}
+	Timeout_Error              = SocketCodes{4011, "Timed out"}
 )
 
+// Finds a predefined socket code by its numeric value.
+func Lookup_Socket_Code(code uint) (SocketCodes, bool) {
+	for _, c := range []SocketCodes{
+		Generic_Error,
+		Username_Error,
+		Overloaded_Status,
+		Unavailable_Status,
+		Security_Error,
+		Identity_Error,
+		Protocol_Detection_Failure,
+		Protocol_Handler_Failure,
+		Ratelimit_Exceeded,
+		Slow_Consumer,
+		Timeout_Error,
+	} {
+		if c.Code == code {
+			return c, true
+		}
+	}
+	return SocketCodes{}, false
+}
+
 type Room struct {
 	Clients    Targets
 	GlobalVars *sync.Map // Protocol-agnostic global variable storage
+	access     room_access
+	mux        sync.RWMutex
+	vars_mux   sync.Mutex  // Serializes changes to GlobalVars
+	project    atomic.Bool // A Scratch client joined it, see Is_Project
 }
 
 type Targets map[*BridgeClient]bool
 type BridgeClients []*BridgeClient
 
-type RoomOp int
-
-const (
-	OpJoinRoom RoomOp = iota
-	OpLeaveRoom
-	OpGetClients
-	OpGetTargets
-	OpDoesRoomExist
-	OpGetActiveRooms
-	OpCanAllocateNRooms
-	OpGetRoomVars
-	OpSetRoomVar
-	OpDeleteRoomVar
-)
-
-func (r RoomOp) String() string {
-	switch r {
-	case OpJoinRoom:
-		return "join room"
-	case OpLeaveRoom:
-		return "leave room"
-	case OpGetClients:
-		return "get clients"
-	case OpGetTargets:
-		return "get targets"
-	case OpDoesRoomExist:
-		return "does room exist"
-	case OpGetActiveRooms:
-		return "get active rooms"
-	case OpCanAllocateNRooms:
-		return "can allocate n rooms"
-	case OpGetRoomVars:
-		return "get room vars"
-	case OpSetRoomVar:
-		return "set room var"
-	case OpDeleteRoomVar:
-		return "delete room var"
-	default:
-		return "unknown"
-	}
-}
-
-type RoomEvent struct {
-	Op      RoomOp
-	Client  *BridgeClient
-	Room    RoomKey
-	N       int
-	Key     any
-	Value   any
-	Respond chan any
-}
-
 type Protocol interface {
 
 	// Helper that runs automatically to clean up any remaining states for a detected protocol once a client disconnects
@@ -113,6 +114,9 @@ type Protocol interface {
 
 	// Lead-in function that detects a client's protocol and dialect, and processes the packet if a protocol match was made.
 	Reader(*BridgeClient, []byte) bool
+
+	// Returns the name that the protocol was registered with.
+	Name() string
 }
 
 type Config struct {
@@ -130,9 +134,19 @@ type Config struct {
 	// The maximum number of concurrently opened rooms. Cannot be less than or equal to zero.
 	Maximum_Rooms uint
 
+	// The maximum number of clients in any room other than the default one. Unlimited if zero.
+	// Clients may open rooms with a lower limit of their own.
+	Maximum_Room_Members uint
+
 	// The maximum number of concurrently connected clients. Cannot be less than or equal to zero.
 	Maximum_Clients uint
 
+	// The maximum number of concurrent connections from a single source IP. Unlimited if zero.
+	Maximum_Clients_Per_IP uint
+
+	// Addresses or CIDR ranges that are exempt from Maximum_Clients_Per_IP, e.g. a trusted reverse proxy.
+	IP_Limit_Exemptions []string
+
 	// If enabled, the server will use a patch that forces the "set" method for ulist events.
 	// It is more network heavy to use instead of incremental updates (the default behavior),
 	// But it addresses unfixed bugs with older CL clients.
@@ -144,39 +158,207 @@ type Config struct {
 	// Rate limiting: Enables the rate limiter.
 	Enable_Rate_Limit bool
 
-	// Rate limiting: Maximum number of messages per interval.
+	// Rate limiting: Each client has a bucket of this many tokens, and every packet takes tokens from it
+	// according to Rate_Limit_Costs. Packets are dropped while the bucket is empty.
 	Rate_Limit_Burst int
 
-	// Rate limiting: The interval at which the message count resets.
+	// Rate limiting: The interval over which an empty bucket is completely refilled.
 	Rate_Limit_Interval time.Duration
 
+	// Rate limiting: Cost of each command in tokens, overriding Default_Rate_Limit_Costs. Every frame is charged
+	// Rate_Limit_Frame_Cost before it is parsed, or the cheapest cost listed here if that is lower, so that commands
+	// can be made cheaper than the default.
+	Rate_Limit_Costs map[string]float64
+
+	// Rate limiting: Size of a bucket shared by every client from the same source IP, refilled over the same interval.
+	// Per-IP rate limiting is disabled if zero.
+	Rate_Limit_IP_Burst int
+
 	// Rate limiting: If enabled, this will kick a client if they exceed the rate limit. Otherwise, packets are dropped.
 	Kick_On_Rate_Limit bool
 
+	// Message sent to every classic client when the server shuts down. Nothing is sent if empty.
+	Shutdown_Message string
+
+	// How long queued packets may take to be written to clients when the server shuts down. Defaults to 10 seconds.
+	Shutdown_Timeout time.Duration
+
+	// Slow consumers: Disconnects a client once this many packets to it were dropped because its writer queue was full.
+	// Disabled if zero.
+	Slow_Consumer_Max_Drops uint64
+
+	// Slow consumers: Disconnects a client once its writer queue has been full for this long. Disabled if zero.
+	Slow_Consumer_Timeout time.Duration
+
+	// How often to send WebSocket pings to classic clients. Disabled if zero.
+	Ping_Interval time.Duration
+
+	// Disconnects classic clients that send nothing, not even a pong, for this long. Disabled if zero.
+	Idle_Timeout time.Duration
+
+	// Disconnects classic clients that haven't been detected and finished their handshake within this long. Disabled if zero.
+	Handshake_Timeout time.Duration
+
+	// Rooms shared with the other bridges in the BridgeRegistry that federate them too. See federation.go.
+	Federated_Rooms []string
+
+	// Node of the snowflake IDs that the bridge gives its clients, from 1 to 1023. Bridges that federate rooms must
+	// use different nodes, so that their clients never share an ID. If zero, it is derived from the designation.
+	Snowflake_Node int64
+
 	// If enabled, the server will only provide the classic Clients server, and won't create or use the Delta protocol.
 	Standalone_Mode bool
 
+	// Names of classic protocols that will not be detected on the WebSocket gateway (i.e. "cl2", "cl4", "scratch").
+	Disabled_Protocols []string
+
+	// Negotiates permessage-deflate with classic clients that offer it.
+	Enable_Compression bool
+
+	// DEFLATE level of compressed frames, from -2 (Huffman coding only) to 9 (best compression). If zero,
+	// Default_Compression_Level (1, best speed) is used, since level 0 would store frames without compressing them.
+	Compression_Level int
+
+	// Frames smaller than this many bytes are sent uncompressed. If zero, Default_Compression_Threshold (512) is used.
+	Compression_Threshold uint
+
+	// Names of classic protocols whose clients are never sent compressed frames, even if they offer compression.
+	Uncompressed_Protocols []string
+
 	// Defines the logging level that the server will use.
 	Log_Level zerolog.Level
+
+	// Format of the logs: "console" (the default) for human-readable logs, or "json".
+	Log_Format string
+
+	// If set, logs are written to this file instead of the standard output.
+	Log_File string
+
+	// Size in megabytes at which the log file is rotated. It is never rotated if zero.
+	Log_File_Max_Size int
+
+	// Number of rotated log files to keep.
+	Log_File_Backups int
+
+	// Log levels of individual subsystems (rooms, cl2, cl4, scratch and delta), overriding Log_Level.
+	Subsystem_Log_Levels map[string]zerolog.Level
+
+	// Only one in this many debug and trace messages of each subsystem is logged. Everything is logged if zero.
+	Log_Sample_Rate uint32
+
+	// If set, the server logs to this logger when embedded. Log_Format and the log file options are ignored.
+	Logger *zerolog.Logger
+
+	// Selects the backend used to persist room global variables. "memory" (the default) only keeps them
+	// while a room is open, and "bolt" stores them on disk so that they survive restarts.
+	Storage_Driver string
+
+	// Path to the database file used by on-disk storage drivers.
+	Storage_Path string
+
+	// If set, this backend is used instead of the one selected by Storage_Driver. Useful when embedding the server.
+	Storage VarStore
+
+	// Scratch: If enabled, cloud variable commands from Scratch clients are validated like the TurboWarp cloud server does.
+	// Names must start with "☁ ", values must be numeric, and violations close the connection. Other clients that
+	// change the variables of a room that Scratch clients joined are held to the same rules: CL4 clients are refused
+	// with a status code, and the changes of CL2 clients and Delta peers are dropped.
+	Scratch_Validation bool
+
+	// Scratch: The maximum length of a cloud variable value. Zero or less disables the limit.
+	Scratch_Max_Value_Length int
+
+	// Scratch: The maximum number of cloud variables per project. Zero or less disables the limit.
+	Scratch_Max_Variables int
+
+	// Decides what happens when a client claims a username that another client in the same room already uses:
+	// "allow" (the default) permits duplicates, "reject" refuses the claim, and "kick" disconnects the older session.
+	Username_Policy string
+
+	// Per-room overrides for Username_Policy, keyed by room name (or Scratch project ID).
+	Room_Username_Policies map[string]string
+
+	// Bearer token that protects the admin API under /admin. The admin API is disabled if left empty.
+	Admin_Token string
+
+	// Path to a JSONL file that every frame sent and received by classic clients is appended to.
+	// Capture is disabled if left empty. See Replay for feeding a capture back into a server.
+	Capture_Path string
+
+	// Address of the TLS listener, which is served alongside the plain listener on Address.
+	// TLS is disabled if left empty.
+	TLS_Address string
+
+	// Only serve the TLS listener.
+	TLS_Only bool
+
+	// Certificate and key of the TLS listener, in PEM format.
+	TLS_Cert_File string
+	TLS_Key_File  string
+
+	// Directory of certificates to use instead of TLS_Cert_File. Each certificate (.crt or .pem) needs a key
+	// with the same name (.key), and is picked by the server name that clients request.
+	TLS_Cert_Dir string
+
+	// Browser origins that may connect to the classic gateway, e.g. https://turbowarp.org or https://*.example.com.
+	// Any origin is accepted if left empty.
+	Allowed_Origins []string
+
+	// Per-room allowlists, keyed by room name (or Scratch project ID). Clients must pass both these and
+	// Allowed_Origins to join a room. An allowlist for the default room is checked when clients connect.
+	Room_Allowed_Origins map[string][]string
+
+	// Reject clients that don't send an Origin header wherever an allowlist applies. If unset, clients without an
+	// origin pass every allowlist, so allowlists only restrict browsers. Non-browser clients usually don't send one.
+	Require_Origin bool
+
+	// Verifies the tokens of classic clients. If nil, an HMAC_Authenticator is used when Auth_HMAC_Key is set.
+	Authenticator Authenticator
+
+	// Shared key used to verify HS256-signed tokens.
+	Auth_HMAC_Key string
+
+	// Name of the query parameter and cookie that carry a token when connecting. Defaults to "token".
+	Auth_Token_Name string
+
+	// Disconnect classic clients with Identity_Error unless they authenticate. CL4 clients may authenticate
+	// with the "token" field of their handshake; every other client must present a token when connecting.
+	Require_Auth bool
 }
 
 type Server struct {
 	Self                  string
 	Logger                *zerolog.Logger
+	loggers               map[string]*zerolog.Logger // Per subsystem
+	log_filters           map[string]*log_filter     // Per subsystem, and "" for the base logger
+	log_file              *rotating_file
 	Close                 chan bool
 	Done                  chan bool
-	Config                *Config
+	config                atomic.Pointer[Config] // Replaced by Reload_Config, see Config
+	config_mux            sync.Mutex             // Serializes reloads
 	instance              *duplex.Instance
+	write_peer            func(*BridgeClient, *duplex.TxPacket) // Sends packets to Delta clients
 	BridgeRegistry        Registry
 	DiscoveryRegistry     Registry
 	registry_mux          sync.RWMutex
 	deltaclientsmu        sync.RWMutex
 	ClassicClients        Targets
 	classicclientsmu      sync.RWMutex
-	RoomsMap              map[RoomKey]*Room // Replaces clients map
-	roomEvents            chan RoomEvent    // Replaces roomsMu
+	shutting_down         bool // Guarded by classicclientsmu
+	rooms                 *Room_Store
+	federation            *federation
 	snowflakeGen          *snowflake.Node
+	store                 *var_writer // Nil if persistence is disabled
+	protocols             []Protocol_Entry
+	Metrics               *Metrics
+	recorder              *Recorder
+	deflaters             sync.Pool // Of *flate.Writer, to measure compression ratios
+	certs                 *Cert_Store
+	auth                  Authenticator
+	ip_limits             *ip_limiter
+	rate_limits           *rate_limiter
 	App                   *fiber.App
+	listener              net.Listener
 	Address               string
 	DeltaResolverCache    map[*duplex.Peer]HelloArgs
 	Predisposed_Instances []string
@@ -288,9 +470,12 @@ type ScratchPacket struct {
 	Method    string `json:"method" jsonschema:"required"`
 	ProjectID string `json:"project_id,omitempty"`
 	User      string `json:"user,omitempty"`
+	Password  string `json:"password,omitempty"` // Joins (or opens) a password-protected project
+	Invite    string `json:"invite,omitempty"`   // Joins a private project with an invite token
 	Name      any    `json:"name,omitempty"`
 	NewName   any    `json:"new_name,omitempty"`
 	Value     any    `json:"value,omitempty"`
+	Origin    any    `json:"-"` // Sender of a broadcast, for the protocols that report it
 }
 
 func (p *ScratchPacket) String() string {
@@ -363,24 +548,46 @@ type HelloArgs struct {
 type RoomKey string
 type RoomKeys []RoomKey
 
+// frame is a message queued for the writer of a classic client.
+type frame struct {
+	data          []byte
+	binary        bool // Otherwise, sent as a text frame
+	deflate       bool // Sent compressed
+	deflated_size int  // Size of the compressed payload
+}
+
 type BridgeClient struct {
 	Conn      *websocket.Conn `json:"-"`
 	ID        string          `json:"id"`
 	Peer      *duplex.Peer    `json:"-"`
 	UUID      string          `json:"uuid"`
 	Username  any             `json:"username,omitempty"`
-	writer    chan []byte     `json:"-"`
+	writer    chan frame      `json:"-"`
 	exit      chan bool       `json:"-"`
+	closing   chan time.Time  `json:"-"` // Asks the writer to flush its queue and close before a deadline
 	Rooms     RoomKeys        `json:"rooms"`
 	room_mux  sync.RWMutex    `json:"-"`
 	state_mux sync.RWMutex    `json:"-"`
 	dialect   uint            `json:"-"`
+	pinned    bool            `json:"-"` // The dialect was declared by the client, see PinDialect
 	Protocol  Protocol        `json:"-"`
 	Server    *Server         `json:"-"`
+	origin    string          `json:"-"` // Origin header of the WebSocket upgrade
+	identity  *Identity       `json:"-"`
+	ip        string          `json:"-"`
+	msgpack   atomic.Bool     `json:"-"` // Framing negotiated by the client. See msgpack.go.
+	deflate   bool            `json:"-"` // The client negotiated permessage-deflate
 
 	// Rate limiting
-	last_msg_time time.Time `json:"-"`
-	msg_count     int       `json:"-"`
+	bucket *token_bucket `json:"-"`
+
+	// Slow consumer detection
+	drops      atomic.Uint64 `json:"-"` // Packets dropped because the writer queue was full
+	full_since atomic.Int64  `json:"-"` // Unix time in nanoseconds at which the writer queue filled up, zero if it isn't full
+	evicted    atomic.Bool   `json:"-"`
+
+	// Timeouts
+	handshaken atomic.Bool `json:"-"` // The client finished its handshake before Handshake_Timeout, see heartbeat.go
 }
 
 func (c *BridgeClient) GetRooms() RoomKeys {
@@ -391,6 +598,15 @@ func (c *BridgeClient) GetRooms() RoomKeys {
 	return rooms
 }
 
+// Adds a room to the list of rooms that the client is in.
+func (c *BridgeClient) track_room(room RoomKey) {
+	c.room_mux.Lock()
+	defer c.room_mux.Unlock()
+	if !slices.Contains(c.Rooms, room) {
+		c.Rooms = append(c.Rooms, room)
+	}
+}
+
 func (c *BridgeClient) GetUsername() any {
 	c.state_mux.RLock()
 	defer c.state_mux.RUnlock()
@@ -415,10 +631,43 @@ func (c *BridgeClient) SetDialect(dialect uint) {
 	c.dialect = dialect
 }
 
+func (c *BridgeClient) GetProtocol() Protocol {
+	c.state_mux.RLock()
+	defer c.state_mux.RUnlock()
+	return c.Protocol
+}
+
+func (c *BridgeClient) SetProtocol(protocol Protocol) {
+	c.state_mux.Lock()
+	defer c.state_mux.Unlock()
+	c.Protocol = protocol
+}
+
+// Returns the verified identity of the client, or nil if it hasn't authenticated.
+func (c *BridgeClient) GetIdentity() *Identity {
+	c.state_mux.RLock()
+	defer c.state_mux.RUnlock()
+	return c.identity
+}
+
+func (c *BridgeClient) SetIdentity(identity *Identity) {
+	c.state_mux.Lock()
+	defer c.state_mux.Unlock()
+	c.identity = identity
+}
+
+// Sets a dialect that UpgradeDialect will never change.
+func (c *BridgeClient) PinDialect(dialect uint) {
+	c.state_mux.Lock()
+	defer c.state_mux.Unlock()
+	c.dialect = dialect
+	c.pinned = true
+}
+
 func (c *BridgeClient) UpgradeDialect(newDialect uint) {
 	c.state_mux.Lock()
 	defer c.state_mux.Unlock()
-	if newDialect > c.dialect {
+	if newDialect > c.dialect && !c.pinned {
 		c.dialect = newDialect
 	}
 }
@@ -441,8 +690,11 @@ func (p *CL2Packet) Packet() Packet {
 
 // Define a unique key for grouping
 type groupKey struct {
-	proto   Protocol
-	dialect uint
+	protocol string
+	dialect  uint
+	binary   bool          // MessagePack framing
+	deflate  bool          // permessage-deflate
+	client   *BridgeClient // Only set for clients that are translated individually
 }
 
 var (
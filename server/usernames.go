@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Username policies. See Config.Username_Policy.
+const (
+	Username_Policy_Allow  = "allow"
+	Username_Policy_Reject = "reject"
+	Username_Policy_Kick   = "kick"
+)
+
+func valid_username_policy(policy string) bool {
+	switch policy {
+	case "", Username_Policy_Allow, Username_Policy_Reject, Username_Policy_Kick:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the username policy that applies to a room.
+func (s *Server) Username_Policy(room RoomKey) string {
+	if policy, ok := s.Config().Room_Username_Policies[string(room)]; ok && policy != "" {
+		return policy
+	}
+	if s.Config().Username_Policy == "" {
+		return Username_Policy_Allow
+	}
+	return s.Config().Username_Policy
+}
+
+// Find_Username_Conflicts returns every other client in a room that already uses a username.
+func (s *Server) Find_Username_Conflicts(c *BridgeClient, room RoomKey, username any) BridgeClients {
+	r := s.rooms.get(room)
+	if r == nil {
+		return nil
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return username_conflicts(r, c, username)
+}
+
+// Returns every other client in a room that already uses a username. The caller must hold the room's lock.
+func username_conflicts(r *Room, c *BridgeClient, username any) BridgeClients {
+	if username == nil || username == "" {
+		return nil
+	}
+	var conflicts BridgeClients
+	wanted := fmt.Sprintf("%v", username)
+	for other := range r.Clients {
+		if other == c || other.UUID == c.UUID {
+			continue
+		}
+		if current := other.GetUsername(); current != nil && current != "" && fmt.Sprintf("%v", current) == wanted {
+			conflicts = append(conflicts, other)
+		}
+	}
+	return conflicts
+}
+
+// Reports whether a member of a federated room on another bridge uses a username.
+func (s *Server) remote_username(room RoomKey, username any) bool {
+	return username != nil && username != "" && s.Is_Federated(room) && s.federation.has_username(room, username)
+}
+
+// Claim_Username enforces the username policy of each room for a client that is about to use a username in them,
+// and gives the client the username if the claim succeeds. Returns false if the claim must be refused.
+// Under the kick policy, older sessions holding the name are removed and the claim succeeds: classic clients are
+// disconnected, while Delta peers only leave the rooms where the name conflicts. Names used by members of federated
+// rooms on other bridges are always refused.
+//
+// The open rooms stay locked from the check until the username is set, so that concurrent claims of the same name
+// see each other. Rooms that aren't open yet are checked again when the client joins them, see admit.
+func (s *Server) Claim_Username(c *BridgeClient, username any, rooms RoomKeys) bool {
+	if username == nil || username == "" {
+		c.SetUsername(username)
+		return true
+	}
+
+	keys := slices.Clone(rooms)
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	// Rooms are always locked in the same order, so that claims can't deadlock each other
+	var locked []*Room
+	unlock := func() {
+		for _, r := range locked {
+			r.mux.Unlock()
+		}
+	}
+	evict := make(map[*BridgeClient]RoomKeys)
+	for _, room := range keys {
+		policy := s.Username_Policy(room)
+
+		// Members on other bridges can't be removed from here, so their names are refused under either policy
+		if policy != Username_Policy_Allow && s.remote_username(room, username) {
+			unlock()
+			s.Logger.Warn().Any("room", room).Msgf("%s ⚠️  Refused username %v: Already in use on another bridge.", c.GiveName(), username)
+			return false
+		}
+
+		r := s.rooms.get(room)
+		if r == nil {
+			continue
+		}
+		r.mux.Lock()
+		locked = append(locked, r)
+
+		if policy == Username_Policy_Allow {
+			continue
+		}
+
+		conflicts := username_conflicts(r, c, username)
+		if len(conflicts) == 0 {
+			continue
+		}
+
+		if policy == Username_Policy_Reject {
+			unlock()
+			s.Logger.Warn().Any("room", room).Msgf("%s ⚠️  Refused username %v: Already in use.", c.GiveName(), username)
+			return false
+		}
+		for _, older := range conflicts {
+			evict[older] = append(evict[older], room)
+		}
+	}
+	c.SetUsername(username)
+	unlock()
+
+	for older, rooms := range evict {
+		s.Logger.Warn().Msgf("%s ⚠️  Replaced by a newer session using the same username.", older.GiveName())
+		if older.Peer != nil {
+			for _, room := range rooms {
+				s.Unlink_Peer(older, room, "Your username is now used by another client in this room.")
+			}
+			continue
+		}
+		s.Evict_Client(older, Username_Error)
+	}
+	return true
+}
+
+// Evict_Client disconnects a classic client with a close code, or closes the connection to a Delta peer.
+func (s *Server) Evict_Client(c *BridgeClient, code SocketCodes) {
+	if c.Peer != nil {
+		c.Peer.Close()
+		return
+	}
+	if c.Conn == nil {
+		return
+	}
+	s.Respond_With_Code(c.Conn, code)
+	c.Conn.Close()
+}
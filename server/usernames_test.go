@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Clients that claim the same name at once must not all get it under the reject policy.
+func TestConcurrentUsernameClaims(t *testing.T) {
+	config := New_Test_Config()
+	config.Username_Policy = Username_Policy_Reject
+	b := Start_Test_Bridge(t, config)
+
+	var clients []*Test_Client
+	for i := range 10 {
+		c := b.Connect(fmt.Sprint("client", i))
+		c.Send(`{"cmd":"handshake","val":{"language":"Scratch","version":"0.2.0"}}`)
+		clients = append(clients, c)
+	}
+	b.Settle()
+	for _, c := range clients {
+		c.Drain()
+	}
+
+	for _, c := range clients {
+		c.Send(`{"cmd":"setid","val":"same","listener":"id"}`)
+	}
+	b.Settle()
+
+	claimed := 0
+	for _, c := range clients {
+		for _, frame := range c.Drain() {
+			if strings.Contains(frame, `"listener":"id"`) && strings.Contains(frame, fmt.Sprintf(`"code_id":%d`, StatusOK.Code)) {
+				claimed++
+			}
+		}
+	}
+	if claimed != 1 {
+		t.Errorf("%d clients claimed the same username, expected 1", claimed)
+	}
+	if conflicts := b.Find_Username_Conflicts(&BridgeClient{}, DEFAULT_ROOM, "same"); len(conflicts) != 1 {
+		t.Errorf("%d clients use the same username", len(conflicts))
+	}
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"cmp"
 	"fmt"
 	"slices"
+	"strings"
 )
 
 func (CL4_or_CL3) isTypeDeclaration(val any) bool {
@@ -19,7 +21,24 @@ func (s *Server) UserObject(c *BridgeClient) *CL4_UserObject {
 	return &CL4_UserObject{ID: c.ID, UUID: c.UUID, Username: c.GetUsername()}
 }
 
+// Get_User_List lists the members of a room that have a username, including those on other bridges if the room
+// is federated. Clients in the filter are left out.
 func (s *Server) Get_User_List(room RoomKey, filter ...*BridgeClient) []*CL4_UserObject {
+	fullList := s.local_user_list(room, filter...)
+	if s.Is_Federated(room) {
+		fullList = append(fullList, s.federation.list(room, "")...)
+	}
+
+	// Snowflake IDs increase over time, so this lists users in the order that they connected
+	slices.SortFunc(fullList, func(a, b *CL4_UserObject) int {
+		return cmp.Or(cmp.Compare(len(a.ID), len(b.ID)), strings.Compare(a.ID, b.ID))
+	})
+
+	return fullList
+}
+
+// Like Get_User_List, but only lists the clients of this bridge, in no particular order.
+func (s *Server) local_user_list(room RoomKey, filter ...*BridgeClient) []*CL4_UserObject {
 	clients := s.Copy_Clients(room)
 	fullList := make([]*CL4_UserObject, 0)
 
@@ -33,7 +52,6 @@ func (s *Server) Get_User_List(room RoomKey, filter ...*BridgeClient) []*CL4_Use
 			fullList = append(fullList, s.UserObject(client))
 		}
 	}
-
 	return fullList
 }
 
@@ -86,28 +104,38 @@ func (s *Server) Get_Target_Rooms(client *BridgeClient, roomsContext any) RoomKe
 	return targetRooms
 }
 
-// Is_Client_In_Room checks if the client is currently subscribed to a specific room
-func (s *Server) Is_Client_In_Room(client *BridgeClient, room RoomKey) bool {
-	clientsInRoom := s.Copy_Clients(room)
-	for _, c := range clientsInRoom {
-		if c.UUID == client.UUID {
-			return true
-		}
+// Room_Var is a single global variable of a room.
+type Room_Var struct {
+	Name  any
+	Value any
+}
+
+// Get_Room_Vars returns a snapshot of a room's global variables, ordered by name.
+func (s *Server) Get_Room_Vars(room RoomKey) []Room_Var {
+	gv := s.GetRoomGlobalVars(room)
+	if gv == nil {
+		return nil
 	}
-	return false
+
+	var vars []Room_Var
+	gv.Range(func(key, value any) bool {
+		vars = append(vars, Room_Var{Name: key, Value: value})
+		return true
+	})
+	slices.SortFunc(vars, func(a, b Room_Var) int {
+		return strings.Compare(fmt.Sprintf("%v", a.Name), fmt.Sprintf("%v", b.Name))
+	})
+	return vars
 }
 
 // Sync_Room_State loops through a room's global variables and unicasts them to a client
 func (s *Server) Sync_Room_State(client *BridgeClient, room RoomKey) {
-	if gv := s.GetRoomGlobalVars(room); gv != nil {
-		gv.Range(func(key, value any) bool {
-			s.Unicast(client, &Common_Packet{
-				Command: "gvar",
-				Name:    key,
-				Value:   value,
-				Rooms:   room,
-			})
-			return true
+	for _, v := range s.Get_Room_Vars(room) {
+		s.Unicast(client, &Common_Packet{
+			Command: "gvar",
+			Name:    v.Name,
+			Value:   v.Value,
+			Rooms:   room,
 		})
 	}
 }